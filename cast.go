@@ -0,0 +1,171 @@
+package capytest
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// DefaultCastDir is where asciinema recordings of interactive sessions are
+// written, relative to the package directory. CAPYTEST_CAST_DIR overrides
+// it.
+var DefaultCastDir = "__casts__"
+
+// castMode tells when to write recordings: "failed" (the default) writes
+// them for failed tests only, "always" for every interactive command and
+// "never" disables them. It is set with CAPYTEST_CAST.
+func castMode() string {
+	switch mode := os.Getenv("CAPYTEST_CAST"); mode {
+	case "always", "never":
+		return mode
+	default:
+		return "failed"
+	}
+}
+
+func castDir() string {
+	if dir := os.Getenv("CAPYTEST_CAST_DIR"); dir != "" {
+		return dir
+	}
+	return DefaultCastDir
+}
+
+type castEvent struct {
+	time float64
+	kind string
+	data string
+}
+
+// castRecorder keeps the input, output and resizes of an interactive
+// session with their timestamps, for writing an asciinema v2 recording.
+type castRecorder struct {
+	mu      sync.Mutex
+	secrets *Secrets
+	start   time.Time
+	width   int
+	height  int
+	events  []castEvent
+}
+
+func newCastRecorder(s *Secrets, rows, cols uint16) *castRecorder {
+	return &castRecorder{secrets: s, start: time.Now(), width: int(cols), height: int(rows)}
+}
+
+func (r *castRecorder) add(kind, data string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, castEvent{time.Since(r.start).Seconds(), kind, data})
+}
+
+func (r *castRecorder) output(data string) {
+	r.add("o", data)
+}
+
+func (r *castRecorder) input(data []byte) {
+	r.add("i", string(data))
+}
+
+func (r *castRecorder) resize(rows, cols uint16) {
+	r.add("r", fmt.Sprintf("%dx%d", cols, rows))
+}
+
+func (r *castRecorder) terminalEvents() []TerminalEvent {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.terminalEventsLocked()
+}
+
+func (r *castRecorder) terminalEventsLocked() []TerminalEvent {
+	events := make([]TerminalEvent, len(r.events))
+	for i, e := range r.events {
+		events[i] = TerminalEvent{Time: e.time, Kind: e.kind, Data: e.data}
+	}
+	return events
+}
+
+func (r *castRecorder) write(path, title string, cmd []string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	enc := json.NewEncoder(f)
+	header := map[string]any{
+		"version":   2,
+		"width":     r.width,
+		"height":    r.height,
+		"timestamp": r.start.Unix(),
+		"title":     title,
+		"command":   r.secrets.Mask(strings.Join(cmd, " ")),
+	}
+	if err := enc.Encode(header); err != nil {
+		return err
+	}
+	events := r.terminalEventsLocked()
+	r.secrets.maskEvents(events)
+	for _, e := range events {
+		if e.Data == "" {
+			continue
+		}
+		if err := enc.Encode([]any{e.Time, e.Kind, e.Data}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var castNames struct {
+	sync.Mutex
+	used map[string]int
+}
+
+var unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// castPath returns a file name for a recording of the test; tests running
+// several interactive commands get numbered files.
+func castPath(t *testing.T) string {
+	name := unsafeFileChars.ReplaceAllString(t.Name(), "_")
+
+	castNames.Lock()
+	defer castNames.Unlock()
+	if castNames.used == nil {
+		castNames.used = map[string]int{}
+	}
+	castNames.used[name]++
+	if n := castNames.used[name]; n > 1 {
+		name = fmt.Sprintf("%s_%d", name, n)
+	}
+	return filepath.Join(castDir(), name+".cast")
+}
+
+// saveCast writes the recording if the mode asks for it.
+func (c *commandBuilder) saveCast(t *testing.T, rec *castRecorder) {
+	t.Helper()
+
+	switch mode := castMode(); {
+	case mode == "never":
+		return
+	case mode == "failed" && !t.Failed():
+		return
+	}
+
+	path := castPath(t)
+	if err := rec.write(path, t.Name(), c.cmd); err != nil {
+		t.Logf("failed to write terminal recording: %v", err)
+		return
+	}
+	t.Logf("terminal recording: %s (play with `asciinema play %s`)", path, path)
+}
@@ -0,0 +1,10 @@
+module go.alt-gnome.ru/capytest/cmd/capytest
+
+go 1.24.4
+
+require (
+	github.com/creack/pty v1.1.24
+	golang.org/x/term v0.34.0
+)
+
+require golang.org/x/sys v0.35.0 // indirect
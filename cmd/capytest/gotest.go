@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go/format"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.alt-gnome.ru/capytest"
+)
+
+// capytestModule is the module of the library; every provider is a module
+// of its own below it.
+const capytestModule = "go.alt-gnome.ru/capytest"
+
+// sourceEnv points to a checkout of the capytest modules, for programs
+// built without their versions, e.g. in a go.work workspace.
+const sourceEnv = "CAPYTEST_SOURCE_DIR"
+
+// goTest runs the scenario files given by indexes in a test package of a
+// temporary module, with `go test`, and fills in their results.
+func goTest(f runFlags, files []string, indexes []int, results []scenarioResult) error {
+	dir, err := os.MkdirTemp("", "capytest-run")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	mod, err := goMod(f.provider)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, "go.mod"), []byte(mod), 0o644); err != nil {
+		return err
+	}
+	code, err := generateTests(f, files, indexes)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, "scenarios_test.go"), []byte(code), 0o644); err != nil {
+		return err
+	}
+
+	env, err := goTestEnv()
+	if err != nil {
+		return err
+	}
+	tidy := exec.Command("go", "mod", "tidy")
+	tidy.Dir = dir
+	tidy.Env = env
+	if out, err := tidy.CombinedOutput(); err != nil {
+		return fmt.Errorf("go mod tidy: %v\n%s", err, out)
+	}
+
+	cmd := exec.Command("go", "test", "-json", "-count=1", "-timeout=0", "-parallel="+strconv.Itoa(f.parallel), ".")
+	cmd.Dir = dir
+	cmd.Env = env
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	done := map[int]bool{}
+	var pkgOutput strings.Builder
+	readTestEvents(stdout, results, done, &pkgOutput)
+	err = cmd.Wait()
+
+	// A package that failed to build has no test results.
+	for _, i := range indexes {
+		if done[i] {
+			continue
+		}
+		results[i].output += pkgOutput.String() + stderr.String()
+		if results[i].output == "" && err != nil {
+			results[i].output = err.Error()
+		}
+	}
+	return nil
+}
+
+// testEvent is an event of `go test -json`.
+type testEvent struct {
+	Action  string
+	Test    string
+	Output  string
+	Elapsed float64
+}
+
+// readTestEvents adds the output and the result of every test to the
+// result of its scenario, and the output of the package to pkgOutput.
+func readTestEvents(r io.Reader, results []scenarioResult, done map[int]bool, pkgOutput *strings.Builder) {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, 16<<20)
+	for sc.Scan() {
+		var e testEvent
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			pkgOutput.WriteString(sc.Text() + "\n")
+			continue
+		}
+		name, _, sub := strings.Cut(e.Test, "/")
+		i, ok := scenarioIndex(name)
+		if !ok || i >= len(results) {
+			if e.Action == "output" {
+				pkgOutput.WriteString(e.Output)
+			}
+			continue
+		}
+		switch e.Action {
+		case "output":
+			results[i].output += e.Output
+		case "pass", "fail":
+			if !sub {
+				results[i].passed = e.Action == "pass"
+				results[i].duration = time.Duration(e.Elapsed * float64(time.Second))
+				done[i] = true
+			}
+		}
+	}
+}
+
+// testName is the name of the test running the scenario file with index i.
+func testName(i int) string {
+	return fmt.Sprintf("TestScenario%d", i)
+}
+
+func scenarioIndex(name string) (int, bool) {
+	n, ok := strings.CutPrefix(name, "TestScenario")
+	if !ok {
+		return 0, false
+	}
+	i, err := strconv.Atoi(n)
+	return i, err == nil
+}
+
+// generateTests returns a test file with a test for every scenario file,
+// each with a provider of its own.
+func generateTests(f runFlags, files []string, indexes []int) (string, error) {
+	var b bytes.Buffer
+	b.WriteString("// Code generated by capytest run. DO NOT EDIT.\n\npackage scenarios\n\n")
+	fmt.Fprintf(&b, "import (\n\"testing\"\n\n%q\n%q\n)\n\n", capytestModule, capytestModule+"/providers/"+f.provider)
+
+	b.WriteString("func provider() capytest.Provider {\n")
+	switch f.provider {
+	case "podman":
+		fmt.Fprintf(&b, "return podman.Provider(podman.WithImage(%s))\n", strconv.Quote(f.image))
+	default:
+		fmt.Fprintf(&b, "return %s.Provider()\n", f.provider)
+	}
+	b.WriteString("}\n")
+
+	for _, i := range indexes {
+		file, err := filepath.Abs(files[i])
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&b, "\nfunc %s(t *testing.T) {\nt.Parallel()\ncapytest.RunScenarios(t, provider(), %s)\n}\n", testName(i), strconv.Quote(file))
+	}
+
+	code, err := format.Source(b.Bytes())
+	if err != nil {
+		return "", fmt.Errorf("failed to format generated code: %w", err)
+	}
+	return string(code), nil
+}
+
+// goMod returns the go.mod of the module the scenarios run in, which
+// requires the versions of the capytest modules this program was built
+// with. Without versions, the modules are replaced by a checkout: the one
+// in $CAPYTEST_SOURCE_DIR or the one this program was built from.
+func goMod(provider string) (string, error) {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "", errors.New("no build information in the capytest executable")
+	}
+	deps := map[string]*debug.Module{}
+	for _, dep := range info.Deps {
+		deps[dep.Path] = dep
+	}
+
+	var b strings.Builder
+	b.WriteString("module capytest.run\n\ngo 1.24.4\n")
+	for _, mod := range []string{capytestModule, capytestModule + "/providers/" + provider} {
+		dep := deps[mod]
+		if dep == nil {
+			return "", fmt.Errorf("the capytest executable does not include %s", mod)
+		}
+		if dep.Replace != nil {
+			dep = dep.Replace
+		}
+		if dep.Version != "" && dep.Version != "(devel)" {
+			fmt.Fprintf(&b, "require %s %s\n", mod, dep.Version)
+			if dep.Path != mod {
+				fmt.Fprintf(&b, "replace %s => %s %s\n", mod, dep.Path, dep.Version)
+			}
+			continue
+		}
+
+		src, err := sourceDir()
+		if err != nil {
+			return "", err
+		}
+		dir := filepath.Join(src, strings.TrimPrefix(mod, capytestModule))
+		fmt.Fprintf(&b, "require %s v0.0.0\nreplace %s => %s\n", mod, mod, strconv.Quote(dir))
+	}
+	return b.String(), nil
+}
+
+// sourceDir returns the checkout of the capytest modules.
+func sourceDir() (string, error) {
+	if dir := os.Getenv(sourceEnv); dir != "" {
+		return filepath.Abs(dir)
+	}
+	if _, file, _, ok := runtime.Caller(0); ok && filepath.IsAbs(file) {
+		dir := filepath.Dir(filepath.Dir(filepath.Dir(file)))
+		if _, err := os.Stat(filepath.Join(dir, "go.mod")); err == nil {
+			return dir, nil
+		}
+	}
+	return "", fmt.Errorf("the capytest modules have no version; set %s to a checkout of them", sourceEnv)
+}
+
+// goTestEnv returns the environment of the go commands. The generated
+// module is used on its own, and the directories of the reports and the
+// recordings are made absolute, so that they don't end up in the
+// temporary directory.
+func goTestEnv() ([]string, error) {
+	env := append(os.Environ(), "GOWORK=off", "GOFLAGS=-mod=mod")
+	for _, name := range []string{"CAPYTEST_REPORT_DIR", "CAPYTEST_CAST_DIR"} {
+		dir := os.Getenv(name)
+		if dir == "" && name == "CAPYTEST_CAST_DIR" {
+			dir = capytest.DefaultCastDir
+		}
+		if dir == "" {
+			continue
+		}
+		abs, err := filepath.Abs(dir)
+		if err != nil {
+			return nil, err
+		}
+		env = append(env, name+"="+abs)
+	}
+	return env, nil
+}
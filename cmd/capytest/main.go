@@ -0,0 +1,51 @@
+// Command capytest is the command-line companion of the capytest library.
+//
+// Usage:
+//
+//	capytest record [flags] -- program [args...]
+//	capytest run [flags] file|dir|glob...
+//	capytest report [flags] file.jsonl...
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+)
+
+type command struct {
+	run   func(args []string) int
+	short string
+}
+
+var commands = map[string]command{
+	"record": {record, "record a terminal session as a test"},
+	"report": {report, "render JSON reports as an HTML page"},
+	"run":    {run, "run scenario files and report the results"},
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: capytest <command> [arguments]\n\ncommands:\n")
+	var names []string
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", name, commands[name].short)
+	}
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "capytest: unknown command %q\n", os.Args[1])
+		usage()
+		os.Exit(2)
+	}
+	os.Exit(cmd.run(os.Args[2:]))
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"go/format"
+	"os"
+	"os/exec"
+	"os/signal"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"unicode/utf8"
+
+	"github.com/creack/pty"
+	"golang.org/x/term"
+)
+
+func record(args []string) int {
+	fs := flag.NewFlagSet("record", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: capytest record [flags] -- program [args...]\n\n")
+		fmt.Fprintf(fs.Output(), "Runs the program in a terminal and prints a test replaying the session.\n\n")
+		fs.PrintDefaults()
+	}
+	output := fs.String("o", "", "write the test to `file` instead of stdout")
+	name := fs.String("name", "recorded session", "`name` of the generated test case")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	rec, err := recordSession(fs.Args())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "capytest: %v\n", err)
+		return 1
+	}
+
+	code, err := generateGo(*name, rec)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "capytest: %v\n", err)
+		return 1
+	}
+
+	if *output == "" {
+		fmt.Print(code)
+		return 0
+	}
+	if err := os.WriteFile(*output, []byte(code), 0o644); err != nil {
+		fmt.Fprintf(os.Stderr, "capytest: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+type inputKind int
+
+const (
+	// inputLine is text terminated by Enter, replayed with SendLine.
+	inputLine inputKind = iota
+	// inputText is text or a key sequence sent as is.
+	inputText
+	inputInterrupt
+)
+
+// inputEvent is one step of the session: the input and the output that
+// followed it, up to the next input.
+type inputEvent struct {
+	kind   inputKind
+	data   string
+	output string
+}
+
+type recording struct {
+	argv []string
+
+	// output is what the program printed before the first input.
+	output   string
+	events   []inputEvent
+	exitCode int
+}
+
+// recorder splits the session into input events. Typed characters are
+// collected until Enter, so that line editing with backspace collapses into
+// the final line.
+type recorder struct {
+	mu    sync.Mutex
+	rec   *recording
+	typed []byte
+	out   strings.Builder
+}
+
+func (r *recorder) output(data []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.out.Write(data)
+}
+
+func (r *recorder) input(data []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i := 0; i < len(data); i++ {
+		b := data[i]
+		switch {
+		case b == '\r' || b == '\n':
+			r.emit(inputEvent{kind: inputLine, data: string(r.typed)})
+			r.typed = nil
+		case b == 3:
+			r.flushTyped()
+			r.emit(inputEvent{kind: inputInterrupt})
+		case b == 0x7f || b == '\b':
+			if len(r.typed) > 0 {
+				_, size := utf8.DecodeLastRune(r.typed)
+				r.typed = r.typed[:len(r.typed)-size]
+			} else {
+				r.emit(inputEvent{kind: inputText, data: string(b)})
+			}
+		case b == 0x1b:
+			// Escape sequences of a key arrive in a single read.
+			r.flushTyped()
+			r.emit(inputEvent{kind: inputText, data: string(data[i:])})
+			return
+		case b < 0x20:
+			r.flushTyped()
+			r.emit(inputEvent{kind: inputText, data: string(b)})
+		default:
+			r.typed = append(r.typed, b)
+		}
+	}
+}
+
+func (r *recorder) flushTyped() {
+	if len(r.typed) > 0 {
+		r.emit(inputEvent{kind: inputText, data: string(r.typed)})
+		r.typed = nil
+	}
+}
+
+// emit attaches the output received so far to the previous event and
+// starts a new one.
+func (r *recorder) emit(e inputEvent) {
+	r.attachOutput()
+	r.rec.events = append(r.rec.events, e)
+}
+
+func (r *recorder) attachOutput() {
+	if len(r.rec.events) == 0 {
+		r.rec.output += r.out.String()
+	} else {
+		r.rec.events[len(r.rec.events)-1].output += r.out.String()
+	}
+	r.out.Reset()
+}
+
+func (r *recorder) finish() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.flushTyped()
+	r.attachOutput()
+}
+
+// recordSession runs argv in a pty connected to the user's terminal.
+func recordSession(argv []string) (*recording, error) {
+	cmd := exec.Command(argv[0], argv[1:]...)
+	ptmx, err := pty.Start(cmd)
+	if err != nil {
+		return nil, err
+	}
+	defer ptmx.Close()
+
+	stdin := int(os.Stdin.Fd())
+	if term.IsTerminal(stdin) {
+		state, err := term.MakeRaw(stdin)
+		if err != nil {
+			return nil, err
+		}
+		defer term.Restore(stdin, state)
+
+		pty.InheritSize(os.Stdin, ptmx)
+		winch := make(chan os.Signal, 1)
+		signal.Notify(winch, syscall.SIGWINCH)
+		defer signal.Stop(winch)
+		go func() {
+			for range winch {
+				pty.InheritSize(os.Stdin, ptmx)
+			}
+		}()
+	}
+
+	r := &recorder{rec: &recording{argv: argv}}
+
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, err := os.Stdin.Read(buf)
+			if n > 0 {
+				r.input(buf[:n])
+				ptmx.Write(buf[:n])
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	buf := make([]byte, 4096)
+	for {
+		n, err := ptmx.Read(buf)
+		if n > 0 {
+			r.output(buf[:n])
+			os.Stdout.Write(buf[:n])
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	cmd.Wait()
+	r.finish()
+	r.rec.exitCode = exitCode(cmd.ProcessState)
+	return r.rec, nil
+}
+
+func exitCode(state *os.ProcessState) int {
+	if status, ok := state.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return 128 + int(status.Signal())
+	}
+	return state.ExitCode()
+}
+
+var ansiEscape = regexp.MustCompile(`\x1b\[[0-9;?]*[ -/]*[@-~]|\x1b\][^\x07\x1b]*(\x07|\x1b\\)|\x1b[()][A-Za-z0-9]|\x1b[=>]`)
+
+// expectation picks the text to expect from the output of a step: the last
+// complete line that is not the echo of the input, or else the trailing
+// partial line, which is usually a prompt.
+func expectation(output, input string) string {
+	output = ansiEscape.ReplaceAllString(output, "")
+	output = strings.ReplaceAll(output, "\r", "")
+	lines := strings.Split(output, "\n")
+	partial := strings.TrimSpace(lines[len(lines)-1])
+	for i := len(lines) - 2; i >= 0; i-- {
+		line := strings.TrimSpace(lines[i])
+		if line == "" || (i == 0 && line == strings.TrimSpace(input)) {
+			continue
+		}
+		return line
+	}
+	return partial
+}
+
+func generateGo(name string, rec *recording) (string, error) {
+	var b bytes.Buffer
+
+	fmt.Fprintf(&b, "ts.Run(%s, func(t *testing.T, r capytest.Runner) {\n", strconv.Quote(name))
+	fmt.Fprintf(&b, "r.Command(%s).\n", quoteArgs(rec.argv))
+
+	next := "Do()"
+	if exp := expectation(rec.output, ""); exp != "" {
+		fmt.Fprintf(&b, "%s.ExpectOutputContains(%s).\n", next, strconv.Quote(exp))
+		next = "Then()"
+	}
+	for _, e := range rec.events {
+		switch e.kind {
+		case inputLine:
+			fmt.Fprintf(&b, "%s.SendLine(%s)", next, strconv.Quote(e.data))
+		case inputText:
+			fmt.Fprintf(&b, "%s.SendString(%s)", next, strconv.Quote(e.data))
+		case inputInterrupt:
+			fmt.Fprintf(&b, "%s.Interrupt()", next)
+		}
+		if exp := expectation(e.output, e.data); exp != "" {
+			fmt.Fprintf(&b, ".ExpectOutputContains(%s)", strconv.Quote(exp))
+		}
+		b.WriteString(".\n")
+		next = "Then()"
+	}
+	if next == "Do()" {
+		fmt.Fprintf(&b, "ExpectExitCode(%d).\n", rec.exitCode)
+	} else {
+		fmt.Fprintf(&b, "Done().ExpectExitCode(%d).\n", rec.exitCode)
+	}
+	b.WriteString("Run(t)\n})\n")
+
+	code, err := format.Source(b.Bytes())
+	if err != nil {
+		return "", fmt.Errorf("failed to format generated code: %w", err)
+	}
+	return string(code), nil
+}
+
+func quoteArgs(argv []string) string {
+	quoted := make([]string, len(argv))
+	for i, arg := range argv {
+		quoted[i] = strconv.Quote(arg)
+	}
+	return strings.Join(quoted, ", ")
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRecordGeneratesSteps(t *testing.T) {
+	r := &recorder{rec: &recording{argv: []string{"bc", "-q"}}}
+
+	r.output([]byte("bc 1.07\r\n"))
+	r.input([]byte("2+3"))
+	r.input([]byte{0x7f})
+	r.input([]byte("2\r"))
+	r.output([]byte("2+2\r\n\x1b[1m4\x1b[0m\r\n"))
+	r.input([]byte{3})
+	r.output([]byte("^C\r\n"))
+	r.input([]byte{4})
+	r.finish()
+	r.rec.exitCode = 0
+
+	code, err := generateGo("bc adds", r.rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `ts.Run("bc adds", func(t *testing.T, r capytest.Runner) {
+	r.Command("bc", "-q").
+		Do().ExpectOutputContains("bc 1.07").
+		Then().SendLine("2+2").ExpectOutputContains("4").
+		Then().Interrupt().ExpectOutputContains("^C").
+		Then().SendString("\x04").
+		Done().ExpectExitCode(0).
+		Run(t)
+})
+`
+	if strings.TrimSpace(code) != strings.TrimSpace(want) {
+		t.Errorf("unexpected code:\n%s\nwant:\n%s", code, want)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"go.alt-gnome.ru/capytest"
+)
+
+func report(args []string) int {
+	fs := flag.NewFlagSet("report", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: capytest report [flags] file.jsonl...\n\n")
+		fmt.Fprintf(fs.Output(), "Renders the JSON reports written to CAPYTEST_REPORT_DIR as one HTML page.\n\n")
+		fs.PrintDefaults()
+	}
+	output := fs.String("o", "report.html", "write the page to `file`")
+	title := fs.String("title", "capytest report", "`title` of the page")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	var records []*capytest.CommandRecord
+	for _, path := range fs.Args() {
+		recs, err := readRecords(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "capytest: %s: %v\n", path, err)
+			return 1
+		}
+		records = append(records, recs...)
+	}
+
+	f, err := os.Create(*output)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "capytest: %v\n", err)
+		return 1
+	}
+	defer f.Close()
+	if err := capytest.WriteHTMLReport(f, *title, records); err != nil {
+		fmt.Fprintf(os.Stderr, "capytest: failed to write report: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+func readRecords(path string) ([]*capytest.CommandRecord, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var records []*capytest.CommandRecord
+	dec := json.NewDecoder(f)
+	for {
+		var rec capytest.CommandRecord
+		if err := dec.Decode(&rec); errors.Is(err, io.EOF) {
+			return records, nil
+		} else if err != nil {
+			return nil, err
+		}
+		records = append(records, &rec)
+	}
+}
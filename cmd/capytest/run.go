@@ -0,0 +1,260 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"go.alt-gnome.ru/capytest"
+	"go.alt-gnome.ru/capytest/providers/local"
+	"go.alt-gnome.ru/capytest/providers/podman"
+)
+
+type runFlags struct {
+	provider string
+	image    string
+	parallel int
+	format   string
+	output   string
+}
+
+func run(args []string) int {
+	fs := flag.NewFlagSet("run", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: capytest run [flags] file|dir|glob...\n\n")
+		fmt.Fprintf(fs.Output(), "Runs scenario files and prints a TAP or JUnit report.\n")
+		fmt.Fprintf(fs.Output(), "Directories are searched for *.txt files.\n\n")
+		fs.PrintDefaults()
+	}
+	var f runFlags
+	fs.StringVar(&f.provider, "provider", "local", "`name` of the provider to run in: local or podman")
+	fs.StringVar(&f.image, "image", "", "container `image` for the podman provider")
+	fs.IntVar(&f.parallel, "parallel", runtime.NumCPU(), "run up to `n` scenarios at once")
+	fs.StringVar(&f.format, "format", "tap", "report `format`: tap or junit")
+	fs.StringVar(&f.output, "o", "", "write the report to `file` instead of stdout")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+	if f.parallel < 1 {
+		f.parallel = 1
+	}
+
+	if _, err := newProvider(f.provider, f.image); err != nil {
+		fmt.Fprintf(os.Stderr, "capytest: %v\n", err)
+		return 2
+	}
+
+	var report func(io.Writer, []scenarioResult) error
+	switch f.format {
+	case "tap":
+		report = writeTAP
+	case "junit":
+		report = writeJUnit
+	default:
+		fmt.Fprintf(os.Stderr, "capytest: unknown format %q\n", f.format)
+		return 2
+	}
+
+	files, err := scenarioFiles(fs.Args())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "capytest: %v\n", err)
+		return 2
+	}
+
+	results := runScenarios(f, files)
+
+	out := io.Writer(os.Stdout)
+	if f.output != "" {
+		file, err := os.Create(f.output)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "capytest: %v\n", err)
+			return 1
+		}
+		defer file.Close()
+		out = file
+	}
+	if err := report(out, results); err != nil {
+		fmt.Fprintf(os.Stderr, "capytest: failed to write report: %v\n", err)
+		return 1
+	}
+
+	for _, r := range results {
+		if !r.passed {
+			return 1
+		}
+	}
+	return 0
+}
+
+func newProvider(name, image string) (capytest.Provider, error) {
+	switch name {
+	case "local":
+		return local.Provider(), nil
+	case "podman":
+		if image == "" {
+			return nil, errors.New("the podman provider needs -image")
+		}
+		return podman.Provider(podman.WithImage(image)), nil
+	default:
+		return nil, fmt.Errorf("unknown provider %q", name)
+	}
+}
+
+// scenarioFiles expands the arguments into a sorted list of files.
+func scenarioFiles(args []string) ([]string, error) {
+	seen := map[string]bool{}
+	var files []string
+	for _, arg := range args {
+		matches := []string{arg}
+		if info, err := os.Stat(arg); err == nil && info.IsDir() {
+			matches, _ = filepath.Glob(filepath.Join(arg, "*.txt"))
+		} else if err != nil {
+			matches, err = filepath.Glob(arg)
+			if err != nil {
+				return nil, fmt.Errorf("invalid pattern %q: %v", arg, err)
+			}
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("no scenario files match %s", arg)
+		}
+		for _, m := range matches {
+			if !seen[m] {
+				seen[m] = true
+				files = append(files, m)
+			}
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+type scenarioResult struct {
+	file     string
+	name     string
+	passed   bool
+	duration time.Duration
+	output   string
+}
+
+// runScenarios runs the files with `go test`, up to f.parallel at a time,
+// and returns the results in the order of files.
+func runScenarios(f runFlags, files []string) []scenarioResult {
+	results := make([]scenarioResult, len(files))
+	var valid []int
+	for i, file := range files {
+		results[i] = scenarioResult{
+			file: file,
+			name: strings.TrimSuffix(filepath.Base(file), filepath.Ext(file)),
+		}
+
+		// Syntax errors are reported without starting anything.
+		data, err := os.ReadFile(file)
+		if err == nil {
+			_, err = capytest.ParseScenario(file, data)
+		}
+		if err != nil {
+			results[i].output = err.Error()
+			continue
+		}
+		valid = append(valid, i)
+	}
+	if len(valid) == 0 {
+		return results
+	}
+
+	if err := goTest(f, files, valid, results); err != nil {
+		for _, i := range valid {
+			results[i].output = fmt.Sprintf("failed to run go test: %v", err)
+		}
+	}
+	return results
+}
+
+func writeTAP(w io.Writer, results []scenarioResult) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "TAP version 13\n1..%d\n", len(results))
+	for i, r := range results {
+		status := "ok"
+		if !r.passed {
+			status = "not ok"
+		}
+		fmt.Fprintf(&b, "%s %d - %s\n", status, i+1, r.name)
+		if r.passed {
+			continue
+		}
+		fmt.Fprintf(&b, "  ---\n  file: %q\n  duration_ms: %d\n  output: |\n", r.file, r.duration.Milliseconds())
+		for _, line := range strings.Split(strings.TrimRight(r.output, "\n"), "\n") {
+			fmt.Fprintf(&b, "    %s\n", line)
+		}
+		b.WriteString("  ...\n")
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+type junitSuite struct {
+	XMLName  xml.Name    `xml:"testsuite"`
+	Name     string      `xml:"name,attr"`
+	Tests    int         `xml:"tests,attr"`
+	Failures int         `xml:"failures,attr"`
+	Time     string      `xml:"time,attr"`
+	Cases    []junitCase `xml:"testcase"`
+}
+
+type junitCase struct {
+	Name      string        `xml:"name,attr"`
+	Classname string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Output  string `xml:",chardata"`
+}
+
+func writeJUnit(w io.Writer, results []scenarioResult) error {
+	suite := junitSuite{Name: "capytest", Tests: len(results)}
+	var total time.Duration
+	for _, r := range results {
+		total += r.duration
+		c := junitCase{
+			Name:      r.name,
+			Classname: filepath.Dir(r.file),
+			Time:      seconds(r.duration),
+		}
+		if !r.passed {
+			suite.Failures++
+			c.Failure = &junitFailure{Message: "scenario failed", Output: r.output}
+		}
+		suite.Cases = append(suite.Cases, c)
+	}
+	suite.Time = seconds(total)
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(suite); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+func seconds(d time.Duration) string {
+	return fmt.Sprintf("%.3f", d.Seconds())
+}
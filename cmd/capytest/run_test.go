@@ -0,0 +1,130 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteTAP(t *testing.T) {
+	results := []scenarioResult{
+		{file: "testdata/ok.txt", name: "ok", passed: true},
+		{file: "testdata/broken.txt", name: "broken", duration: 1500 * time.Millisecond, output: "--- FAIL: scenario\nstdout does not contain \"hi\"\n"},
+	}
+
+	var b strings.Builder
+	if err := writeTAP(&b, results); err != nil {
+		t.Fatal(err)
+	}
+
+	want := `TAP version 13
+1..2
+ok 1 - ok
+not ok 2 - broken
+  ---
+  file: "testdata/broken.txt"
+  duration_ms: 1500
+  output: |
+    --- FAIL: scenario
+    stdout does not contain "hi"
+  ...
+`
+	if b.String() != want {
+		t.Errorf("unexpected TAP output:\n%s\nwant:\n%s", b.String(), want)
+	}
+}
+
+func TestWriteJUnit(t *testing.T) {
+	results := []scenarioResult{
+		{file: "testdata/ok.txt", name: "ok", passed: true, duration: 250 * time.Millisecond},
+		{file: "testdata/broken.txt", name: "broken", duration: 1500 * time.Millisecond, output: "stdout does not contain \"<hi>\"\n"},
+	}
+
+	var b strings.Builder
+	if err := writeJUnit(&b, results); err != nil {
+		t.Fatal(err)
+	}
+
+	want := `<?xml version="1.0" encoding="UTF-8"?>
+<testsuite name="capytest" tests="2" failures="1" time="1.750">
+  <testcase name="ok" classname="testdata" time="0.250"></testcase>
+  <testcase name="broken" classname="testdata" time="1.500">
+    <failure message="scenario failed">stdout does not contain &#34;&lt;hi&gt;&#34;&#xA;</failure>
+  </testcase>
+</testsuite>
+`
+	if b.String() != want {
+		t.Errorf("unexpected JUnit output:\n%s\nwant:\n%s", b.String(), want)
+	}
+}
+
+func TestReadTestEvents(t *testing.T) {
+	events := `{"Action":"start","Package":"capytest.run"}
+{"Action":"run","Test":"TestScenario1"}
+{"Action":"output","Test":"TestScenario1","Output":"=== RUN   TestScenario1\n"}
+{"Action":"output","Test":"TestScenario1/broken","Output":"    stdout does not contain \"hi\"\n"}
+{"Action":"fail","Test":"TestScenario1/broken","Elapsed":0.1}
+{"Action":"fail","Test":"TestScenario1","Elapsed":1.5}
+{"Action":"pass","Test":"TestScenario0","Elapsed":0.25}
+{"Action":"output","Output":"FAIL\n"}
+`
+	results := make([]scenarioResult, 3)
+	done := map[int]bool{}
+	var pkgOutput strings.Builder
+	readTestEvents(strings.NewReader(events), results, done, &pkgOutput)
+
+	if !results[0].passed || results[0].duration != 250*time.Millisecond {
+		t.Errorf("unexpected result of the passed scenario: %+v", results[0])
+	}
+	if results[1].passed || results[1].duration != 1500*time.Millisecond ||
+		results[1].output != "=== RUN   TestScenario1\n    stdout does not contain \"hi\"\n" {
+		t.Errorf("unexpected result of the failed scenario: %+v", results[1])
+	}
+	if !done[0] || !done[1] || done[2] {
+		t.Errorf("unexpected finished scenarios: %v", done)
+	}
+	if pkgOutput.String() != "FAIL\n" {
+		t.Errorf("unexpected package output: %q", pkgOutput.String())
+	}
+}
+
+func TestRunScenarios(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds a test package")
+	}
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go is not installed")
+	}
+
+	dir := t.TempDir()
+	files := map[string]string{
+		"ok.txt":     "exec echo hi\nstdout hi\n",
+		"broken.txt": "exec echo hi\nstdout bye\n",
+		"syntax.txt": "bogus\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("CAPYTEST_CAST_DIR", filepath.Join(dir, "casts"))
+
+	results := runScenarios(runFlags{provider: "local", parallel: 2}, []string{
+		filepath.Join(dir, "broken.txt"),
+		filepath.Join(dir, "ok.txt"),
+		filepath.Join(dir, "syntax.txt"),
+	})
+
+	if r := results[0]; r.passed || !strings.Contains(r.output, `stdout does not contain "bye"`) {
+		t.Errorf("unexpected result of broken.txt: %+v", r)
+	}
+	if r := results[1]; !r.passed {
+		t.Errorf("unexpected result of ok.txt: %+v", r)
+	}
+	if r := results[2]; r.passed || !strings.Contains(r.output, "unknown command bogus") {
+		t.Errorf("unexpected result of syntax.txt: %+v", r)
+	}
+}
@@ -1,10 +1,13 @@
 package capytest
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"regexp"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -69,16 +72,44 @@ type CommandBuilder interface {
 	// multiple times; later values override earlier values for the same key.
 	WithEnv(key, value string) CommandBuilder
 
+	// WithStdin writes input to the stdin of the command and closes it.
+	// Without it the command inherits an open stdin with nothing to read.
+	// It is ignored for commands with steps, which use Send instead.
+	WithStdin(input string) CommandBuilder
+
 	// WithCaptureStdout writes stdout to the provided io.Writer in addition to internal checks.
 	WithCaptureStdout(w io.Writer) CommandBuilder
 
 	// WithCaptureStderr writes stderr to the provided io.Writer in addition to internal checks.
 	WithCaptureStderr(w io.Writer) CommandBuilder
 
+	// OnOutput answers every prompt matching the regex pattern with
+	// response, for the whole session and alongside the steps. It is meant
+	// for confirmations that appear in an unpredictable order, such as
+	// OnOutput(`Continue\? \[y/N\]`, "y\n"). The command is run in a
+	// terminal, like a command with steps. A prompt is matched within the
+	// last 4 KiB of output.
+	OnOutput(pattern, response string, opts ...ResponderOption) CommandBuilder
+
+	// WithInputPacing writes the input of the steps one character (or key)
+	// at a time, delay plus up to jitter apart, instead of in one burst.
+	// Pasted text still arrives at once. It is also the pacing of Type.
+	WithInputPacing(delay, jitter time.Duration) CommandBuilder
+
+	// WithSecrets masks the values in the failures, logs, reports,
+	// recordings and snapshots of the command, in addition to the Secrets
+	// of its TestSuite.
+	WithSecrets(values ...string) CommandBuilder
+
+	// WithTerminalSize sets the terminal size the command starts with,
+	// instead of DefaultTerminalSize.
+	WithTerminalSize(rows, cols uint16) CommandBuilder
+
 	Do() StepBuilder
 }
 
 type commandBuilder struct {
+	runner   *runner
 	provider Provider
 	cmd      []string
 
@@ -99,12 +130,31 @@ type commandBuilder struct {
 	stdoutExpectedEqual         *string
 	stderrExpectedEqual         *string
 
-	env []string
+	env     []string
+	stubEnv []string
+	stdin   *string
+
+	// rows and cols are the terminal size; zero means DefaultTerminalSize.
+	rows, cols uint16
 
 	stdoutWriters []io.Writer
 	stderrWriters []io.Writer
 
-	steps []step
+	steps      []step
+	responders []*responder
+
+	// record describes the run for the reports.
+	record *CommandRecord
+	// log streams the output in verbose mode.
+	log *outputLog
+	// exit tells the steps whether an interactive command has exited.
+	exit *exitWatcher
+	// modes follows the terminal modes of an interactive command.
+	modes termModes
+	// pacing spreads the input of the steps over time.
+	pacing pacing
+	// secrets are masked in the logs, reports and recordings.
+	secrets Secrets
 }
 
 func (c *commandBuilder) WithTimeout(duration time.Duration) CommandBuilder {
@@ -196,6 +246,11 @@ func (c *commandBuilder) WithEnv(key, value string) CommandBuilder {
 	return c
 }
 
+func (c *commandBuilder) WithStdin(input string) CommandBuilder {
+	c.stdin = &input
+	return c
+}
+
 func (c *commandBuilder) WithCaptureStdout(w io.Writer) CommandBuilder {
 	c.stdoutWriters = append(c.stdoutWriters, w)
 	return c
@@ -216,46 +271,72 @@ func (c *commandBuilder) Do() StepBuilder {
 func (c *commandBuilder) runInteractive(t *testing.T) {
 	t.Helper()
 
-	session, err := c.provider.StartInteractiveCommand(c.cmd, CommandOptions{Env: c.env})
+	c.compileResponders(t)
+
+	opts := c.commandOptions()
+	c.record.Env = opts.Env
+	session, err := c.provider.StartInteractiveCommand(c.cmd, opts)
 	if err != nil {
-		t.Fatalf("failed to start command: %v", err)
+		c.fatal(t, "failed to start command: %v", err)
 	}
 
-	var outputBuf strings.Builder
+	c.exit = watchExit(session)
+
+	rows, cols := c.terminalSize()
+	if rs, ok := session.(ResizableSession); ok {
+		if err := rs.Resize(rows, cols); err != nil {
+			c.fatal(t, "failed to set the terminal size: %v", err)
+		}
+	}
+	cast := newCastRecorder(&c.secrets, rows, cols)
+	defer c.saveCast(t, cast)
+
+	var outputBuf, transcript syncBuffer
 	outputCh := session.Output()
 
 	done := make(chan struct{})
 	go func() {
 		defer close(done)
 		for out := range outputCh {
+			cast.output(out)
+			c.modes.update(out)
+			c.log.write("[pty]", out)
 			outputBuf.WriteString(out)
+			transcript.WriteString(out)
+			if len(c.responders) > 0 {
+				c.respond(session, out, cast)
+			}
 		}
 	}()
+	defer func() {
+		c.record.Transcript = transcript.String()
+		c.record.Events = cast.terminalEvents()
+	}()
 
-	for _, step := range c.steps {
-		outputBuf.Reset()
-
-		if err := c.executeStep(session, step, &outputBuf, t); err != nil {
-			t.Fatalf("failed to execute step: %v", err)
-		}
+	if err := c.runSteps(session, c.steps, &outputBuf, false, cast, t); err != nil {
+		c.fatal(t, "failed to execute step: %v", err)
 	}
 
-	exitCode, err := session.Wait()
+	<-c.exit.done
+	exitCode, err := c.exit.code, c.exit.err
 	if err != nil {
-		t.Fatalf("error waiting for process: %v", err)
+		c.fatal(t, "error waiting for process: %v", err)
 	}
 
 	<-done
 
+	c.validateResponders(t)
 	c.validateResults(exitCode, "", "", t)
 }
 
 func (c *commandBuilder) runNonInteractive(t *testing.T) {
 	t.Helper()
 
-	session, err := c.provider.StartCommand(c.cmd, CommandOptions{Env: c.env})
+	opts := c.commandOptions()
+	c.record.Env = opts.Env
+	session, err := c.provider.StartCommand(c.cmd, opts)
 	if err != nil {
-		t.Fatalf("failed to start command: %v", err)
+		c.fatal(t, "failed to start command: %v", err)
 	}
 
 	var stdoutBuf, stderrBuf strings.Builder
@@ -267,6 +348,7 @@ func (c *commandBuilder) runNonInteractive(t *testing.T) {
 		defer close(stdoutDone)
 		for out := range session.Stdout() {
 			stdoutBuf.WriteString(out)
+			c.log.write("[stdout]", out)
 			for _, w := range c.stdoutWriters {
 				w.Write([]byte(out))
 			}
@@ -277,65 +359,401 @@ func (c *commandBuilder) runNonInteractive(t *testing.T) {
 		defer close(stderrDone)
 		for errOut := range session.Stderr() {
 			stderrBuf.WriteString(errOut)
+			c.log.write("[stderr]", errOut)
 			for _, w := range c.stderrWriters {
 				w.Write([]byte(errOut))
 			}
 		}
 	}()
 
+	if c.stdin != nil {
+		c.log.send([]byte(*c.stdin))
+		if err := session.Write(*c.stdin); err != nil {
+			t.Errorf("failed to write to stdin: %v", err)
+		}
+		if sc, ok := session.(StdinCloser); ok {
+			sc.CloseStdin()
+		} else {
+			t.Errorf("provider does not support closing stdin")
+		}
+	}
+
 	exitCode, err := session.Wait()
 	if err != nil {
-		t.Fatalf("error waiting for process: %v", err)
+		c.fatal(t, "error waiting for process: %v", err)
 	}
 
 	<-stdoutDone
 	<-stderrDone
 
+	c.record.Stdout = stdoutBuf.String()
+	c.record.Stderr = stderrBuf.String()
 	c.validateResults(exitCode, stdoutBuf.String(), stderrBuf.String(), t)
 }
 
+func (c *commandBuilder) commandOptions() CommandOptions {
+	env := append(coverageEnv(), c.stubEnv...)
+	return CommandOptions{Env: append(env, c.env...)}
+}
+
+// fatal records why the command could not be run and stops the test.
+func (c *commandBuilder) fatal(t *testing.T, format string, args ...any) {
+	t.Helper()
+	c.record.Error = c.secrets.sprintf(format, args...)
+	t.Fatal(c.record.Error)
+}
+
+func (c *commandBuilder) WithSecrets(values ...string) CommandBuilder {
+	c.secrets.Add(values...)
+	return c
+}
+
+func (c *commandBuilder) WithTerminalSize(rows, cols uint16) CommandBuilder {
+	c.rows, c.cols = rows, cols
+	return c
+}
+
+func (c *commandBuilder) terminalSize() (rows, cols uint16) {
+	if c.rows == 0 || c.cols == 0 {
+		return DefaultTerminalSize.Rows, DefaultTerminalSize.Cols
+	}
+	return c.rows, c.cols
+}
+
 func (c *commandBuilder) Run(t *testing.T) {
 	t.Helper()
 
-	if len(c.steps) > 0 {
+	c.record = &CommandRecord{
+		Test:     t.Name(),
+		Provider: providerName(c.provider),
+		Argv:     c.cmd,
+		Start:    time.Now(),
+	}
+	defer func() {
+		c.record.Duration = time.Since(c.record.Start)
+		c.record.mask(&c.secrets)
+		reports.add(t, c.record)
+	}()
+	c.log = c.runner.outputLog(t, &c.secrets)
+	defer c.log.close()
+
+	if fc, ok := c.provider.(FileCopier); ok {
+		defer copyBuilds(t, fc)()
+	}
+	if c.runner != nil {
+		env, collect := c.runner.prepareStubs(t)
+		defer collect()
+		c.stubEnv = env
+	}
+
+	if len(c.steps) > 0 || len(c.responders) > 0 {
 		c.runInteractive(t)
 	} else {
 		c.runNonInteractive(t)
 	}
 }
 
-func (c *commandBuilder) executeStep(session InteractiveSession, step step, combinedBuf *strings.Builder, t *testing.T) error {
-	combinedBuf.Reset()
+var stepActions = map[stepAction]string{
+	sendAction:      "send",
+	sendLineAction:  "send",
+	waitAction:      "wait",
+	interruptAction: "interrupt",
+	terminateAction: "terminate",
+	keysAction:      "keys",
+	pasteAction:     "paste",
+	typeAction:      "type",
+	secretAction:    "send",
+	resizeAction:    "resize",
+}
+
+// runSteps runs the steps in order, each on the output that arrives during
+// it. The first step when carry is set and the step after one that took an
+// ExpectOneOf case also see the output that came with the case, e.g. a
+// prompt printed right after it.
+func (c *commandBuilder) runSteps(session InteractiveSession, steps []step, combinedBuf *syncBuffer, carry bool, cast *castRecorder, t *testing.T) error {
+	for _, s := range steps {
+		took, err := c.executeStep(session, s, combinedBuf, carry, cast, t)
+		if err != nil {
+			return err
+		}
+		carry = took
+	}
+	return nil
+}
+
+// executeStep runs a step and reports whether it took an ExpectOneOf case.
+func (c *commandBuilder) executeStep(session InteractiveSession, step step, combinedBuf *syncBuffer, carry bool, cast *castRecorder, t *testing.T) (bool, error) {
+	if !carry {
+		combinedBuf.Reset()
+	}
+
+	c.record.Steps = append(c.record.Steps, StepRecord{Action: stepActions[step.action]})
+	rec := &c.record.Steps[len(c.record.Steps)-1]
+	mark := len(combinedBuf.String())
 
 	switch step.action {
-	case sendAction:
-		if err := session.Write(step.data); err != nil {
-			return fmt.Errorf("failed to write to stdin: %v", err)
+	case sendAction, keysAction, pasteAction, typeAction, secretAction:
+		data := step.data
+		chunks := splitRunes(data)
+		p := c.pacing
+		switch step.action {
+		case keysAction:
+			chunks = chunks[:0]
+			for _, k := range step.keys {
+				chunks = append(chunks, c.modes.encodeKey(k))
+			}
+			data = bytes.Join(chunks, nil)
+		case pasteAction:
+			data = c.modes.encodePaste(string(step.data))
+			chunks = [][]byte{data}
+		case secretAction:
+			// The secret is registered when it is sent, which also covers
+			// the steps of an ExpectOneOf case, built apart from the
+			// command. Typed characters would reach the recording one by
+			// one, where they could not be masked.
+			c.secrets.Add(strings.TrimSuffix(string(data), "\n"))
+			chunks = [][]byte{data}
+		case typeAction:
+			p = c.typePacing(step.typeOpts)
+		}
+		if len(data) == 0 {
+			// A step that only waits for output.
+			rec.Action = "expect"
+			break
+		}
+		if !p.paced() {
+			chunks = [][]byte{data}
+		}
+		rec.Input = string(data)
+		c.log.send(data)
+		if err := writePaced(session, chunks, p, cast); err != nil {
+			return false, err
 		}
 	case waitAction:
 		time.Sleep(step.duration)
 	case interruptAction:
+		cast.input([]byte{3})
 		if err := session.Interrupt(); err != nil {
-			return fmt.Errorf("failed to interrupt process: %v", err)
+			return false, fmt.Errorf("failed to interrupt process: %v", err)
+		}
+	case resizeAction:
+		rs, ok := session.(ResizableSession)
+		if !ok {
+			return false, errors.New("the terminal of the session can't be resized")
 		}
+		if err := rs.Resize(step.rows, step.cols); err != nil {
+			return false, fmt.Errorf("failed to resize the terminal: %v", err)
+		}
+		cast.resize(step.rows, step.cols)
 	}
 
-	c.validateStepExpectations(step.expectation, combinedBuf, t)
+	c.validateStepExpectations(session, step.expectation, combinedBuf, mark, rec, t)
 
-	return nil
+	var taken *branch
+	if len(step.expectation.oneOf) > 0 {
+		taken = c.chooseBranch(step.expectation.oneOf, combinedBuf, rec, t)
+	}
+	rec.Output = combinedBuf.String()
+
+	// rec must not be used from here on: the steps of the branch append to
+	// the records.
+	if taken == nil {
+		return false, nil
+	}
+	return true, c.runSteps(session, taken.steps, combinedBuf, true, cast, t)
 }
 
-func (c *commandBuilder) validateStepExpectations(exp expectation, combinedBuf *strings.Builder, t *testing.T) {
-	if exp.outputContains != "" {
-		if !waitForSubstring(combinedBuf, exp.outputContains, 5) {
-			t.Errorf("stdout does not contain %q\nstdout: %q", exp.outputContains, combinedBuf.String())
+// chooseBranch waits until the output matches one of the branches and
+// returns the one matching earliest, or nil.
+func (c *commandBuilder) chooseBranch(branches []branch, combinedBuf *syncBuffer, rec *StepRecord, t *testing.T) *branch {
+	t.Helper()
+
+	patterns := make([]string, len(branches))
+	res := make([]*regexp.Regexp, len(branches))
+	for i, b := range branches {
+		re, err := regexp.Compile(b.pattern)
+		if err != nil {
+			check(t, &c.secrets, &rec.Expectations, fmt.Sprintf("valid pattern %q", b.pattern), false,
+				"invalid ExpectOneOf pattern %q: %v", b.pattern, err)
+			return nil
 		}
+		patterns[i] = b.pattern
+		res[i] = re
+	}
+	desc := fmt.Sprintf("output matches one of %q", patterns)
+
+	timeout := time.After(DefaultWaitTimeout)
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		out := combinedBuf.String()
+		best, bestPos := -1, 0
+		for i, re := range res {
+			if loc := re.FindStringIndex(out); loc != nil && (best < 0 || loc[0] < bestPos) {
+				best, bestPos = i, loc[0]
+			}
+		}
+		if best >= 0 {
+			rec.Branch = patterns[best]
+			t.Logf("ExpectOneOf: took the case %q", c.secrets.Mask(patterns[best]))
+			check(t, &c.secrets, &rec.Expectations, desc, true, "")
+			return &branches[best]
+		}
+
+		select {
+		case <-timeout:
+			check(t, &c.secrets, &rec.Expectations, desc, false,
+				"output does not match any of %q\nstdout: %q", patterns, out)
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// validateStepExpectations checks the output of a step, which starts at
+// mark in combinedBuf.
+func (c *commandBuilder) validateStepExpectations(session InteractiveSession, exp expectation, combinedBuf *syncBuffer, mark int, rec *StepRecord, t *testing.T) {
+	t.Helper()
+
+	start := time.Now()
+	if exp.noOutputFor > 0 {
+		time.Sleep(exp.noOutputFor - time.Since(start))
+		out := combinedBuf.String()[mark:]
+		check(t, &c.secrets, &rec.Expectations, fmt.Sprintf("no output for %s", exp.noOutputFor), out == "",
+			"expected no output for %s but got: %q", exp.noOutputFor, out)
+	}
+
+	if exp.outputContains != "" {
+		ok := waitForSubstring(combinedBuf, exp.outputContains, DefaultWaitTimeout)
+		check(t, &c.secrets, &rec.Expectations, fmt.Sprintf("output contains %q", exp.outputContains), ok,
+			"stdout does not contain %q\nstdout: %q", exp.outputContains, combinedBuf.String())
 	}
 	if exp.outputRegex != "" {
-		if matched, _ := regexp.MatchString(exp.outputRegex, combinedBuf.String()); !matched {
-			t.Errorf("stdout does not match regex %q\nstdout: %q", exp.outputContains, combinedBuf.String())
+		matched, _ := regexp.MatchString(exp.outputRegex, combinedBuf.String())
+		check(t, &c.secrets, &rec.Expectations, fmt.Sprintf("output matches %q", exp.outputRegex), matched,
+			"stdout does not match regex %q\nstdout: %q", exp.outputRegex, combinedBuf.String())
+	}
+	if exp.quiet > 0 {
+		ok := waitForQuiet(combinedBuf, exp.quiet, DefaultWaitTimeout)
+		check(t, &c.secrets, &rec.Expectations, fmt.Sprintf("quiet for %s", exp.quiet), ok,
+			"output did not stop for %s within %s\nstdout: %q", exp.quiet, DefaultWaitTimeout, combinedBuf.String())
+	}
+	if exp.exitCode != nil || exp.exitWithin > 0 {
+		timeout := DefaultWaitTimeout
+		if exp.exitWithin > 0 {
+			timeout = exp.exitWithin
+		}
+		exited := c.exit.wait(timeout)
+		check(t, &c.secrets, &rec.Expectations, fmt.Sprintf("exit within %s", timeout), exited,
+			"command did not exit within %s\nstdout: %q", timeout, combinedBuf.String())
+		if exited && exp.exitCode != nil {
+			check(t, &c.secrets, &rec.Expectations, fmt.Sprintf("exit code %d", *exp.exitCode), c.exit.code == *exp.exitCode,
+				"unexpected exit code: got %d, want %d\nstdout: %q", c.exit.code, *exp.exitCode, combinedBuf.String())
+		}
+	}
+	if len(exp.outputNotContains) > 0 {
+		time.Sleep(DefaultNegativeWindow - time.Since(start))
+		out := combinedBuf.String()[mark:]
+		for _, substr := range exp.outputNotContains {
+			check(t, &c.secrets, &rec.Expectations, fmt.Sprintf("output does not contain %q", substr), !strings.Contains(out, substr),
+				"output contains %q but should not\nstdout: %q", substr, out)
+		}
+	}
+	if exp.echo != nil {
+		c.checkEcho(session, *exp.echo, rec, t)
+	}
+	if exp.stillRunning {
+		exited := c.exit.exited()
+		code := 0
+		if exited {
+			code = c.exit.code
+		}
+		check(t, &c.secrets, &rec.Expectations, "still running", !exited,
+			"command exited with code %d but should still be running\nstdout: %q", code, combinedBuf.String())
+	}
+}
+
+// checkEcho waits until the terminal echo is turned on or off as wanted,
+// which programs do around their password prompts.
+func (c *commandBuilder) checkEcho(session InteractiveSession, want bool, rec *StepRecord, t *testing.T) {
+	t.Helper()
+
+	state := map[bool]string{true: "enabled", false: "disabled"}
+	desc := "echo " + state[want]
+
+	es, ok := session.(EchoSession)
+	if !ok {
+		check(t, &c.secrets, &rec.Expectations, desc, false,
+			"the %s provider cannot tell whether the terminal echoes input", providerName(c.provider))
+		return
+	}
+
+	deadline := time.Now().Add(DefaultWaitTimeout)
+	for {
+		echo, err := es.Echo()
+		if err != nil {
+			check(t, &c.secrets, &rec.Expectations, desc, false, "failed to read the terminal echo state: %v", err)
+			return
+		}
+		if echo == want || time.Now().After(deadline) {
+			check(t, &c.secrets, &rec.Expectations, desc, echo == want,
+				"terminal echo is %s but should be %s", state[echo], state[want])
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// exitWatcher waits for a session in the background, so that steps can
+// check whether the command has exited without blocking.
+type exitWatcher struct {
+	done chan struct{}
+	code int
+	err  error
+}
+
+func watchExit(session InteractiveSession) *exitWatcher {
+	w := &exitWatcher{done: make(chan struct{})}
+	go func() {
+		w.code, w.err = session.Wait()
+		close(w.done)
+	}()
+	return w
+}
+
+// wait reports whether the command exits within timeout.
+func (w *exitWatcher) wait(timeout time.Duration) bool {
+	select {
+	case <-w.done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+func (w *exitWatcher) exited() bool {
+	select {
+	case <-w.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// waitForQuiet waits until nothing is written to buf for d.
+func waitForQuiet(buf *syncBuffer, d, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	size, changed := len(buf.String()), time.Now()
+	for time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		if n := len(buf.String()); n != size {
+			size, changed = n, time.Now()
+		} else if time.Since(changed) >= d {
+			return true
 		}
 	}
+	return false
 }
 
 // validateResults aggregates all validation checks and reports
@@ -343,77 +761,79 @@ func (c *commandBuilder) validateStepExpectations(exp expectation, combinedBuf *
 // to provide complete diagnostic information.
 func (c *commandBuilder) validateResults(exitCode int, stdout, stderr string, t *testing.T) {
 	t.Helper()
+
+	c.record.ExitCode = exitCode
+	exps := &c.record.Expectations
+
 	// Check exit code
 	if c.expectedExitCode != nil {
-		if exitCode != *c.expectedExitCode {
-			t.Errorf("unexpected exit code: got %d, want %d\nstderr: %q", exitCode, *c.expectedExitCode, stderr)
-		}
+		check(t, &c.secrets, exps, fmt.Sprintf("exit code %d", *c.expectedExitCode), exitCode == *c.expectedExitCode,
+			"unexpected exit code: got %d, want %d\nstderr: %q", exitCode, *c.expectedExitCode, stderr)
 	} else if c.expectFailure {
-		if exitCode == 0 {
-			t.Errorf("expected failure but got success (exit code 0)\nstderr: %q", stderr)
-		}
+		check(t, &c.secrets, exps, "failure", exitCode != 0,
+			"expected failure but got success (exit code 0)\nstderr: %q", stderr)
 	}
 
 	// Check stdout
 	for _, expected := range c.stdoutExpectations {
-		if !strings.Contains(stdout, expected) {
-			t.Errorf("stdout does not contain %q\nstdout: %q", expected, stdout)
-		}
+		check(t, &c.secrets, exps, fmt.Sprintf("stdout contains %q", expected), strings.Contains(stdout, expected),
+			"stdout does not contain %q\nstdout: %q", expected, stdout)
 	}
 
 	// Check stderr
 	for _, expected := range c.stderrExpectations {
-		if !strings.Contains(stderr, expected) {
-			t.Errorf("stderr does not contain %q\nstderr: %q", expected, stderr)
-		}
+		check(t, &c.secrets, exps, fmt.Sprintf("stderr contains %q", expected), strings.Contains(stderr, expected),
+			"stderr does not contain %q\nstderr: %q", expected, stderr)
 	}
 
 	// Check stdout NOT contains
 	for _, notExpected := range c.stdoutNotExpectations {
-		if strings.Contains(stdout, notExpected) {
-			t.Errorf("stdout contains %q but should not\nstdout: %q", notExpected, stdout)
-		}
+		check(t, &c.secrets, exps, fmt.Sprintf("stdout does not contain %q", notExpected), !strings.Contains(stdout, notExpected),
+			"stdout contains %q but should not\nstdout: %q", notExpected, stdout)
 	}
 
 	// Check stderr NOT contains
 	for _, notExpected := range c.stderrNotExpectations {
-		if strings.Contains(stderr, notExpected) {
-			t.Errorf("stderr contains %q but should not\nstderr: %q", notExpected, stderr)
-		}
+		check(t, &c.secrets, exps, fmt.Sprintf("stderr does not contain %q", notExpected), !strings.Contains(stderr, notExpected),
+			"stderr contains %q but should not\nstderr: %q", notExpected, stderr)
 	}
 
 	// Check regex for stdout
 	for _, pattern := range c.stdoutRegexes {
-		if matched, _ := regexp.MatchString(pattern, stdout); !matched {
-			t.Errorf("stdout does not match regex %q\nstdout: %q", pattern, stdout)
-		}
+		matched, _ := regexp.MatchString(pattern, stdout)
+		check(t, &c.secrets, exps, fmt.Sprintf("stdout matches %q", pattern), matched,
+			"stdout does not match regex %q\nstdout: %q", pattern, stdout)
 	}
 
 	// Check regex for stderr
 	for _, pattern := range c.stderrRegexes {
-		if matched, _ := regexp.MatchString(pattern, stderr); !matched {
-			t.Errorf("stderr does not match regex %q\nstderr: %q", pattern, stderr)
-		}
+		matched, _ := regexp.MatchString(pattern, stderr)
+		check(t, &c.secrets, exps, fmt.Sprintf("stderr matches %q", pattern), matched,
+			"stderr does not match regex %q\nstderr: %q", pattern, stderr)
 	}
 
 	// Check empty stdout
-	if c.expectStdoutEmpty && stdout != "" {
-		t.Errorf("expected stdout to be empty but got: %q", stdout)
+	if c.expectStdoutEmpty {
+		check(t, &c.secrets, exps, "stdout is empty", stdout == "",
+			"expected stdout to be empty but got: %q", stdout)
 	}
 
 	// Check empty stderr
-	if c.expectStderrEmpty && stderr != "" {
-		t.Errorf("expected stderr to be empty but got: %q", stderr)
+	if c.expectStderrEmpty {
+		check(t, &c.secrets, exps, "stderr is empty", stderr == "",
+			"expected stderr to be empty but got: %q", stderr)
 	}
 
 	// Check exact stdout match
-	if c.stdoutExpectedEqual != nil && stdout != *c.stdoutExpectedEqual {
-		t.Errorf("stdout does not equal %q\nstdout: %q", *c.stdoutExpectedEqual, stdout)
+	if c.stdoutExpectedEqual != nil {
+		check(t, &c.secrets, exps, fmt.Sprintf("stdout equals %q", *c.stdoutExpectedEqual), stdout == *c.stdoutExpectedEqual,
+			"stdout does not equal %q\nstdout: %q", *c.stdoutExpectedEqual, stdout)
 	}
 
 	// Check exact stderr match
-	if c.stderrExpectedEqual != nil && stderr != *c.stderrExpectedEqual {
-		t.Errorf("stderr does not equal %q\nstderr: %q", *c.stderrExpectedEqual, stderr)
+	if c.stderrExpectedEqual != nil {
+		check(t, &c.secrets, exps, fmt.Sprintf("stderr equals %q", *c.stderrExpectedEqual), stderr == *c.stderrExpectedEqual,
+			"stderr does not equal %q\nstderr: %q", *c.stderrExpectedEqual, stderr)
 	}
 
 	if c.expectStdoutMatchesSnapshot {
@@ -427,11 +847,43 @@ func (c *commandBuilder) validateResults(exitCode int, stdout, stderr string, t
 
 func (c *commandBuilder) compareSnapshot(t *testing.T, name string, out string) {
 	t.Helper()
-	snaps.WithConfig(snaps.Ext("."+name)).MatchStandaloneSnapshot(t, out)
+	st := &snapshotT{T: t}
+	snaps.WithConfig(snaps.Ext("."+name)).MatchStandaloneSnapshot(st, c.secrets.Mask(out))
+	msg := strings.Join(st.errors, "\n")
+	check(t, &c.secrets, &c.record.Expectations, name+" matches snapshot", len(st.errors) == 0, "%s", msg)
+	if diff := snapshotDiff(msg); diff != "" {
+		c.record.Expectations[len(c.record.Expectations)-1].Diff = c.secrets.Mask(diff)
+	}
+}
+
+// snapshotDiff extracts the diff from a failure reported by go-snaps,
+// without the colors, or returns "" if there is none.
+func snapshotDiff(msg string) string {
+	msg = ansiSequence.ReplaceAllString(msg, "")
+	start := strings.Index(msg, "- Snapshot - ")
+	if start < 0 {
+		return ""
+	}
+	diff := msg[start:]
+	if end := strings.LastIndex(diff, "\nat "); end >= 0 {
+		diff = diff[:end]
+	}
+	return strings.TrimRight(diff, "\n") + "\n"
+}
+
+// snapshotT collects the failures reported by go-snaps instead of passing
+// them to the test, so that they are recorded like other expectations.
+type snapshotT struct {
+	*testing.T
+	errors []string
+}
+
+func (t *snapshotT) Error(args ...any) {
+	t.errors = append(t.errors, strings.TrimSuffix(fmt.Sprintln(args...), "\n"))
 }
 
-func waitForSubstring(buf *strings.Builder, substr string, timeoutSeconds int) bool {
-	timeout := time.After(time.Duration(timeoutSeconds) * time.Second)
+func waitForSubstring(buf *syncBuffer, substr string, d time.Duration) bool {
+	timeout := time.After(d)
 	ticker := time.NewTicker(50 * time.Millisecond)
 	defer ticker.Stop()
 
@@ -446,3 +898,28 @@ func waitForSubstring(buf *strings.Builder, substr string, timeoutSeconds int) b
 		}
 	}
 }
+
+// syncBuffer is a strings.Builder that is written by the goroutine reading
+// the output of a session while the steps read it.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf strings.Builder
+}
+
+func (b *syncBuffer) WriteString(s string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.buf.WriteString(s)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func (b *syncBuffer) Reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.buf.Reset()
+}
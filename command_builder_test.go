@@ -0,0 +1,119 @@
+package capytest
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestExecuteStepResetsOutput(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		carry bool
+		want  string
+	}{
+		{"new step", false, ""},
+		{"after a case", true, "> "},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &commandBuilder{record: &CommandRecord{}}
+			var buf syncBuffer
+			buf.WriteString("> ")
+
+			// An expect-only step, as added by Then().
+			if _, err := c.executeStep(&fakeSession{}, step{}, &buf, tt.carry, newCastRecorder(nil, 24, 80), t); err != nil {
+				t.Fatal(err)
+			}
+			if got := buf.String(); got != tt.want {
+				t.Errorf("output = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+type resizableSession struct {
+	fakeSession
+	sizes       [][2]uint16
+	interrupted bool
+}
+
+func (s *resizableSession) Interrupt() error {
+	s.interrupted = true
+	return nil
+}
+
+func (s *resizableSession) Resize(rows, cols uint16) error {
+	s.sizes = append(s.sizes, [2]uint16{rows, cols})
+	return nil
+}
+
+func TestCastRecordsResizesAndInterrupts(t *testing.T) {
+	c := &commandBuilder{record: &CommandRecord{}}
+	session := &resizableSession{}
+	cast := newCastRecorder(&c.secrets, 30, 100)
+	var buf syncBuffer
+	steps := []step{{action: resizeAction, rows: 40, cols: 120}, {action: interruptAction}}
+	if err := c.runSteps(session, steps, &buf, false, cast, t); err != nil {
+		t.Fatal(err)
+	}
+	if want := [][2]uint16{{40, 120}}; !reflect.DeepEqual(session.sizes, want) {
+		t.Errorf("sizes = %v, want %v", session.sizes, want)
+	}
+	if !session.interrupted {
+		t.Error("session not interrupted")
+	}
+
+	path := filepath.Join(t.TempDir(), "test.cast")
+	if err := cast.write(path, "test", []string{"sh"}); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	sc.Scan()
+	var header struct{ Width, Height int }
+	if err := json.Unmarshal(sc.Bytes(), &header); err != nil {
+		t.Fatal(err)
+	}
+	if header.Width != 100 || header.Height != 30 {
+		t.Errorf("size = %dx%d, want 100x30", header.Width, header.Height)
+	}
+	var events [][2]string
+	for sc.Scan() {
+		var e []any
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, [2]string{e[1].(string), e[2].(string)})
+	}
+	if want := [][2]string{{"r", "120x40"}, {"i", "\x03"}}; !reflect.DeepEqual(events, want) {
+		t.Errorf("events = %q, want %q", events, want)
+	}
+}
+
+func TestExecuteStepRequiresResizableSession(t *testing.T) {
+	c := &commandBuilder{record: &CommandRecord{}}
+	var buf syncBuffer
+	_, err := c.executeStep(&fakeSession{}, step{action: resizeAction, rows: 40, cols: 120}, &buf, false, newCastRecorder(nil, 24, 80), t)
+	if err == nil {
+		t.Error("resizing a session without ResizableSession succeeded")
+	}
+}
+
+func TestSnapshotDiff(t *testing.T) {
+	msg := "\n\x1b[38;5;52m\x1b[48;5;225m- Snapshot - 1\x1b[0m\n\x1b[38;5;22m\x1b[48;5;159m+ Received + 1\x1b[0m\n\n" +
+		"\x1b[38;5;52m\x1b[48;5;225m- old\n\x1b[0m\x1b[38;5;22m\x1b[48;5;159m+ new\n\x1b[0m\n\x1b[2mat __snapshots__/TestX_1.snap.stdout:1\n\x1b[0m"
+	want := "- Snapshot - 1\n+ Received + 1\n\n- old\n+ new\n"
+	if got := snapshotDiff(msg); got != want {
+		t.Errorf("snapshotDiff() = %q, want %q", got, want)
+	}
+	if got := snapshotDiff("snapshot not found"); got != "" {
+		t.Errorf("snapshotDiff() = %q for a message without a diff", got)
+	}
+}
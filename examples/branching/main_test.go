@@ -0,0 +1,49 @@
+package branching_test
+
+import (
+	"testing"
+
+	"go.alt-gnome.ru/capytest"
+	"go.alt-gnome.ru/capytest/providers/local"
+)
+
+// login asks for a password unless a session exists.
+const login = `
+if [ "$SESSION" = 1 ]; then
+	echo "already logged in"
+else
+	printf 'Password: '; read password
+	[ "$password" = secret ] && echo "Welcome" || { echo "Access denied"; exit 1; }
+fi
+printf '> '; read cmd
+echo "ran $cmd"
+`
+
+func TestExpectOneOf(t *testing.T) {
+	ts := capytest.NewTestSuite(t, local.Provider())
+
+	for _, session := range []string{"0", "1"} {
+		ts.Run("SESSION="+session, func(t *testing.T, r capytest.Runner) {
+			r.Command("sh", "-c", login).
+				WithEnv("SESSION", session).
+				Do().
+				ExpectOneOf(
+					capytest.Case{
+						Pattern: `Password: `,
+						Steps: func(s capytest.StepBuilder) capytest.StepBuilder {
+							return s.SendLine("secret").ExpectOutputContains("Welcome")
+						},
+					},
+					capytest.Case{Pattern: `already logged in`},
+				).
+				Then().
+				ExpectOutputContains("> ").
+				Then().
+				SendLine("status").
+				ExpectOutputContains("ran status").
+				Done().
+				ExpectSuccess().
+				Run(t)
+		})
+	}
+}
@@ -0,0 +1,47 @@
+package chroot_test
+
+import (
+	"os"
+	"testing"
+
+	"go.alt-gnome.ru/capytest"
+	"go.alt-gnome.ru/capytest/providers/chroot"
+)
+
+func TestChroot(t *testing.T) {
+	// A rootfs directory or tarball, e.g. an ALT rootfs .tar.xz.
+	rootfs := os.Getenv("CAPYTEST_ROOTFS")
+	if rootfs == "" {
+		t.Skip("CAPYTEST_ROOTFS is not set")
+	}
+
+	ts := capytest.NewTestSuite(t, chroot.Provider(rootfs))
+
+	ts.Run("commands see the rootfs", func(t *testing.T, r capytest.Runner) {
+		r.Command("sh", "-c", "test -e /etc/os-release && test \"$PWD\" = /").
+			ExpectSuccess().
+			Run(t)
+	})
+
+	ts.Run("pseudo filesystems are mounted", func(t *testing.T, r capytest.Runner) {
+		r.Command("sh", "-c", "test -e /proc/self/status && test -c /dev/null && test -d /sys/kernel").
+			ExpectSuccess().
+			Run(t)
+	})
+
+	// Failures to set up the chroot are reported separately, so any exit
+	// code of the command is passed through.
+	ts.Run("exit code 125 of the command", func(t *testing.T, r capytest.Runner) {
+		r.Command("sh", "-c", "exit 125").
+			ExpectExitCode(125).
+			Run(t)
+	})
+
+	ts.Run("interactive shell", func(t *testing.T, r capytest.Runner) {
+		r.Command("sh").
+			Do().SendLine("echo $((2+2))").ExpectOutputContains("4").
+			Then().SendLine("exit 3").
+			Done().ExpectExitCode(3).
+			Run(t)
+	})
+}
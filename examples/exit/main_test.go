@@ -0,0 +1,46 @@
+package exit_test
+
+import (
+	"testing"
+	"time"
+
+	"go.alt-gnome.ru/capytest"
+	"go.alt-gnome.ru/capytest/providers/local"
+)
+
+// repl echoes commands until it is told to quit.
+const repl = `
+while read cmd; do
+	[ "$cmd" = quit ] && { echo bye; exit 3; }
+	echo "you said $cmd"
+done
+`
+
+func TestExit(t *testing.T) {
+	ts := capytest.NewTestSuite(t, local.Provider())
+
+	ts.Run("exits after quit", func(t *testing.T, r capytest.Runner) {
+		r.Command("sh", "-c", repl).
+			Do().
+			SendLine("hello").
+			ExpectOutputContains("you said hello").
+			ExpectStillRunning().
+			Then().
+			SendLine("quit").
+			ExpectOutputContains("bye").
+			ExpectExit(3).
+			Done().
+			ExpectExitCode(3).
+			Run(t)
+	})
+
+	ts.Run("exits on end of input", func(t *testing.T, r capytest.Runner) {
+		r.Command("sh", "-c", repl).
+			Do().
+			Send([]byte{4}).
+			ExpectExitWithin(time.Second).
+			Done().
+			ExpectSuccess().
+			Run(t)
+	})
+}
@@ -0,0 +1,35 @@
+package gobinary_test
+
+import (
+	"testing"
+
+	"go.alt-gnome.ru/capytest"
+	"go.alt-gnome.ru/capytest/providers/local"
+)
+
+func TestMain(m *testing.M) {
+	capytest.Main(m)
+}
+
+func TestGoBinary(t *testing.T) {
+	ts := capytest.NewTestSuite(t, local.Provider())
+
+	ts.Run("greets", func(t *testing.T, r capytest.Runner) {
+		hello := capytest.BuildGoBinary(t, "./hello", capytest.BuildOptions{})
+
+		r.Command(hello, "capybara").
+			ExpectSuccess().
+			ExpectStdoutEqual("hello, capybara\n").
+			ExpectStderrEmpty().
+			Run(t)
+	})
+
+	ts.Run("usage", func(t *testing.T, r capytest.Runner) {
+		hello := capytest.BuildGoBinary(t, "./hello", capytest.BuildOptions{})
+
+		r.Command(hello).
+			ExpectExitCode(2).
+			ExpectStderrEqual("usage: hello NAME\n").
+			Run(t)
+	})
+}
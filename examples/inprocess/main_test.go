@@ -0,0 +1,145 @@
+package inprocess_test
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"go.alt-gnome.ru/capytest"
+	"go.alt-gnome.ru/capytest/providers/inprocess"
+)
+
+func greet(args []string, stdin io.Reader, stdout, stderr io.Writer, env []string) int {
+	fs := flag.NewFlagSet("greet", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	shout := fs.Bool("shout", false, "shout the greeting")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	name := "world"
+	for _, e := range env {
+		if v, ok := strings.CutPrefix(e, "GREET_NAME="); ok {
+			name = v
+		}
+	}
+	greeting := fmt.Sprintf("hello, %s", name)
+	if *shout {
+		greeting = strings.ToUpper(greeting)
+	}
+	fmt.Fprintln(stdout, greeting)
+	return 0
+}
+
+// repl upper-cases lines until "quit", EOF or an interrupt.
+func repl(args []string, stdin io.Reader, stdout, stderr io.Writer, env []string) int {
+	if !inprocess.IsTerminal(stdout) {
+		fmt.Fprintln(stderr, "repl: not a terminal")
+		return 1
+	}
+	scanner := bufio.NewScanner(stdin)
+	for {
+		fmt.Fprint(stdout, "> ")
+		if !scanner.Scan() {
+			if scanner.Err() == inprocess.ErrInterrupted {
+				return 130
+			}
+			return 0
+		}
+		if scanner.Text() == "quit" {
+			return 0
+		}
+		fmt.Fprintln(stdout, strings.ToUpper(scanner.Text()))
+	}
+}
+
+// shell runs commands until "exit" or EOF; ^C cancels the line being
+// typed, like in an interactive shell.
+func shell(args []string, stdin io.Reader, stdout, stderr io.Writer, env []string) int {
+	in := bufio.NewReader(stdin)
+	for {
+		fmt.Fprint(stdout, "$ ")
+		line, err := in.ReadString('\n')
+		switch {
+		case err == inprocess.ErrInterrupted:
+			continue
+		case err != nil:
+			return 0
+		case line == "exit\n":
+			return 0
+		}
+		fmt.Fprintf(stdout, "ran %s", line)
+	}
+}
+
+func TestInprocess(t *testing.T) {
+	ts := capytest.NewTestSuite(t, inprocess.Provider(
+		inprocess.WithProgram("greet", greet),
+		inprocess.WithProgram("repl", repl),
+		inprocess.WithProgram("shell", shell),
+		inprocess.WithProgram("crash", func([]string, io.Reader, io.Writer, io.Writer, []string) int {
+			panic("boom")
+		}),
+	))
+
+	ts.Run("arguments and environment", func(t *testing.T, r capytest.Runner) {
+		r.Command("greet", "-shout").
+			WithEnv("GREET_NAME", "capytest").
+			ExpectSuccess().
+			ExpectStdoutEqual("HELLO, CAPYTEST\n").
+			Run(t)
+	})
+
+	ts.Run("usage errors", func(t *testing.T, r capytest.Runner) {
+		r.Command("greet", "-loud").
+			ExpectExitCode(2).
+			ExpectStderrContains("flag provided but not defined: -loud").
+			Run(t)
+	})
+
+	ts.Run("panics exit with code 2", func(t *testing.T, r capytest.Runner) {
+		r.Command("crash").
+			ExpectExitCode(2).
+			ExpectStderrContains("panic: boom").
+			Run(t)
+	})
+
+	ts.Run("non-interactive commands have no terminal", func(t *testing.T, r capytest.Runner) {
+		r.Command("repl").
+			ExpectFailure().
+			ExpectStderrEqual("repl: not a terminal\n").
+			Run(t)
+	})
+
+	ts.Run("interactive session", func(t *testing.T, r capytest.Runner) {
+		r.Command("repl").
+			Do().SendLine("hello").ExpectOutputContains("HELLO\r\n> ").
+			Then().SendLine("quit").
+			Done().ExpectSuccess().
+			Run(t)
+	})
+
+	ts.Run("interrupt", func(t *testing.T, r capytest.Runner) {
+		r.Command("repl").
+			Do().Wait(100 * time.Millisecond).
+			Then().Interrupt().
+			Done().ExpectExitCode(130).
+			Run(t)
+	})
+
+	ts.Run("reading after an interrupt", func(t *testing.T, r capytest.Runner) {
+		r.Command("shell").
+			Do().ExpectOutputContains("$ ").
+			Then().Send([]byte("sleep")).ExpectOutputContains("sleep").
+			Then().Interrupt().ExpectOutputContains("^C\r\n$ ").
+			Then().SendLine("ls").ExpectOutputContains("ran ls\r\n$ ").
+			Then().Interrupt().ExpectOutputContains("^C\r\n$ ").
+			Then().SendLine("exit").
+			Done().ExpectSuccess().
+			Run(t)
+	})
+}
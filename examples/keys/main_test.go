@@ -0,0 +1,69 @@
+package keys_test
+
+import (
+	"testing"
+	"time"
+
+	"go.alt-gnome.ru/capytest"
+	"go.alt-gnome.ru/capytest/providers/local"
+)
+
+// dump switches the terminal to the given modes, then prints the bytes of
+// every line it reads.
+const dump = `
+printf "$1ready\n"
+while IFS= read -r line; do
+	printf '%s' "$line" | od -An -tx1
+done
+`
+
+func TestKeys(t *testing.T) {
+	ts := capytest.NewTestSuite(t, local.Provider())
+
+	ts.Run("cursor keys", func(t *testing.T, r capytest.Runner) {
+		r.Command("sh", "-c", dump, "dump", "").
+			Do().
+			ExpectOutputContains("ready").
+			Then().
+			SendKeys(capytest.KeyUp, capytest.KeyF1, capytest.Ctrl('a'), capytest.KeyEnter).
+			ExpectOutputContains("1b 5b 41 1b 4f 50 01").
+			Then().
+			SendKeys(capytest.Ctrl('d')).
+			ExpectExitWithin(time.Second).
+			Done().
+			ExpectSuccess().
+			Run(t)
+	})
+
+	ts.Run("application cursor keys", func(t *testing.T, r capytest.Runner) {
+		r.Command("sh", "-c", dump, "dump", `\033[?1h`).
+			Do().
+			ExpectOutputContains("ready").
+			Then().
+			SendKeys(capytest.KeyUp, capytest.Alt('x'), capytest.KeyEnter).
+			ExpectOutputContains("1b 4f 41 1b 78").
+			Then().
+			SendKeys(capytest.Ctrl('d')).
+			ExpectExitWithin(time.Second).
+			Done().
+			ExpectSuccess().
+			Run(t)
+	})
+
+	ts.Run("bracketed paste", func(t *testing.T, r capytest.Runner) {
+		r.Command("sh", "-c", dump, "dump", `\033[?2004h`).
+			Do().
+			ExpectOutputContains("ready").
+			Then().
+			Paste("hi").
+			Then().
+			SendKeys(capytest.KeyEnter).
+			ExpectOutputContains("1b 5b 32 30 30 7e 68 69 1b 5b 32 30 31 7e").
+			Then().
+			SendKeys(capytest.Ctrl('d')).
+			ExpectExitWithin(time.Second).
+			Done().
+			ExpectSuccess().
+			Run(t)
+	})
+}
@@ -0,0 +1,55 @@
+package nspawn_test
+
+import (
+	"os"
+	"testing"
+
+	"go.alt-gnome.ru/capytest"
+	"go.alt-gnome.ru/capytest/providers/nspawn"
+)
+
+func TestNspawn(t *testing.T) {
+	// A container directory with systemd installed, e.g. created with
+	// mkosi or unpacked from a rootfs tarball. Booting requires root.
+	dir := os.Getenv("CAPYTEST_NSPAWN_DIR")
+	if dir == "" {
+		t.Skip("CAPYTEST_NSPAWN_DIR is not set")
+	}
+
+	ts := capytest.NewTestSuite(t, nspawn.Provider(dir,
+		nspawn.WithEphemeral(true),
+	))
+
+	ts.Run("systemd is the init", func(t *testing.T, r capytest.Runner) {
+		r.Command("cat", "/proc/1/comm").
+			ExpectStdoutEqual("systemd\n").
+			Run(t)
+	})
+
+	ts.Run("transient service can be managed", func(t *testing.T, r capytest.Runner) {
+		r.Command("systemd-run", "--unit=capytest-sleep", "sleep", "infinity").
+			ExpectSuccess().
+			Run(t)
+
+		r.Command("systemctl", "is-active", "capytest-sleep").
+			ExpectStdoutEqual("active\n").
+			Run(t)
+
+		r.Command("systemctl", "stop", "capytest-sleep").
+			ExpectSuccess().
+			Run(t)
+
+		r.Command("systemctl", "is-active", "capytest-sleep").
+			ExpectFailure().
+			ExpectStdoutEqual("inactive\n").
+			Run(t)
+	})
+
+	ts.Run("interactive shell", func(t *testing.T, r capytest.Runner) {
+		r.Command("sh").
+			Do().SendLine("echo $((2+2))").ExpectOutputContains("4").
+			Then().SendLine("exit 3").
+			Done().ExpectExitCode(3).
+			Run(t)
+	})
+}
@@ -0,0 +1,47 @@
+package pipeline_test
+
+import (
+	"testing"
+
+	"go.alt-gnome.ru/capytest"
+	"go.alt-gnome.ru/capytest/providers/local"
+)
+
+func TestPipeline(t *testing.T) {
+	ts := capytest.NewTestSuite(t, local.Provider())
+
+	ts.Run("stdout flows into the next stage", func(t *testing.T, r capytest.Runner) {
+		r.Pipeline(
+			capytest.Cmd("printf", "b\\na\\nc\\n"),
+			capytest.Cmd("sort"),
+			capytest.Cmd("tr", "a-z", "A-Z"),
+		).
+			ExpectSuccess().
+			ExpectStdoutEqual("A\nB\nC\n").
+			Run(t)
+	})
+
+	ts.Run("stdin of the first stage", func(t *testing.T, r capytest.Runner) {
+		r.Pipeline(
+			capytest.Cmd("cat"),
+			capytest.Cmd("wc", "-l"),
+		).
+			WithStdin("one\ntwo\n").
+			ExpectStdoutRegex(`^\s*2\n$`).
+			Run(t)
+	})
+
+	ts.Run("the failing stage is reported", func(t *testing.T, r capytest.Runner) {
+		r.Pipeline(
+			capytest.Cmd("sh", "-c", "echo partial; echo 'export failed' >&2; exit 3"),
+			capytest.Cmd("cat"),
+		).
+			ExpectExitCode(3).
+			ExpectStageExitCode(0, 3).
+			ExpectStageStderrContains(0, "export failed").
+			ExpectStageExitCode(1, 0).
+			ExpectStageStderrEmpty(1).
+			ExpectStdoutEqual("partial\n").
+			Run(t)
+	})
+}
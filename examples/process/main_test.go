@@ -0,0 +1,77 @@
+package process_test
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"testing"
+	"time"
+
+	"go.alt-gnome.ru/capytest"
+	"go.alt-gnome.ru/capytest/providers/local"
+)
+
+func freePort(t *testing.T) int {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func TestProcess(t *testing.T) {
+	ts := capytest.NewTestSuite(t, local.Provider())
+
+	ts.Run("server stays up while other commands run", func(t *testing.T, r capytest.Runner) {
+		if _, err := exec.LookPath("python3"); err != nil {
+			t.Skip("python3 is not installed")
+		}
+		port := freePort(t)
+		dir := t.TempDir()
+
+		r.Start(t, "python3", "-m", "http.server", "--bind", "127.0.0.1", "--directory", dir, fmt.Sprint(port)).
+			WaitForPort(port)
+
+		r.Command("sh", "-c", "echo ok > "+dir+"/health").
+			ExpectSuccess().
+			Run(t)
+
+		r.Command("python3", "-c", fmt.Sprintf("import urllib.request; print(urllib.request.urlopen('http://127.0.0.1:%d/health').read().decode(), end='')", port)).
+			ExpectStdoutEqual("ok\n").
+			Run(t)
+	})
+
+	ts.Run("readiness by output and file", func(t *testing.T, r capytest.Runner) {
+		pidfile := t.TempDir() + "/daemon.pid"
+
+		daemon := r.Start(t, "sh", "-c", "echo starting; sleep 0.2; echo $$ > "+pidfile+"; echo ready; exec sleep 60").
+			WaitForOutput("ready").
+			WaitForFile(pidfile)
+
+		r.Command("test", "-s", pidfile).
+			ExpectSuccess().
+			Run(t)
+
+		daemon.Stop()
+		if !daemon.Exited() {
+			t.Error("daemon is still running")
+		}
+	})
+
+	ts.Run("killed with its children", func(t *testing.T, r capytest.Runner) {
+		stopTimeout := capytest.DefaultStopTimeout
+		capytest.DefaultStopTimeout = 200 * time.Millisecond
+		t.Cleanup(func() { capytest.DefaultStopTimeout = stopTimeout })
+
+		// The daemon ignores interrupts, and its child keeps the output
+		// open after the daemon is gone.
+		daemon := r.Start(t, "sh", "-c", `trap "" INT; sleep 60 & echo ready; wait`).
+			WaitForOutput("ready")
+
+		daemon.Stop()
+		if !daemon.Exited() {
+			t.Error("daemon is still running")
+		}
+	})
+}
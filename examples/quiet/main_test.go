@@ -0,0 +1,47 @@
+package quiet_test
+
+import (
+	"testing"
+	"time"
+
+	"go.alt-gnome.ru/capytest"
+	"go.alt-gnome.ru/capytest/providers/local"
+)
+
+// download is a long operation that Ctrl-C cancels cleanly.
+const download = `
+trap 'kill $!; echo; echo cancelled; exit 130' INT
+echo "downloading..."
+sleep 10 & wait
+echo "error: download finished too late"
+`
+
+func TestQuiet(t *testing.T) {
+	ts := capytest.NewTestSuite(t, local.Provider())
+
+	ts.Run("Ctrl-C cancels without an error", func(t *testing.T, r capytest.Runner) {
+		r.Command("sh", "-c", download).
+			Do().
+			ExpectOutputContains("downloading...").
+			Then().
+			Interrupt().
+			ExpectOutputContains("cancelled").
+			ExpectOutputNotContains("error").
+			ExpectQuiet(100 * time.Millisecond).
+			Done().
+			ExpectExitCode(130).
+			Run(t)
+	})
+
+	ts.Run("nothing is printed before the input", func(t *testing.T, r capytest.Runner) {
+		r.Command("sh", "-c", `read name; echo "hello, $name"`).
+			Do().
+			ExpectNoOutputFor(300 * time.Millisecond).
+			Then().
+			SendLine("capybara").
+			ExpectOutputContains("hello, capybara").
+			Done().
+			ExpectSuccess().
+			Run(t)
+	})
+}
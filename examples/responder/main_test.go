@@ -0,0 +1,41 @@
+package responder_test
+
+import (
+	"testing"
+
+	"go.alt-gnome.ru/capytest"
+	"go.alt-gnome.ru/capytest/providers/local"
+)
+
+// installer asks for confirmations, some of them only sometimes, like a
+// package manager resolving dependencies.
+const installer = `
+ask() { printf '%s [y/N] ' "$1"; read answer; [ "$answer" = y ] || exit 1; }
+ask "Install 3 packages?"
+[ "$EXTRA" = 1 ] && ask "Also remove 1 package?"
+ask "Import the signing key?"
+printf 'Name: '; read name
+echo "Installed for $name"
+`
+
+func TestResponders(t *testing.T) {
+	ts := capytest.NewTestSuite(t, local.Provider())
+
+	for _, extra := range []string{"0", "1"} {
+		ts.Run("confirmations with EXTRA="+extra, func(t *testing.T, r capytest.Runner) {
+			r.Command("sh", "-c", installer).
+				WithEnv("EXTRA", extra).
+				OnOutput(`Install \d+ packages\? \[y/N\] `, "y\n", capytest.WithRequired(), capytest.WithMaxCount(1)).
+				OnOutput(`remove \d+ package\? \[y/N\] `, "y\n").
+				OnOutput(`signing key\? \[y/N\] `, "y\n", capytest.WithRequired()).
+				Do().
+				ExpectOutputContains("Name: ").
+				Then().
+				SendLine("capybara").
+				ExpectOutputContains("Installed for capybara").
+				Done().
+				ExpectSuccess().
+				Run(t)
+		})
+	}
+}
@@ -0,0 +1,90 @@
+package sandbox_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"go.alt-gnome.ru/capytest"
+	"go.alt-gnome.ru/capytest/providers/sandbox"
+)
+
+func TestSandbox(t *testing.T) {
+	ts := capytest.NewTestSuite(t, sandbox.Provider(
+		sandbox.WithoutNetwork(),
+	))
+
+	ts.Run("commands run in a fresh pid namespace", func(t *testing.T, r capytest.Runner) {
+		r.Command("cat", "/proc/1/cmdline").
+			ExpectStdoutContains("capytest-sandbox").
+			Run(t)
+	})
+
+	ts.Run("root is read-only", func(t *testing.T, r capytest.Runner) {
+		r.Command("touch", "/usr/capytest").
+			ExpectFailure().
+			ExpectStderrContains("Read-only file system").
+			Run(t)
+	})
+
+	ts.Run("/tmp is writable and kept between commands", func(t *testing.T, r capytest.Runner) {
+		r.Command("sh", "-c", "echo hi > /tmp/greeting").
+			ExpectSuccess().
+			Run(t)
+
+		r.Command("cat", "/tmp/greeting").
+			ExpectStdoutEqual("hi\n").
+			Run(t)
+	})
+
+	ts.Run("only loopback is available", func(t *testing.T, r capytest.Runner) {
+		r.Command("sh", "-c", "tail -n +3 /proc/net/dev | cut -d: -f1 | tr -d ' '").
+			ExpectStdoutEqual("lo\n").
+			Run(t)
+	})
+
+	// Failures to set up the sandbox are reported separately, so any exit
+	// code of the command is passed through.
+	ts.Run("exit code 125 of the command", func(t *testing.T, r capytest.Runner) {
+		r.Command("sh", "-c", "exit 125").
+			ExpectExitCode(125).
+			Run(t)
+	})
+
+	ts.Run("interactive shell", func(t *testing.T, r capytest.Runner) {
+		r.Command("sh").
+			Do().SendLine("echo $((2+2))").ExpectOutputContains("4").
+			Then().SendLine("exit 3").
+			Done().ExpectExitCode(3).
+			Run(t)
+	})
+
+	ts.Run("interrupt reaches the command", func(t *testing.T, r capytest.Runner) {
+		r.Command("sleep", "10").
+			Do().Wait(100 * time.Millisecond).
+			Then().Interrupt().
+			Done().ExpectExitCode(130).
+			Run(t)
+	})
+}
+
+func TestSandboxSetupFailure(t *testing.T) {
+	p := sandbox.Provider(sandbox.WithWritablePaths("/nonexistent/capytest"))
+	if err := p.Prepare(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Cleanup()
+
+	sess, err := p.StartCommand([]string{"true"}, capytest.CommandOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range sess.Stdout() {
+	}
+	for range sess.Stderr() {
+	}
+	code, err := sess.Wait()
+	if err == nil || !strings.Contains(err.Error(), "failed to set up sandbox") {
+		t.Errorf("Wait() = %d, %v, want a setup failure", code, err)
+	}
+}
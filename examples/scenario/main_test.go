@@ -0,0 +1,12 @@
+package scenario_test
+
+import (
+	"testing"
+
+	"go.alt-gnome.ru/capytest"
+	"go.alt-gnome.ru/capytest/providers/local"
+)
+
+func TestScenarios(t *testing.T) {
+	capytest.RunScenarios(t, local.Provider(), "testdata/*.txt")
+}
@@ -0,0 +1,76 @@
+package secret_test
+
+import (
+	"testing"
+
+	"go.alt-gnome.ru/capytest"
+	"go.alt-gnome.ru/capytest/providers/local"
+)
+
+// login asks for a user name and a password, turning echo off for the
+// password.
+const login = `
+printf 'login: '
+read user
+printf 'password: '
+stty -echo
+read password
+stty echo
+echo
+[ "$password" = hunter2 ] && echo "welcome $user" || echo "bad password"
+`
+
+// unlock asks for a password only when the vault is locked, which the test
+// doesn't know in advance.
+const unlock = `
+if [ -n "$LOCKED" ]; then
+	printf 'password: '
+	stty -echo
+	read password
+	stty echo
+	echo
+	echo "got $password"
+fi
+echo unlocked
+`
+
+func TestSecret(t *testing.T) {
+	ts := capytest.NewTestSuite(t, local.Provider(), capytest.WithVerbose())
+
+	ts.Run("password prompt", func(t *testing.T, r capytest.Runner) {
+		r.Command("sh", "-c", login).
+			Do().
+			ExpectOutputContains("login: ").
+			ExpectEchoEnabled().
+			Then().
+			SendLine("capybara").
+			ExpectOutputContains("password: ").
+			ExpectEchoDisabled().
+			Then().
+			SendSecret("hunter2").
+			ExpectOutputContains("welcome capybara").
+			ExpectEchoEnabled().
+			Done().
+			ExpectSuccess().
+			Run(t)
+	})
+
+	ts.Run("password in a branch", func(t *testing.T, r capytest.Runner) {
+		r.Command("sh", "-c", unlock).
+			WithEnv("LOCKED", "1").
+			Do().
+			ExpectOneOf(
+				capytest.Case{Pattern: `password: `, Steps: func(s capytest.StepBuilder) capytest.StepBuilder {
+					return s.Then().
+						SendSecret("hunter2").
+						ExpectOutputContains("got hunter2")
+				}},
+				capytest.Case{Pattern: `unlocked`},
+			).
+			Then().
+			ExpectOutputContains("unlocked").
+			Done().
+			ExpectSuccess().
+			Run(t)
+	})
+}
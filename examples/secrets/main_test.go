@@ -0,0 +1,159 @@
+package secrets_test
+
+import (
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"go.alt-gnome.ru/capytest"
+	"go.alt-gnome.ru/capytest/providers/local"
+)
+
+// token would come from the CI environment in a real test.
+const token = "ghp_0123456789abcdef"
+
+func TestSecrets(t *testing.T) {
+	ts := capytest.NewTestSuite(t, local.Provider(), capytest.WithVerbose())
+	ts.Secrets().Add(token)
+
+	// The verbose log and the snapshot show "token: ***".
+	ts.Run("token in the environment", func(t *testing.T, r capytest.Runner) {
+		r.Command("sh", "-c", `echo "token: $TOKEN"`).
+			WithEnv("TOKEN", token).
+			ExpectStdoutContains(token).
+			ExpectStdoutMatchesSnapshot().
+			ExpectSuccess().
+			Run(t)
+	})
+
+	ts.Run("secret of a command", func(t *testing.T, r capytest.Runner) {
+		r.Command("cat").
+			WithSecrets("opensesame").
+			Do().
+			SendLine("opensesame").
+			ExpectOutputContains("opensesame").
+			Then().
+			Send([]byte{4}).
+			Done().
+			ExpectSuccess().
+			Run(t)
+	})
+}
+
+// TestFailure fails on purpose with the token in its failure messages and
+// in typed input; TestFailureIsMasked runs it.
+func TestFailure(t *testing.T) {
+	if os.Getenv("SECRETS_EXAMPLE_FAIL") == "" {
+		t.Skip("run by TestFailureIsMasked")
+	}
+
+	ts := capytest.NewTestSuite(t, local.Provider())
+	ts.Secrets().Add(token)
+
+	ts.Run("wrong output", func(t *testing.T, r capytest.Runner) {
+		r.Command("echo", token).
+			ExpectStdoutContains(token + "!").
+			Run(t)
+	})
+
+	ts.Run("typed token", func(t *testing.T, r capytest.Runner) {
+		r.Command("cat").
+			Do().
+			Type(token+"\n", capytest.WithDelay(time.Millisecond)).
+			ExpectOutputNotContains(token).
+			Then().
+			Send([]byte{4}).
+			Done().
+			Run(t)
+	})
+}
+
+// TestFailureIsMasked checks that the token doesn't leak into the failure
+// messages, the reports and the terminal recordings of TestFailure.
+func TestFailureIsMasked(t *testing.T) {
+	dir := t.TempDir()
+	cmd := exec.Command(os.Args[0], "-test.run=^TestFailure$", "-test.v")
+	cmd.Env = append(os.Environ(),
+		"SECRETS_EXAMPLE_FAIL=1",
+		"CAPYTEST_REPORT_DIR="+dir,
+		"CAPYTEST_CAST=always",
+		"CAPYTEST_CAST_DIR="+dir,
+	)
+	out, err := cmd.CombinedOutput()
+	if err == nil {
+		t.Fatalf("TestFailure passed:\n%s", out)
+	}
+	if strings.Contains(string(out), token) {
+		t.Errorf("the token is in the failure messages:\n%s", out)
+	}
+	if !strings.Contains(string(out), "***") {
+		t.Errorf("the failure messages don't show the mask:\n%s", out)
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var casts int
+	for _, name := range files {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, text := range append(terminalStreams(t, name, data), string(data)) {
+			if strings.Contains(text, token) {
+				t.Errorf("the token is in %s", filepath.Base(name))
+			}
+		}
+		if filepath.Ext(name) == ".cast" {
+			casts++
+		}
+	}
+	if casts == 0 || len(files) < 4 {
+		t.Errorf("expected reports and a recording, got %q", files)
+	}
+}
+
+// terminalStreams joins the input and the output events of the recordings
+// and of the JSON report, where typed text is split into characters.
+func terminalStreams(t *testing.T, name string, data []byte) []string {
+	var streams []string
+	join := func(events [][2]string) {
+		joined := map[string]string{}
+		for _, e := range events {
+			joined[e[0]] += e[1]
+		}
+		streams = append(streams, joined["i"], joined["o"])
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	switch filepath.Ext(name) {
+	case ".cast":
+		var events [][2]string
+		for _, line := range lines[1:] {
+			var e [3]any
+			if err := json.Unmarshal([]byte(line), &e); err != nil {
+				t.Fatal(err)
+			}
+			events = append(events, [2]string{e[1].(string), e[2].(string)})
+		}
+		join(events)
+	case ".jsonl":
+		for _, line := range lines {
+			var rec capytest.CommandRecord
+			if err := json.Unmarshal([]byte(line), &rec); err != nil {
+				t.Fatal(err)
+			}
+			var events [][2]string
+			for _, e := range rec.Events {
+				events = append(events, [2]string{e.Kind, e.Data})
+			}
+			join(events)
+		}
+	}
+	return streams
+}
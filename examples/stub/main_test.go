@@ -0,0 +1,118 @@
+package stub_test
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"go.alt-gnome.ru/capytest"
+	"go.alt-gnome.ru/capytest/providers/local"
+)
+
+func TestStub(t *testing.T) {
+	ts := capytest.NewTestSuite(t, local.Provider())
+
+	ts.Run("responses depend on arguments", func(t *testing.T, r capytest.Runner) {
+		git := r.Stub("git")
+		git.On("rev-parse *").Stdout("0123abc\n")
+		git.On("push *").Stderr("rejected\n").ExitCode(1)
+
+		r.Command("sh", "-c", "git rev-parse HEAD && git push origin main").
+			ExpectExitCode(1).
+			ExpectStdoutEqual("0123abc\n").
+			ExpectStderrEqual("rejected\n").
+			Run(t)
+
+		calls := git.Calls()
+		if len(calls) != 2 {
+			t.Fatalf("expected 2 calls, got %d", len(calls))
+		}
+		if !slices.Equal(calls[1].Args, []string{"push", "origin", "main"}) {
+			t.Errorf("unexpected arguments: %q", calls[1].Args)
+		}
+	})
+
+	ts.Run("environment, directory and stdin are recorded", func(t *testing.T, r capytest.Runner) {
+		rpm := r.Stub("rpm").CaptureStdin()
+
+		r.Command("sh", "-c", "cd / && echo data | rpm --import -").
+			WithEnv("LANG", "C").
+			ExpectSuccess().
+			Run(t)
+
+		calls := rpm.Calls()
+		if len(calls) != 1 {
+			t.Fatalf("expected 1 call, got %d", len(calls))
+		}
+		if calls[0].Dir != "/" {
+			t.Errorf("unexpected directory: %q", calls[0].Dir)
+		}
+		if calls[0].Stdin != "data\n" {
+			t.Errorf("unexpected stdin: %q", calls[0].Stdin)
+		}
+		if !slices.Contains(calls[0].Env, "LANG=C") {
+			t.Errorf("LANG is not recorded: %q", calls[0].Env)
+		}
+	})
+
+	ts.Run("tools used by the stubs can be stubbed", func(t *testing.T, r capytest.Runner) {
+		cat := r.Stub("cat").CaptureStdin()
+		cat.On("/etc/*").Stdout("stubbed\n")
+		mkdir := r.Stub("mkdir")
+
+		r.Command("sh", "-c", "echo data | cat /etc/hostname && mkdir -p /nonexistent/dir").
+			WithTimeout(10 * time.Second).
+			ExpectSuccess().
+			ExpectStdoutEqual("stubbed\n").
+			Run(t)
+
+		calls := cat.Calls()
+		if len(calls) != 1 {
+			t.Fatalf("expected 1 call of cat, got %d", len(calls))
+		}
+		if calls[0].Stdin != "data\n" {
+			t.Errorf("unexpected stdin: %q", calls[0].Stdin)
+		}
+		if !slices.ContainsFunc(calls[0].Env, func(e string) bool {
+			return strings.HasPrefix(e, "PATH=") && strings.Contains(e, "capytest-stub")
+		}) {
+			t.Errorf("PATH of the caller is not recorded: %q", calls[0].Env)
+		}
+		if calls := mkdir.Calls(); len(calls) != 1 || !slices.Equal(calls[0].Args, []string{"-p", "/nonexistent/dir"}) {
+			t.Errorf("unexpected calls of mkdir: %+v", calls)
+		}
+	})
+}
+
+// TestStubOfNewRunner checks that a runner shared by several tests removes
+// its stubs after each of them and writes them again for the next one.
+func TestStubOfNewRunner(t *testing.T) {
+	r := capytest.NewRunner(local.Provider())
+	hello := r.Stub("hello")
+	hello.On("*").Stdout("hi\n")
+
+	var dir string
+	for _, name := range []string{"first", "second"} {
+		t.Run(name, func(t *testing.T) {
+			r.Command("sh", "-c", "hello").
+				ExpectStdoutEqual("hi\n").
+				Run(t)
+
+			calls := hello.Calls()
+			if len(calls) != 1 {
+				t.Fatalf("expected 1 call, got %d", len(calls))
+			}
+			for _, env := range calls[0].Env {
+				if path, ok := strings.CutPrefix(env, "PATH="); ok {
+					dir = filepath.Dir(strings.Split(path, string(os.PathListSeparator))[0])
+				}
+			}
+		})
+		if _, err := os.Stat(dir); !os.IsNotExist(err) {
+			t.Errorf("stub directory %q is left after the %s test: %v", dir, name, err)
+		}
+	}
+}
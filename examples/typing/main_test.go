@@ -0,0 +1,63 @@
+package typing_test
+
+import (
+	"testing"
+	"time"
+
+	"go.alt-gnome.ru/capytest"
+	"go.alt-gnome.ru/capytest/providers/local"
+)
+
+// prompt reads the answer a character at a time, without echo, like a
+// readline-based program. It tells whether the characters arrived at least
+// $1 milliseconds apart, as typed, or faster, as in a single burst.
+const prompt = `
+stty -icanon -echo min 1
+printf 'name: '
+name= last= gap=
+while c=$(dd bs=1 count=1 2>/dev/null) && [ -n "$c" ]; do
+	now=$(date +%s%N)
+	if [ -n "$last" ] && { [ -z "$gap" ] || [ $((now - last)) -lt "$gap" ]; }; then
+		gap=$((now - last))
+	fi
+	last=$now
+	name="$name$c"
+done
+echo "hello $name"
+if [ $((gap / 1000000)) -ge "$1" ]; then
+	echo "typed"
+else
+	echo "burst: characters $((gap / 1000000))ms apart"
+fi
+`
+
+func TestTyping(t *testing.T) {
+	ts := capytest.NewTestSuite(t, local.Provider())
+
+	ts.Run("types an answer", func(t *testing.T, r capytest.Runner) {
+		r.Command("sh", "-c", prompt, "sh", "20").
+			Do().
+			ExpectOutputContains("name: ").
+			Then().
+			Type("capybara", capytest.WithDelay(40*time.Millisecond), capytest.WithJitter(10*time.Millisecond)).
+			Then().
+			SendKeys(capytest.KeyEnter).
+			ExpectOutputContains("hello capybara\r\ntyped").
+			Done().
+			ExpectSuccess().
+			Run(t)
+	})
+
+	ts.Run("paces every step", func(t *testing.T, r capytest.Runner) {
+		r.Command("sh", "-c", prompt, "sh", "20").
+			WithInputPacing(40*time.Millisecond, 10*time.Millisecond).
+			Do().
+			ExpectOutputContains("name: ").
+			Then().
+			SendLine("capybara").
+			ExpectOutputContains("hello capybara\r\ntyped").
+			Done().
+			ExpectSuccess().
+			Run(t)
+	})
+}
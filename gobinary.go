@@ -0,0 +1,274 @@
+package capytest
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// BuildOptions configures BuildGoBinary.
+type BuildOptions struct {
+	// Tags are passed to go build as -tags.
+	Tags []string
+
+	// LDFlags are passed to go build as -ldflags.
+	LDFlags string
+
+	// CoverPkg is passed to go build as -coverpkg. By default only the
+	// packages of the main module are instrumented.
+	CoverPkg string
+
+	// Env is added to the environment of go build, e.g. "CGO_ENABLED=0"
+	// for binaries that run in containers.
+	Env []string
+}
+
+type goBuild struct {
+	once sync.Once
+	path string
+	err  error
+}
+
+// goBuilds holds the binaries built by the test binary and the directory
+// their coverage data is written to.
+var goBuilds struct {
+	sync.Mutex
+	dir      string
+	coverDir string
+	builds   map[string]*goBuild
+}
+
+// BuildGoBinary builds the main package pkgPath with coverage enabled and
+// returns the path to the binary. Each package and options pair is built
+// once per test binary, so the helper can be called from every test.
+//
+// While a coverage build exists, GOCOVERDIR is set for every command the
+// runners start, and binaries are copied into providers implementing
+// FileCopier. Use Main from TestMain to merge the coverage into the
+// -coverprofile output of go test.
+func BuildGoBinary(t testing.TB, pkgPath string, opts BuildOptions) string {
+	t.Helper()
+
+	key := fmt.Sprintf("%s %q", pkgPath, opts)
+
+	goBuilds.Lock()
+	if goBuilds.builds == nil {
+		goBuilds.builds = map[string]*goBuild{}
+	}
+	b, ok := goBuilds.builds[key]
+	if !ok {
+		b = &goBuild{}
+		goBuilds.builds[key] = b
+	}
+	index := len(goBuilds.builds)
+	goBuilds.Unlock()
+
+	b.once.Do(func() {
+		b.path, b.err = buildGoBinary(pkgPath, opts, index)
+	})
+	if b.err != nil {
+		t.Fatalf("failed to build %s: %v", pkgPath, b.err)
+	}
+	return b.path
+}
+
+func buildGoBinary(pkgPath string, opts BuildOptions, index int) (string, error) {
+	dir, coverDir, err := buildDirs()
+	if err != nil {
+		return "", err
+	}
+
+	name := filepath.Base(pkgPath)
+	if name == "." || name == string(filepath.Separator) {
+		name = "main"
+	}
+	out := filepath.Join(dir, fmt.Sprint(index), name)
+
+	args := []string{"build", "-cover", "-covermode=" + coverMode(), "-o", out}
+	if len(opts.Tags) > 0 {
+		args = append(args, "-tags", strings.Join(opts.Tags, ","))
+	}
+	if opts.LDFlags != "" {
+		args = append(args, "-ldflags", opts.LDFlags)
+	}
+	if opts.CoverPkg != "" {
+		args = append(args, "-coverpkg", opts.CoverPkg)
+	}
+	args = append(args, pkgPath)
+
+	cmd := exec.Command("go", args...)
+	cmd.Env = append(os.Environ(), opts.Env...)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return "", fmt.Errorf("%w\n%s", err, output)
+	}
+
+	goBuilds.Lock()
+	goBuilds.coverDir = coverDir
+	goBuilds.Unlock()
+	return out, nil
+}
+
+func buildDirs() (string, string, error) {
+	goBuilds.Lock()
+	defer goBuilds.Unlock()
+
+	if goBuilds.dir == "" {
+		dir, err := os.MkdirTemp("", "capytest-build")
+		if err != nil {
+			return "", "", err
+		}
+		goBuilds.dir = dir
+	}
+	coverDir := filepath.Join(goBuilds.dir, "cover")
+	if err := os.MkdirAll(coverDir, 0o777); err != nil {
+		return "", "", err
+	}
+	return goBuilds.dir, coverDir, nil
+}
+
+// coverMode matches the mode of go test -cover, so that the profiles can be
+// merged.
+func coverMode() string {
+	if f := flag.Lookup("test.covermode"); f != nil && f.Value.String() != "" {
+		return f.Value.String()
+	}
+	return "set"
+}
+
+// coverageEnv returns the environment every command gets while coverage
+// builds exist.
+func coverageEnv() []string {
+	goBuilds.Lock()
+	defer goBuilds.Unlock()
+	if goBuilds.coverDir == "" {
+		return nil
+	}
+	return []string{"GOCOVERDIR=" + goBuilds.coverDir}
+}
+
+// builtBinaries returns the paths of the binaries built so far.
+func builtBinaries() []string {
+	goBuilds.Lock()
+	defer goBuilds.Unlock()
+	var paths []string
+	for _, b := range goBuilds.builds {
+		if b.path != "" {
+			paths = append(paths, b.path)
+		}
+	}
+	return paths
+}
+
+// copyBuilds copies the built binaries and an empty coverage directory to a
+// provider that does not share the host filesystem. It returns a function
+// collecting the coverage data written by the command.
+func copyBuilds(t *testing.T, fc FileCopier) func() {
+	t.Helper()
+
+	env := coverageEnv()
+	if env == nil {
+		return func() {}
+	}
+	coverDir := strings.TrimPrefix(env[0], "GOCOVERDIR=")
+
+	for _, path := range builtBinaries() {
+		if err := fc.CopyTo(path, path); err != nil {
+			t.Fatalf("failed to copy %s: %v", path, err)
+		}
+	}
+	if err := fc.CopyTo(coverDir, coverDir); err != nil {
+		t.Fatalf("failed to create coverage directory: %v", err)
+	}
+
+	return func() {
+		if err := fc.CopyFrom(coverDir, coverDir); err != nil {
+			t.Errorf("failed to collect coverage data: %v", err)
+		}
+	}
+}
+
+// Main runs the tests and then appends the coverage collected from binaries
+// built by BuildGoBinary to the -coverprofile output, and removes the
+// builds. Use it as:
+//
+//	func TestMain(m *testing.M) {
+//		capytest.Main(m)
+//	}
+func Main(m *testing.M) {
+	code := m.Run()
+
+	if err := mergeCoverage(); err != nil {
+		fmt.Fprintf(os.Stderr, "capytest: failed to merge coverage: %v\n", err)
+		if code == 0 {
+			code = 1
+		}
+	}
+
+	goBuilds.Lock()
+	if goBuilds.dir != "" {
+		os.RemoveAll(goBuilds.dir)
+	}
+	goBuilds.Unlock()
+
+	os.Exit(code)
+}
+
+func mergeCoverage() error {
+	f := flag.Lookup("test.coverprofile")
+	if f == nil || f.Value.String() == "" {
+		return nil
+	}
+	profile := f.Value.String()
+	if out := flag.Lookup("test.outputdir"); out != nil && out.Value.String() != "" && !filepath.IsAbs(profile) {
+		profile = filepath.Join(out.Value.String(), profile)
+	}
+
+	goBuilds.Lock()
+	coverDir := goBuilds.coverDir
+	goBuilds.Unlock()
+	if coverDir == "" {
+		return nil
+	}
+	entries, err := os.ReadDir(coverDir)
+	if err != nil || len(entries) == 0 {
+		return err
+	}
+
+	text := filepath.Join(filepath.Dir(coverDir), "cover.txt")
+	cmd := exec.Command("go", "tool", "covdata", "textfmt", "-i="+coverDir, "-o="+text)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%w\n%s", err, output)
+	}
+
+	in, err := os.Open(text)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(profile, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	// The profile written by go test already starts with the mode line.
+	w := bufio.NewWriter(out)
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		if strings.HasPrefix(scanner.Text(), "mode:") {
+			continue
+		}
+		fmt.Fprintln(w, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return w.Flush()
+}
@@ -0,0 +1,357 @@
+package capytest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html"
+	"html/template"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// WriteHTMLReport renders the records as a self-contained HTML page with a
+// timeline of the commands of every test: their output, the input sent to
+// interactive commands, the expectations and a player of the terminal
+// session. The reports written to DefaultReportDir include such a page.
+func WriteHTMLReport(w io.Writer, title string, records []*CommandRecord) error {
+	if err := htmlTemplate.ExecuteTemplate(w, "header", title); err != nil {
+		return err
+	}
+	for _, rec := range records {
+		if err := htmlTemplate.ExecuteTemplate(w, "command", rec); err != nil {
+			return err
+		}
+	}
+	return htmlTemplate.ExecuteTemplate(w, "footer", nil)
+}
+
+// htmlParts returns the header and the footer of the page, between which
+// the commands are written. The page groups the commands by test when it
+// is opened, so that they can be written as they finish.
+func htmlParts(title string) (header, footer string, err error) {
+	var b strings.Builder
+	if err := htmlTemplate.ExecuteTemplate(&b, "header", title); err != nil {
+		return "", "", err
+	}
+	header = b.String()
+	b.Reset()
+	if err := htmlTemplate.ExecuteTemplate(&b, "footer", nil); err != nil {
+		return "", "", err
+	}
+	return header, b.String(), nil
+}
+
+func htmlCommand(rec *CommandRecord) ([]byte, error) {
+	var b bytes.Buffer
+	err := htmlTemplate.ExecuteTemplate(&b, "command", rec)
+	return b.Bytes(), err
+}
+
+var htmlTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"ansi": ansiHTML,
+	"diff": diffHTML,
+	"quote": func(s string) string {
+		return strconv.Quote(s)
+	},
+	"duration": func(d time.Duration) string {
+		return d.Round(time.Millisecond).String()
+	},
+	"events": func(events []TerminalEvent) (string, error) {
+		data, err := json.Marshal(events)
+		return string(data), err
+	},
+	"argv": func(argv []string) string {
+		return strings.Join(argv, " ")
+	},
+}).Parse(htmlPage))
+
+const htmlPage = `{{define "header"}}<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+pre { background: #1e1e1e; color: #ddd; padding: .5em; overflow-x: auto; white-space: pre-wrap; }
+summary { cursor: pointer; }
+.test { margin-bottom: 1em; }
+.test > summary { font-size: 1.2em; font-weight: bold; }
+.cmd { border-left: 4px solid #2a2; margin: 1em 0 1em 1em; padding-left: 1em; }
+.cmd.fail { border-color: #c22; }
+.cmd h3 { font-family: monospace; margin: .2em 0; }
+.meta { color: #666; font-size: .9em; }
+.pass { color: #2a2; }
+.fail { color: #c22; }
+.step { margin-left: 1em; }
+.input { font-family: monospace; background: #eef; }
+.player button { margin: .3em .3em .3em 0; }
+.diff .del { background: #4b1818; color: #f88; }
+.diff .ins { background: #173d17; color: #8f8; }
+.diff .range { color: #6af; }
+</style>
+</head>
+<body>
+<h1>{{.}}</h1>
+<p id="summary"></p>
+<div id="tests"></div>
+{{end}}
+
+{{define "command"}}
+<div class="cmd{{if .Failed}} fail{{end}}" data-test="{{.Test}}" data-start="{{.Start.UnixMicro}}">
+<h3>$ {{.Name}}</h3>
+<div class="meta">{{.Provider}} · exit code {{.ExitCode}} · {{duration .Duration}} · {{.Start.Format "15:04:05.000"}}</div>
+{{if .Error}}<p class="fail">{{.Error}}</p>{{end}}
+{{if .Env}}<details><summary>environment</summary><pre>{{range .Env}}{{.}}
+{{end}}</pre></details>{{end}}
+{{range $i, $s := .Stages}}
+<div class="step">stage {{$i}}: <code>{{argv $s.Argv}}</code> · exit code {{$s.ExitCode}}
+{{if $s.Stderr}}<pre>{{ansi $s.Stderr}}</pre>{{end}}</div>
+{{end}}
+{{range .Steps}}
+<div class="step">{{.Action}}{{if .Input}} <span class="input">{{quote .Input}}</span>{{end}}{{if .Branch}} → case <code>{{.Branch}}</code>{{end}}
+{{range .Expectations}}<div class="{{if .Passed}}pass{{else}}fail{{end}}">{{if .Passed}}✓{{else}}✗{{end}} {{.Description}}</div>{{end}}
+{{if .Output}}<pre>{{ansi .Output}}</pre>{{end}}
+</div>
+{{end}}
+{{if .Expectations}}<ul>
+{{range .Expectations}}<li class="{{if .Passed}}pass{{else}}fail{{end}}">{{if .Passed}}✓{{else}}✗{{end}} {{.Description}}{{if .Diff}}<pre class="diff">{{diff .Diff}}</pre>{{else if .Message}}<pre>{{ansi .Message}}</pre>{{end}}</li>
+{{end}}</ul>{{end}}
+{{if .Stdout}}<details open><summary>stdout</summary><pre>{{ansi .Stdout}}</pre></details>{{end}}
+{{if .Stderr}}<details open><summary>stderr</summary><pre>{{ansi .Stderr}}</pre></details>{{end}}
+{{if .Transcript}}<details><summary>transcript</summary><pre>{{ansi .Transcript}}</pre></details>{{end}}
+{{if .Events}}<details class="player" data-events="{{events .Events}}"><summary>replay</summary>
+<button class="play">play</button><button class="restart">restart</button><pre class="screen"></pre></details>{{end}}
+</div>
+{{end}}
+
+{{define "footer"}}
+<script>
+var tests = {}, commands = 0, failed = 0;
+document.querySelectorAll(".cmd").forEach(function (cmd) {
+  var test = tests[cmd.dataset.test];
+  if (!test) {
+    test = tests[cmd.dataset.test] = document.createElement("details");
+    test.className = "test";
+    var summary = document.createElement("summary");
+    summary.className = "pass";
+    summary.textContent = cmd.dataset.test;
+    test.appendChild(summary);
+    document.getElementById("tests").appendChild(test);
+  }
+  test.appendChild(cmd);
+  commands++;
+  if (cmd.classList.contains("fail")) {
+    failed++;
+    test.open = true;
+    test.firstChild.className = "fail";
+  }
+});
+Object.values(tests).forEach(function (test) {
+  Array.from(test.querySelectorAll(":scope > .cmd"))
+    .sort(function (a, b) { return a.dataset.start - b.dataset.start; })
+    .forEach(function (cmd) { test.appendChild(cmd); });
+});
+document.getElementById("summary").innerHTML = Object.keys(tests).length + " tests, " + commands +
+  " commands, <span class=\"" + (failed ? "fail" : "pass") + "\">" + failed + " failed</span>";
+function render(text) {
+  text = text.replace(/\x1b\[[0-9;?]*[ -\/]*[@-~]|\x1b\][^\x07\x1b]*(\x07|\x1b\\)|\x1b[()][A-Za-z0-9]|\x1b[=>]/g, "");
+  var lines = [""], col = 0;
+  for (var ch of text) {
+    var line = lines[lines.length - 1];
+    if (ch === "\n") { lines.push(""); col = 0; }
+    else if (ch === "\r") { col = 0; }
+    else if (ch === "\b") { col = Math.max(0, col - 1); }
+    else {
+      lines[lines.length - 1] = line.slice(0, col) + ch + line.slice(col + 1);
+      col++;
+    }
+  }
+  return lines.join("\n");
+}
+document.querySelectorAll(".player").forEach(function (player) {
+  var events = JSON.parse(player.dataset.events).filter(function (e) { return e.kind === "o"; });
+  var screen = player.querySelector(".screen");
+  var timers = [];
+  function stop() { timers.forEach(clearTimeout); timers = []; }
+  function play() {
+    stop();
+    var output = "";
+    screen.textContent = "";
+    events.forEach(function (e) {
+      timers.push(setTimeout(function () {
+        output += e.data;
+        screen.textContent = render(output);
+      }, e.time * 1000));
+    });
+  }
+  player.querySelector(".play").onclick = play;
+  player.querySelector(".restart").onclick = function () { stop(); screen.textContent = ""; };
+});
+</script>
+</body>
+</html>
+{{end}}`
+
+var ansiSequence = regexp.MustCompile(`\x1b\[([0-9;?]*)([ -/]*[@-~])|\x1b\][^\x07\x1b]*(?:\x07|\x1b\\)|\x1b[()][A-Za-z0-9]|\x1b[=>]`)
+
+var ansiColors = [16]string{
+	"#000000", "#cd3131", "#0dbc79", "#e5e510", "#2472c8", "#bc3fbc", "#11a8cd", "#e5e5e5",
+	"#666666", "#f14c4c", "#23d18b", "#f5f543", "#3b8eea", "#d670d6", "#29b8db", "#ffffff",
+}
+
+type ansiStyle struct {
+	fg, bg                  string
+	bold, italic, underline bool
+}
+
+func (s ansiStyle) css() string {
+	var css []string
+	if s.fg != "" {
+		css = append(css, "color:"+s.fg)
+	}
+	if s.bg != "" {
+		css = append(css, "background:"+s.bg)
+	}
+	if s.bold {
+		css = append(css, "font-weight:bold")
+	}
+	if s.italic {
+		css = append(css, "font-style:italic")
+	}
+	if s.underline {
+		css = append(css, "text-decoration:underline")
+	}
+	return strings.Join(css, ";")
+}
+
+// color256 returns the color of the xterm 256-color palette.
+func color256(n int) string {
+	switch {
+	case n < 16:
+		return ansiColors[n]
+	case n < 232:
+		n -= 16
+		level := func(v int) int {
+			if v == 0 {
+				return 0
+			}
+			return 55 + v*40
+		}
+		return fmt.Sprintf("#%02x%02x%02x", level(n/36), level(n/6%6), level(n%6))
+	default:
+		v := 8 + (n-232)*10
+		return fmt.Sprintf("#%02x%02x%02x", v, v, v)
+	}
+}
+
+// apply updates the style with the parameters of an SGR sequence.
+func (s *ansiStyle) apply(params string) {
+	codes := strings.Split(params, ";")
+	for i := 0; i < len(codes); i++ {
+		code, _ := strconv.Atoi(codes[i])
+		switch {
+		case code == 0:
+			*s = ansiStyle{}
+		case code == 1:
+			s.bold = true
+		case code == 3:
+			s.italic = true
+		case code == 4:
+			s.underline = true
+		case code == 22:
+			s.bold = false
+		case code == 23:
+			s.italic = false
+		case code == 24:
+			s.underline = false
+		case code >= 30 && code <= 37:
+			s.fg = ansiColors[code-30]
+		case code >= 90 && code <= 97:
+			s.fg = ansiColors[code-90+8]
+		case code == 39:
+			s.fg = ""
+		case code >= 40 && code <= 47:
+			s.bg = ansiColors[code-40]
+		case code >= 100 && code <= 107:
+			s.bg = ansiColors[code-100+8]
+		case code == 49:
+			s.bg = ""
+		case code == 38 || code == 48:
+			var color string
+			if i+2 < len(codes) && codes[i+1] == "5" {
+				n, _ := strconv.Atoi(codes[i+2])
+				color = color256(n % 256)
+				i += 2
+			} else if i+4 < len(codes) && codes[i+1] == "2" {
+				r, _ := strconv.Atoi(codes[i+2])
+				g, _ := strconv.Atoi(codes[i+3])
+				b, _ := strconv.Atoi(codes[i+4])
+				color = fmt.Sprintf("#%02x%02x%02x", r&0xff, g&0xff, b&0xff)
+				i += 4
+			}
+			if code == 38 {
+				s.fg = color
+			} else {
+				s.bg = color
+			}
+		}
+	}
+}
+
+// ansiHTML escapes terminal output for HTML, rendering the colors and
+// dropping other escape sequences.
+func ansiHTML(text string) template.HTML {
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	text = strings.ReplaceAll(text, "\r", "")
+
+	var b strings.Builder
+	var style ansiStyle
+	write := func(s string) {
+		if s == "" {
+			return
+		}
+		if css := style.css(); css != "" {
+			fmt.Fprintf(&b, `<span style="%s">%s</span>`, css, html.EscapeString(s))
+		} else {
+			b.WriteString(html.EscapeString(s))
+		}
+	}
+
+	last := 0
+	for _, m := range ansiSequence.FindAllStringSubmatchIndex(text, -1) {
+		write(text[last:m[0]])
+		last = m[1]
+		if m[4] >= 0 && text[m[4]:m[5]] == "m" {
+			style.apply(text[m[2]:m[3]])
+		}
+	}
+	write(text[last:])
+	return template.HTML(b.String())
+}
+
+// diffHTML renders a diff between a snapshot and the output, coloring the
+// removed and added lines.
+func diffHTML(diff string) template.HTML {
+	var b strings.Builder
+	for _, line := range strings.SplitAfter(diff, "\n") {
+		class := ""
+		switch {
+		case strings.HasPrefix(line, "- "):
+			class = "del"
+		case strings.HasPrefix(line, "+ "):
+			class = "ins"
+		case strings.HasPrefix(line, "@@"):
+			class = "range"
+		}
+		if class == "" {
+			b.WriteString(html.EscapeString(line))
+		} else {
+			fmt.Fprintf(&b, `<span class="%s">%s</span>`, class, html.EscapeString(line))
+		}
+	}
+	return template.HTML(b.String())
+}
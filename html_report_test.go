@@ -0,0 +1,144 @@
+package capytest
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAnsiHTML(t *testing.T) {
+	tests := []struct {
+		name, in, want string
+	}{
+		{"plain", "hello\n", "hello\n"},
+		{"escaping", `<b>&"x"</b>`, "&lt;b&gt;&amp;&#34;x&#34;&lt;/b&gt;"},
+		{"crlf", "a\r\nb\r", "a\nb"},
+		{"basic color", "\x1b[31mred\x1b[0m plain", `<span style="color:#cd3131">red</span> plain`},
+		{"bright background", "\x1b[102mx", `<span style="background:#23d18b">x</span>`},
+		{"bold and reset", "\x1b[1;34mx\x1b[22my\x1b[39mz", `<span style="color:#2472c8;font-weight:bold">x</span><span style="color:#2472c8">y</span>z`},
+		{"italic and underline", "\x1b[3;4mx\x1b[23;24my", `<span style="font-style:italic;text-decoration:underline">x</span>y`},
+		{"256 palette", "\x1b[38;5;9mx", `<span style="color:#f14c4c">x</span>`},
+		{"256 cube", "\x1b[38;5;196mx\x1b[48;5;16my", `<span style="color:#ff0000">x</span><span style="color:#ff0000;background:#000000">y</span>`},
+		{"256 grayscale", "\x1b[38;5;244mx", `<span style="color:#808080">x</span>`},
+		{"truecolor", "\x1b[38;2;1;2;255;48;2;16;32;48mx", `<span style="color:#0102ff;background:#102030">x</span>`},
+		{"default colors", "\x1b[31;41mx\x1b[39;49my", `<span style="color:#cd3131;background:#cd3131">x</span>y`},
+		{"other sequences dropped", "\x1b[2J\x1b[?25l\x1b]0;title\x07\x1b(Bx\x1b>", "x"},
+		{"escaped inside color", "\x1b[32m<ok>", `<span style="color:#0dbc79">&lt;ok&gt;</span>`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := string(ansiHTML(tt.in)); got != tt.want {
+				t.Errorf("ansiHTML(%q) =\n%s\nwant\n%s", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDiffHTML(t *testing.T) {
+	got := string(diffHTML("@@ -1,2 +1,2 @@\n  same\n- <old>\n+ new\n"))
+	want := `<span class="range">@@ -1,2 +1,2 @@` + "\n</span>  same\n" +
+		`<span class="del">- &lt;old&gt;` + "\n</span>" +
+		`<span class="ins">+ new` + "\n</span>"
+	if got != want {
+		t.Errorf("diffHTML() =\n%s\nwant\n%s", got, want)
+	}
+}
+
+// reportFixture is a test with a passing pipeline and a failing
+// interactive command, written out of order.
+func reportFixture() []*CommandRecord {
+	start := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+	return []*CommandRecord{
+		{
+			Test:     "TestLogin",
+			Provider: "local",
+			Argv:     []string{"login"},
+			Start:    start.Add(time.Second),
+			ExitCode: 1,
+			Steps: []StepRecord{{
+				Action: "send",
+				Input:  "<user>\n",
+				Output: "\x1b[31mdenied\x1b[0m",
+				Expectations: []ExpectationRecord{
+					{Description: "output contains \"welcome\"", Message: "not found"},
+				},
+			}},
+			Expectations: []ExpectationRecord{{
+				Description: "stdout matches snapshot",
+				Message:     "- Snapshot - 1\n+ Received + 1\n\n- welcome\n+ denied\n",
+				Diff:        "- Snapshot - 1\n+ Received + 1\n\n- welcome\n+ denied\n",
+			}},
+			Events: []TerminalEvent{{Time: 0.1, Kind: "o", Data: "</script>"}},
+		},
+		{
+			Test:     "TestPipe",
+			Provider: "local",
+			Start:    start,
+			Stdout:   "3\n",
+			Stages: []StageRecord{
+				{Argv: []string{"seq", "3"}},
+				{Argv: []string{"wc", "-l"}},
+			},
+		},
+	}
+}
+
+func TestWriteHTMLReport(t *testing.T) {
+	var b strings.Builder
+	if err := WriteHTMLReport(&b, "fixture <report>", reportFixture()); err != nil {
+		t.Fatal(err)
+	}
+	page := b.String()
+
+	for _, want := range []string{
+		"<title>fixture &lt;report&gt;</title>",
+		`<div class="cmd fail" data-test="TestLogin" data-start="1735787046000000">`,
+		`<div class="cmd" data-test="TestPipe" data-start="1735787045000000">`,
+		"<h3>$ seq 3 | wc -l</h3>",
+		`<span class="input">&#34;&lt;user&gt;\n&#34;</span>`,
+		`<pre><span style="color:#cd3131">denied</span></pre>`,
+		`<pre class="diff">`,
+		`<span class="del">- welcome`,
+		`<span class="ins">+ denied`,
+		`data-events="[{&#34;time&#34;:0.1,&#34;kind&#34;:&#34;o&#34;,&#34;data&#34;:&#34;\u003c/script\u003e&#34;}]"`,
+	} {
+		if !strings.Contains(page, want) {
+			t.Errorf("page does not contain %s", want)
+		}
+	}
+	if strings.Count(page, "</script>") != 1 {
+		t.Errorf("output of a command ends the script:\n%s", page)
+	}
+	if strings.Contains(page, "<pre>- Snapshot") {
+		t.Errorf("snapshot diff is rendered as a plain message")
+	}
+}
+
+func TestReporterWritesHTMLReport(t *testing.T) {
+	dir := t.TempDir()
+	records := reportFixture()
+
+	var r reporter
+	for _, rec := range records {
+		if err := r.write(dir, rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r.stream.Close()
+	r.junit.f.Close()
+	r.html.f.Close()
+
+	got, err := os.ReadFile(filepath.Join(dir, reportName()+".html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want strings.Builder
+	if err := WriteHTMLReport(&want, reportName(), records); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want.String() {
+		t.Errorf("page written command by command differs from WriteHTMLReport:\n%s\nwant\n%s", got, want.String())
+	}
+}
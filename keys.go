@@ -0,0 +1,134 @@
+package capytest
+
+import (
+	"regexp"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// Key is a key of the keyboard sent with StepBuilder.SendKeys.
+type Key struct {
+	name string
+	seq  string
+	// appSeq is sent instead of seq when the program enabled application
+	// cursor keys, as full-screen programs do.
+	appSeq string
+}
+
+// String returns the name of the key, e.g. "Ctrl-C".
+func (k Key) String() string {
+	return k.name
+}
+
+// Keys with a fixed encoding, as sent by xterm.
+var (
+	KeyEnter     = Key{name: "Enter", seq: "\r"}
+	KeyTab       = Key{name: "Tab", seq: "\t"}
+	KeyShiftTab  = Key{name: "Shift-Tab", seq: "\x1b[Z"}
+	KeyBackspace = Key{name: "Backspace", seq: "\x7f"}
+	KeyEsc       = Key{name: "Esc", seq: "\x1b"}
+
+	KeyUp    = Key{name: "Up", seq: "\x1b[A", appSeq: "\x1bOA"}
+	KeyDown  = Key{name: "Down", seq: "\x1b[B", appSeq: "\x1bOB"}
+	KeyRight = Key{name: "Right", seq: "\x1b[C", appSeq: "\x1bOC"}
+	KeyLeft  = Key{name: "Left", seq: "\x1b[D", appSeq: "\x1bOD"}
+	KeyHome  = Key{name: "Home", seq: "\x1b[H", appSeq: "\x1bOH"}
+	KeyEnd   = Key{name: "End", seq: "\x1b[F", appSeq: "\x1bOF"}
+
+	KeyInsert   = Key{name: "Insert", seq: "\x1b[2~"}
+	KeyDelete   = Key{name: "Delete", seq: "\x1b[3~"}
+	KeyPageUp   = Key{name: "PageUp", seq: "\x1b[5~"}
+	KeyPageDown = Key{name: "PageDown", seq: "\x1b[6~"}
+
+	KeyF1  = Key{name: "F1", seq: "\x1bOP"}
+	KeyF2  = Key{name: "F2", seq: "\x1bOQ"}
+	KeyF3  = Key{name: "F3", seq: "\x1bOR"}
+	KeyF4  = Key{name: "F4", seq: "\x1bOS"}
+	KeyF5  = Key{name: "F5", seq: "\x1b[15~"}
+	KeyF6  = Key{name: "F6", seq: "\x1b[17~"}
+	KeyF7  = Key{name: "F7", seq: "\x1b[18~"}
+	KeyF8  = Key{name: "F8", seq: "\x1b[19~"}
+	KeyF9  = Key{name: "F9", seq: "\x1b[20~"}
+	KeyF10 = Key{name: "F10", seq: "\x1b[21~"}
+	KeyF11 = Key{name: "F11", seq: "\x1b[23~"}
+	KeyF12 = Key{name: "F12", seq: "\x1b[24~"}
+)
+
+// Ctrl returns the key combination of Ctrl and a letter, e.g. Ctrl('c')
+// for an interrupt or Ctrl('d') for the end of input.
+func Ctrl(letter rune) Key {
+	letter = unicode.ToUpper(letter)
+	if letter < 'A' || letter > 'Z' {
+		panic("capytest: Ctrl takes a letter")
+	}
+	return Key{name: "Ctrl-" + string(letter), seq: string(rune(letter - 'A' + 1))}
+}
+
+// Alt returns the key combination of Alt and a letter, sent as Esc
+// followed by the letter.
+func Alt(letter rune) Key {
+	return Key{name: "Alt-" + string(letter), seq: "\x1b" + string(letter)}
+}
+
+// termModes follows the modes a program sets in its terminal that change
+// how input is encoded.
+type termModes struct {
+	mu             sync.Mutex
+	appCursor      bool
+	bracketedPaste bool
+	// tail keeps the end of the last output, in case a sequence is split
+	// between reads.
+	tail string
+}
+
+var privateModeSequence = regexp.MustCompile(`\x1b\[\?([0-9;]+)([hl])`)
+
+func (m *termModes) update(out string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	text := m.tail + out
+	for _, match := range privateModeSequence.FindAllStringSubmatch(text, -1) {
+		set := match[2] == "h"
+		for _, mode := range strings.Split(match[1], ";") {
+			switch mode {
+			case "1":
+				m.appCursor = set
+			case "2004":
+				m.bracketedPaste = set
+			}
+		}
+	}
+
+	// Sequences complete in text are dropped from the tail, so that they
+	// are not applied twice.
+	if i := strings.LastIndexByte(text, '\x1b'); i >= 0 && !privateModeSequence.MatchString(text[i:]) && len(text)-i < 16 {
+		m.tail = text[i:]
+	} else {
+		m.tail = ""
+	}
+}
+
+// encodeKey returns the input of the key in the current mode.
+func (m *termModes) encodeKey(k Key) []byte {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.appCursor && k.appSeq != "" {
+		return []byte(k.appSeq)
+	}
+	return []byte(k.seq)
+}
+
+// encodePaste wraps text in bracketed paste markers if the program asked
+// for them, like a terminal does.
+func (m *termModes) encodePaste(text string) []byte {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.bracketedPaste {
+		return []byte("\x1b[200~" + text + "\x1b[201~")
+	}
+	return []byte(text)
+}
@@ -0,0 +1,439 @@
+package capytest
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// PipelineBuilder configures a pipeline of commands whose stdout is fed to
+// the stdin of the next command, like `a | b | c` in a shell but without
+// one. Stages are numbered from 0.
+type PipelineBuilder interface {
+	Executable
+
+	// WithStdin writes input to the first stage. Without it the first stage
+	// reads EOF right away.
+	WithStdin(input string) PipelineBuilder
+
+	// WithEnv sets an environment variable for every stage.
+	WithEnv(key, value string) PipelineBuilder
+
+	// ExpectExitCode expects the exit code of the pipeline to be code. As
+	// with `set -o pipefail`, it is the one of the last stage that failed,
+	// or 0.
+	ExpectExitCode(code int) PipelineBuilder
+
+	// ExpectSuccess expects every stage to exit with code 0.
+	ExpectSuccess() PipelineBuilder
+
+	// ExpectFailure expects at least one stage to fail.
+	ExpectFailure() PipelineBuilder
+
+	// ExpectStageExitCode expects the given stage to exit with code.
+	ExpectStageExitCode(stage, code int) PipelineBuilder
+
+	// ExpectStageStderrContains expects the stderr of the given stage to
+	// contain substr.
+	ExpectStageStderrContains(stage int, substr string) PipelineBuilder
+
+	// ExpectStageStderrRegex expects the stderr of the given stage to match
+	// the regex pattern.
+	ExpectStageStderrRegex(stage int, pattern string) PipelineBuilder
+
+	// ExpectStageStderrEmpty expects the stderr of the given stage to be
+	// empty.
+	ExpectStageStderrEmpty(stage int) PipelineBuilder
+
+	// ExpectStdoutContains expects the stdout of the last stage to contain
+	// substr.
+	ExpectStdoutContains(substr string) PipelineBuilder
+
+	// ExpectStdoutRegex expects the stdout of the last stage to match the
+	// regex pattern.
+	ExpectStdoutRegex(pattern string) PipelineBuilder
+
+	// ExpectStdoutEqual expects the stdout of the last stage to equal
+	// expected.
+	ExpectStdoutEqual(expected string) PipelineBuilder
+
+	// ExpectStdoutEmpty expects the stdout of the last stage to be empty.
+	ExpectStdoutEmpty() PipelineBuilder
+
+	// ExpectStdoutMatchesSnapshot expects the stdout of the last stage to
+	// match the snapshot.
+	ExpectStdoutMatchesSnapshot() PipelineBuilder
+}
+
+// Cmd is a shorthand for the argv of a pipeline stage.
+func Cmd(name string, args ...string) []string {
+	return append([]string{name}, args...)
+}
+
+type stageExpectations struct {
+	exitCode       *int
+	stderrContains []string
+	stderrRegexes  []string
+	stderrEmpty    bool
+}
+
+type pipelineBuilder struct {
+	runner *runner
+	stages [][]string
+
+	stdin *string
+
+	expectedExitCode *int
+	expectSuccess    bool
+	expectFailure    bool
+
+	// stageExpects is indexed by stage, and badStages holds the negative
+	// stages given to the expectations.
+	stageExpects []*stageExpectations
+	badStages    []int
+
+	// stdout collects the expectations on the output of the last stage.
+	stdout commandBuilder
+}
+
+func (r *runner) Pipeline(stages ...[]string) PipelineBuilder {
+	return &pipelineBuilder{
+		runner: r,
+		stages: stages,
+		stdout: commandBuilder{secrets: Secrets{parent: r.secrets}},
+	}
+}
+
+func (b *pipelineBuilder) stage(i int) *stageExpectations {
+	if i < 0 {
+		if !slices.Contains(b.badStages, i) {
+			b.badStages = append(b.badStages, i)
+		}
+		return &stageExpectations{}
+	}
+	for len(b.stageExpects) <= i {
+		b.stageExpects = append(b.stageExpects, nil)
+	}
+	if b.stageExpects[i] == nil {
+		b.stageExpects[i] = &stageExpectations{}
+	}
+	return b.stageExpects[i]
+}
+
+func (b *pipelineBuilder) WithStdin(input string) PipelineBuilder {
+	b.stdin = &input
+	return b
+}
+
+func (b *pipelineBuilder) WithEnv(key, value string) PipelineBuilder {
+	b.stdout.WithEnv(key, value)
+	return b
+}
+
+func (b *pipelineBuilder) ExpectExitCode(code int) PipelineBuilder {
+	b.expectedExitCode = &code
+	b.expectSuccess = false
+	b.expectFailure = false
+	return b
+}
+
+func (b *pipelineBuilder) ExpectSuccess() PipelineBuilder {
+	b.expectedExitCode = nil
+	b.expectSuccess = true
+	b.expectFailure = false
+	return b
+}
+
+func (b *pipelineBuilder) ExpectFailure() PipelineBuilder {
+	b.expectedExitCode = nil
+	b.expectSuccess = false
+	b.expectFailure = true
+	return b
+}
+
+func (b *pipelineBuilder) ExpectStageExitCode(stage, code int) PipelineBuilder {
+	b.stage(stage).exitCode = &code
+	return b
+}
+
+func (b *pipelineBuilder) ExpectStageStderrContains(stage int, substr string) PipelineBuilder {
+	b.stage(stage).stderrContains = append(b.stage(stage).stderrContains, substr)
+	return b
+}
+
+func (b *pipelineBuilder) ExpectStageStderrRegex(stage int, pattern string) PipelineBuilder {
+	b.stage(stage).stderrRegexes = append(b.stage(stage).stderrRegexes, pattern)
+	return b
+}
+
+func (b *pipelineBuilder) ExpectStageStderrEmpty(stage int) PipelineBuilder {
+	b.stage(stage).stderrEmpty = true
+	return b
+}
+
+func (b *pipelineBuilder) ExpectStdoutContains(substr string) PipelineBuilder {
+	b.stdout.ExpectStdoutContains(substr)
+	return b
+}
+
+func (b *pipelineBuilder) ExpectStdoutRegex(pattern string) PipelineBuilder {
+	b.stdout.ExpectStdoutRegex(pattern)
+	return b
+}
+
+func (b *pipelineBuilder) ExpectStdoutEqual(expected string) PipelineBuilder {
+	b.stdout.ExpectStdoutEqual(expected)
+	return b
+}
+
+func (b *pipelineBuilder) ExpectStdoutEmpty() PipelineBuilder {
+	b.stdout.ExpectStdoutEmpty()
+	return b
+}
+
+func (b *pipelineBuilder) ExpectStdoutMatchesSnapshot() PipelineBuilder {
+	b.stdout.ExpectStdoutMatchesSnapshot()
+	return b
+}
+
+func (b *pipelineBuilder) Run(t *testing.T) {
+	t.Helper()
+
+	if len(b.stages) == 0 {
+		t.Fatalf("pipeline has no stages")
+	}
+
+	p := b.runner.p
+	rec := &CommandRecord{Test: t.Name(), Provider: providerName(p), Start: time.Now()}
+	for _, cmd := range b.stages {
+		rec.Stages = append(rec.Stages, StageRecord{Argv: cmd})
+	}
+	b.stdout.record = rec
+	defer func() {
+		rec.Duration = time.Since(rec.Start)
+		rec.mask(&b.stdout.secrets)
+		reports.add(t, rec)
+	}()
+	log := b.runner.outputLog(t, &b.stdout.secrets)
+	defer log.close()
+
+	if fc, ok := p.(FileCopier); ok {
+		defer copyBuilds(t, fc)()
+	}
+	stubEnv, collect := b.runner.prepareStubs(t)
+	defer collect()
+	env := append(coverageEnv(), stubEnv...)
+	opts := CommandOptions{Env: append(env, b.stdout.env...)}
+	rec.Env = opts.Env
+
+	sessions := make([]NotInteractiveSession, len(b.stages))
+	for i, cmd := range b.stages {
+		session, err := p.StartCommand(cmd, opts)
+		if err != nil {
+			stopStages(t, sessions[:i])
+			rec.Error = b.stdout.secrets.sprintf("failed to start stage %d (%s): %v", i, strings.Join(cmd, " "), err)
+			t.Fatal(rec.Error)
+		}
+		sessions[i] = session
+	}
+
+	closeStdin := func(i int) {
+		c, ok := sessions[i].(StdinCloser)
+		if !ok {
+			t.Errorf("stage %d: provider does not support closing stdin", i)
+			return
+		}
+		c.CloseStdin()
+	}
+
+	if b.stdin != nil {
+		log.send([]byte(*b.stdin))
+		if err := sessions[0].Write(*b.stdin); err != nil {
+			t.Errorf("failed to write to stdin of stage 0: %v", err)
+		}
+	}
+	closeStdin(0)
+
+	var wg sync.WaitGroup
+	stderr := make([]strings.Builder, len(sessions))
+	var stdout strings.Builder
+	for i, session := range sessions {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			prefix := "[stderr]"
+			if len(sessions) > 1 {
+				prefix = fmt.Sprintf("[stage %d stderr]", i)
+			}
+			for out := range session.Stderr() {
+				log.write(prefix, out)
+				stderr[i].WriteString(out)
+			}
+		}()
+
+		if i == len(sessions)-1 {
+			go func() {
+				defer wg.Done()
+				for out := range session.Stdout() {
+					log.write("[stdout]", out)
+					stdout.WriteString(out)
+				}
+			}()
+			continue
+		}
+
+		// Once the next stage exits, its stdin is gone; the output is still
+		// drained so that this stage can finish, like after SIGPIPE.
+		next := sessions[i+1]
+		go func() {
+			defer wg.Done()
+			for out := range session.Stdout() {
+				next.Write(out)
+			}
+			closeStdin(i + 1)
+		}()
+	}
+
+	codes := make([]int, len(sessions))
+	for i, session := range sessions {
+		code, err := session.Wait()
+		if err != nil {
+			t.Error(b.stdout.secrets.sprintf("error waiting for stage %d (%s): %v", i, strings.Join(b.stages[i], " "), err))
+		}
+		codes[i] = code
+	}
+	wg.Wait()
+
+	stderrs := make([]string, len(stderr))
+	for i := range stderr {
+		stderrs[i] = stderr[i].String()
+		rec.Stages[i].ExitCode = codes[i]
+		rec.Stages[i].Stderr = stderrs[i]
+	}
+	rec.Stdout = stdout.String()
+	b.validate(codes, stdout.String(), stderrs, t)
+}
+
+// stopStages interrupts the stages started before one failed to start and
+// waits for them, killing those that don't exit within DefaultStopTimeout,
+// so that none of them outlives the test.
+func stopStages(t *testing.T, sessions []NotInteractiveSession) {
+	t.Helper()
+
+	for _, session := range sessions {
+		session.Interrupt()
+		if c, ok := session.(StdinCloser); ok {
+			c.CloseStdin()
+		}
+	}
+	for i, session := range sessions {
+		exited := make(chan struct{})
+		go func() {
+			defer close(exited)
+			var wg sync.WaitGroup
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				for range session.Stdout() {
+				}
+			}()
+			go func() {
+				defer wg.Done()
+				for range session.Stderr() {
+				}
+			}()
+			session.Wait()
+			wg.Wait()
+		}()
+
+		select {
+		case <-exited:
+			continue
+		case <-time.After(DefaultStopTimeout):
+		}
+		k, ok := session.(KillableSession)
+		if !ok {
+			t.Errorf("stage %d did not exit after an interrupt", i)
+			continue
+		}
+		k.Kill()
+		select {
+		case <-exited:
+		case <-time.After(DefaultStopTimeout):
+			t.Errorf("stage %d did not exit after being killed", i)
+		}
+	}
+}
+
+// pipefail returns the exit code of the last failed stage, or 0.
+func pipefail(codes []int) int {
+	for i := len(codes) - 1; i >= 0; i-- {
+		if codes[i] != 0 {
+			return codes[i]
+		}
+	}
+	return 0
+}
+
+func (b *pipelineBuilder) validate(codes []int, stdout string, stderr []string, t *testing.T) {
+	t.Helper()
+
+	name := func(i int) string {
+		return fmt.Sprintf("stage %d (%s)", i, strings.Join(b.stages[i], " "))
+	}
+
+	exps := &b.stdout.record.Expectations
+
+	if b.expectSuccess {
+		for i, code := range codes {
+			check(t, &b.stdout.secrets, exps, fmt.Sprintf("stage %d succeeds", i), code == 0,
+				"%s failed with exit code %d\nstderr: %q", name(i), code, stderr[i])
+		}
+	}
+	if b.expectedExitCode != nil {
+		code := pipefail(codes)
+		check(t, &b.stdout.secrets, exps, fmt.Sprintf("exit code %d", *b.expectedExitCode), code == *b.expectedExitCode,
+			"unexpected pipeline exit code: got %d, want %d\nstage exit codes: %v", code, *b.expectedExitCode, codes)
+	}
+	if b.expectFailure {
+		check(t, &b.stdout.secrets, exps, "failure", pipefail(codes) != 0, "expected failure but every stage succeeded")
+	}
+
+	for _, i := range b.badStages {
+		check(t, &b.stdout.secrets, exps, fmt.Sprintf("stage %d exists", i), false,
+			"expectation for stage %d, but the pipeline has %d stages", i, len(codes))
+	}
+	for i, exp := range b.stageExpects {
+		if exp == nil {
+			continue
+		}
+		if i >= len(codes) {
+			check(t, &b.stdout.secrets, exps, fmt.Sprintf("stage %d exists", i), false,
+				"expectation for stage %d, but the pipeline has %d stages", i, len(codes))
+			continue
+		}
+		if exp.exitCode != nil {
+			check(t, &b.stdout.secrets, exps, fmt.Sprintf("stage %d exit code %d", i, *exp.exitCode), codes[i] == *exp.exitCode,
+				"unexpected exit code of %s: got %d, want %d\nstderr: %q", name(i), codes[i], *exp.exitCode, stderr[i])
+		}
+		for _, substr := range exp.stderrContains {
+			check(t, &b.stdout.secrets, exps, fmt.Sprintf("stage %d stderr contains %q", i, substr), strings.Contains(stderr[i], substr),
+				"stderr of %s does not contain %q\nstderr: %q", name(i), substr, stderr[i])
+		}
+		for _, pattern := range exp.stderrRegexes {
+			matched, _ := regexp.MatchString(pattern, stderr[i])
+			check(t, &b.stdout.secrets, exps, fmt.Sprintf("stage %d stderr matches %q", i, pattern), matched,
+				"stderr of %s does not match regex %q\nstderr: %q", name(i), pattern, stderr[i])
+		}
+		if exp.stderrEmpty {
+			check(t, &b.stdout.secrets, exps, fmt.Sprintf("stage %d stderr is empty", i), stderr[i] == "",
+				"expected stderr of %s to be empty but got: %q", name(i), stderr[i])
+		}
+	}
+
+	b.stdout.validateResults(pipefail(codes), stdout, "", t)
+}
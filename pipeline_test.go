@@ -0,0 +1,69 @@
+package capytest
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeStage prints until it is interrupted, or killed if it ignores
+// interrupts, and exits once its output is read.
+type fakeStage struct {
+	ignoreInterrupt bool
+
+	stdout, stderr chan string
+	stop           chan struct{}
+	once           sync.Once
+	exited         chan struct{}
+}
+
+func newFakeStage(ignoreInterrupt bool) *fakeStage {
+	s := &fakeStage{
+		ignoreInterrupt: ignoreInterrupt,
+		stdout:          make(chan string),
+		stderr:          make(chan string),
+		stop:            make(chan struct{}),
+		exited:          make(chan struct{}),
+	}
+	go func() {
+		defer close(s.exited)
+		defer close(s.stderr)
+		defer close(s.stdout)
+		for {
+			select {
+			case s.stdout <- "y\n":
+			case <-s.stop:
+				s.stderr <- "stopped\n"
+				return
+			}
+		}
+	}()
+	return s
+}
+
+func (s *fakeStage) Write(string) error    { return nil }
+func (s *fakeStage) Stdout() <-chan string { return s.stdout }
+func (s *fakeStage) Stderr() <-chan string { return s.stderr }
+func (s *fakeStage) Wait() (int, error)    { <-s.exited; return 130, nil }
+func (s *fakeStage) Kill() error           { s.once.Do(func() { close(s.stop) }); return nil }
+func (s *fakeStage) Interrupt() error {
+	if !s.ignoreInterrupt {
+		s.Kill()
+	}
+	return nil
+}
+
+func TestStopStages(t *testing.T) {
+	defer func(d time.Duration) { DefaultStopTimeout = d }(DefaultStopTimeout)
+	DefaultStopTimeout = 100 * time.Millisecond
+
+	stages := []*fakeStage{newFakeStage(false), newFakeStage(true)}
+	stopStages(t, []NotInteractiveSession{stages[0], stages[1]})
+	for i, s := range stages {
+		select {
+		case <-s.exited:
+		default:
+			t.Errorf("stage %d is still running", i)
+		}
+	}
+}
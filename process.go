@@ -0,0 +1,243 @@
+package capytest
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// DefaultWaitTimeout is how long the readiness probes of a Process and the
+// steps waiting for output, a case of ExpectOneOf, quiet, an exit or the
+// terminal echo wait.
+var DefaultWaitTimeout = 10 * time.Second
+
+// DefaultStopTimeout is how long Stop waits for a process to exit after
+// interrupting it before killing it.
+var DefaultStopTimeout = 5 * time.Second
+
+// Process is a command running in the background while the scenario runs
+// other commands, such as a daemon or a server the tool under test talks
+// to. It is stopped when the test finishes, and its output is logged if
+// the test failed.
+type Process struct {
+	t       *testing.T
+	runner  *runner
+	name    string
+	session NotInteractiveSession
+	timeout time.Duration
+	log     *outputLog
+
+	mu     sync.Mutex
+	stdout strings.Builder
+	stderr strings.Builder
+	output strings.Builder
+
+	exited   chan struct{}
+	exitCode int
+	err      error
+	stopOnce sync.Once
+}
+
+// Start starts the command in the background. t is used for failures and
+// stops the process when it finishes.
+func (r *runner) Start(t *testing.T, name string, args ...string) *Process {
+	t.Helper()
+
+	env, collect := r.prepareStubs(t)
+	session, err := r.p.StartCommand(append([]string{name}, args...), CommandOptions{Env: append(coverageEnv(), env...)})
+	if err != nil {
+		t.Fatalf("failed to start %s: %v", name, err)
+	}
+
+	p := &Process{
+		t:       t,
+		log:     r.outputLog(t, r.secrets),
+		runner:  r,
+		name:    name,
+		session: session,
+		timeout: DefaultWaitTimeout,
+		exited:  make(chan struct{}),
+	}
+
+	var readers sync.WaitGroup
+	readers.Add(2)
+	go p.read(session.Stdout(), &p.stdout, "["+name+" stdout]", &readers)
+	go p.read(session.Stderr(), &p.stderr, "["+name+" stderr]", &readers)
+	go func() {
+		readers.Wait()
+		p.exitCode, p.err = session.Wait()
+		close(p.exited)
+	}()
+
+	t.Cleanup(func() {
+		p.Stop()
+		p.log.close()
+		collect()
+		if !t.Failed() {
+			return
+		}
+		status := "still running"
+		if p.Exited() {
+			status = fmt.Sprintf("exit code %d", p.exitCode)
+		}
+		t.Logf("output of %s (%s):\n%s", name, status, r.secrets.Mask(p.Output()))
+	})
+
+	return p
+}
+
+func (p *Process) read(ch <-chan string, buf *strings.Builder, prefix string, wg *sync.WaitGroup) {
+	defer wg.Done()
+	for out := range ch {
+		p.log.write(prefix, out)
+		p.mu.Lock()
+		buf.WriteString(out)
+		p.output.WriteString(out)
+		p.mu.Unlock()
+	}
+}
+
+// WithTimeout sets how long the readiness probes wait.
+func (p *Process) WithTimeout(timeout time.Duration) *Process {
+	p.timeout = timeout
+	return p
+}
+
+// WaitForOutput waits until stdout or stderr contains substr.
+func (p *Process) WaitForOutput(substr string) *Process {
+	p.t.Helper()
+	p.waitFor(fmt.Sprintf("output %q", substr), func() bool {
+		return strings.Contains(p.Output(), substr)
+	})
+	return p
+}
+
+// WaitForPort waits until a TCP connection to the port on localhost
+// succeeds. Ports of containers have to be published to the host.
+func (p *Process) WaitForPort(port int) *Process {
+	p.t.Helper()
+	addr := net.JoinHostPort("localhost", strconv.Itoa(port))
+	p.waitFor("port "+strconv.Itoa(port), func() bool {
+		conn, err := net.DialTimeout("tcp", addr, 100*time.Millisecond)
+		if err != nil {
+			return false
+		}
+		conn.Close()
+		return true
+	})
+	return p
+}
+
+// WaitForFile waits until the path exists where the commands run, e.g. a
+// pid file or a socket.
+func (p *Process) WaitForFile(path string) *Process {
+	p.t.Helper()
+	p.waitFor("file "+path, func() bool {
+		_, code, err := p.runner.exec("test", "-e", path)
+		return err == nil && code == 0
+	})
+	return p
+}
+
+func (p *Process) waitFor(what string, ready func() bool) {
+	p.t.Helper()
+
+	deadline := time.After(p.timeout)
+	for {
+		if ready() {
+			return
+		}
+		select {
+		case <-p.exited:
+			if ready() {
+				return
+			}
+			p.t.Fatal(p.runner.secrets.sprintf("%s exited with code %d while waiting for %s\noutput: %q", p.name, p.exitCode, what, p.Output()))
+		case <-deadline:
+			p.t.Fatal(p.runner.secrets.sprintf("%s: timed out after %s waiting for %s\noutput: %q", p.name, p.timeout, what, p.Output()))
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
+
+// Write writes to the stdin of the process.
+func (p *Process) Write(input string) error {
+	p.log.send([]byte(input))
+	return p.session.Write(input)
+}
+
+// Stdout returns the stdout of the process so far.
+func (p *Process) Stdout() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.stdout.String()
+}
+
+// Stderr returns the stderr of the process so far.
+func (p *Process) Stderr() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.stderr.String()
+}
+
+// Output returns stdout and stderr interleaved as they were received.
+func (p *Process) Output() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.output.String()
+}
+
+// Exited reports whether the process has exited.
+func (p *Process) Exited() bool {
+	select {
+	case <-p.exited:
+		return true
+	default:
+		return false
+	}
+}
+
+// Stop interrupts the process and waits for it to exit, killing it after
+// DefaultStopTimeout if the session supports it. The kill is given
+// DefaultStopTimeout as well, since output pipes kept open by children can
+// outlive the process. It returns the exit code, or -1 if the process
+// could not be stopped.
+func (p *Process) Stop() int {
+	p.t.Helper()
+
+	p.stopOnce.Do(func() {
+		if !p.Exited() {
+			p.session.Interrupt()
+			select {
+			case <-p.exited:
+			case <-time.After(DefaultStopTimeout):
+				k, ok := p.session.(KillableSession)
+				if !ok {
+					p.t.Errorf("%s did not exit after an interrupt", p.name)
+					return
+				}
+				if err := k.Kill(); err != nil {
+					p.t.Errorf("failed to kill %s: %v", p.name, err)
+				}
+				select {
+				case <-p.exited:
+				case <-time.After(DefaultStopTimeout):
+					p.t.Errorf("%s did not exit after being killed", p.name)
+					return
+				}
+			}
+		}
+		if p.err != nil {
+			p.t.Errorf("error waiting for %s: %v", p.name, p.err)
+		}
+	})
+
+	if !p.Exited() {
+		return -1
+	}
+	return p.exitCode
+}
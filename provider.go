@@ -39,3 +39,46 @@ type InteractiveSession interface {
 	Write([]byte) error
 	Output() <-chan string
 }
+
+// ResizableSession is implemented by interactive sessions whose terminal
+// size can be changed while the command is running.
+type ResizableSession interface {
+	Resize(rows, cols uint16) error
+}
+
+// DefaultTerminalSize is the terminal size interactive commands start
+// with, unless they set WithTerminalSize. It is applied to sessions that
+// implement ResizableSession and written to the recordings.
+var DefaultTerminalSize = struct{ Rows, Cols uint16 }{24, 80}
+
+// StdinCloser is implemented by non-interactive sessions that can close the
+// stdin of their command, which then reads EOF.
+type StdinCloser interface {
+	CloseStdin() error
+}
+
+// KillableSession is implemented by sessions whose command can be killed
+// when it does not react to an interrupt.
+type KillableSession interface {
+	Kill() error
+}
+
+// FileCopier is implemented by providers whose commands do not see the host
+// filesystem. It is used to copy in binaries built by BuildGoBinary and to
+// copy their coverage data back out.
+type FileCopier interface {
+	// CopyTo copies a host file or directory to path on the target,
+	// creating missing parent directories.
+	CopyTo(hostPath, path string) error
+
+	// CopyFrom copies the contents of the directory path on the target into
+	// the host directory hostPath.
+	CopyFrom(path, hostPath string) error
+}
+
+// EchoSession is implemented by interactive sessions that can tell whether
+// the terminal of their command echoes input, which programs turn off while
+// reading a password.
+type EchoSession interface {
+	Echo() (bool, error)
+}
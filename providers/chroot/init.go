@@ -0,0 +1,130 @@
+//go:build linux
+
+package chroot
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// initEnv carries the initConfig to the re-executed test binary, which sets
+// up the chroot from this package's init function and then execs the
+// command in place of itself.
+const initEnv = "CAPYTEST_CHROOT_INIT"
+
+// statusFd is the write end of the status pipe. The init writes there why
+// it failed to set up the chroot; the pipe is closed on exec, so that exit
+// codes of the command are never mistaken for setup failures.
+const statusFd = 3
+
+type initConfig struct {
+	Argv    []string `json:"argv"`
+	Rootfs  string   `json:"rootfs"`
+	Workdir string   `json:"workdir"`
+	Binds   []string `json:"binds,omitempty"`
+}
+
+func init() {
+	if data, ok := os.LookupEnv(initEnv); ok {
+		os.Exit(runInit(data))
+	}
+}
+
+func runInit(data string) int {
+	unix.CloseOnExec(statusFd)
+
+	var cfg initConfig
+	if err := json.Unmarshal([]byte(data), &cfg); err != nil {
+		return initFailed(fmt.Errorf("invalid config: %w", err))
+	}
+
+	if err := enterRootfs(cfg); err != nil {
+		return initFailed(err)
+	}
+	if err := unix.Prctl(unix.PR_CAP_AMBIENT, unix.PR_CAP_AMBIENT_CLEAR_ALL, 0, 0, 0); err != nil {
+		return initFailed(fmt.Errorf("failed to drop capabilities: %w", err))
+	}
+
+	var env []string
+	for _, e := range os.Environ() {
+		if !strings.HasPrefix(e, initEnv+"=") {
+			env = append(env, e)
+		}
+	}
+
+	path, err := exec.LookPath(cfg.Argv[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "capytest-chroot: %v\n", err)
+		return 127
+	}
+	err = unix.Exec(path, cfg.Argv, env)
+	fmt.Fprintf(os.Stderr, "capytest-chroot: %v\n", err)
+	return 126
+}
+
+func initFailed(err error) int {
+	status := os.NewFile(statusFd, "status")
+	if _, werr := fmt.Fprint(status, err); werr != nil {
+		fmt.Fprintf(os.Stderr, "capytest-chroot: %v\n", err)
+	}
+	return 125
+}
+
+// enterRootfs bind mounts the pseudo filesystems and the configured binds
+// into the rootfs, chroots into it and changes to the working directory.
+// The mounts are made in the private mount namespace of the command.
+func enterRootfs(cfg initConfig) error {
+	if err := unix.Mount("", "/", "", unix.MS_REC|unix.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("failed to make mounts private: %w", err)
+	}
+
+	binds := []string{"/proc", "/dev", "/sys"}
+	binds = append(binds, cfg.Binds...)
+	for _, bind := range binds {
+		src, dst, ok := strings.Cut(bind, ":")
+		if !ok {
+			dst = src
+		}
+		target := filepath.Join(cfg.Rootfs, dst)
+		if err := mountpoint(src, target); err != nil {
+			return fmt.Errorf("failed to create mountpoint %s: %w", dst, err)
+		}
+		if err := unix.Mount(src, target, "", unix.MS_BIND|unix.MS_REC, ""); err != nil {
+			return fmt.Errorf("failed to bind %s: %w", bind, err)
+		}
+	}
+
+	if err := unix.Chroot(cfg.Rootfs); err != nil {
+		return fmt.Errorf("failed to chroot: %w", err)
+	}
+	if err := unix.Chdir(cfg.Workdir); err != nil {
+		return fmt.Errorf("failed to change directory to %s: %w", cfg.Workdir, err)
+	}
+	return nil
+}
+
+// mountpoint creates the target of a bind mount: a directory, or an empty
+// file when a single file is bound.
+func mountpoint(src, target string) error {
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return os.MkdirAll(target, 0o755)
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(target, os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
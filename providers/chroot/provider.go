@@ -0,0 +1,431 @@
+//go:build linux
+
+package chroot
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/creack/pty"
+	"go.alt-gnome.ru/capytest"
+	"golang.org/x/sys/unix"
+)
+
+var DefaultTar string = "tar"
+
+type ChrootOption func(*chrootProvider)
+
+// WithWorkdir sets the working directory of commands inside the rootfs.
+// Defaults to "/".
+func WithWorkdir(workdir string) ChrootOption {
+	return func(p *chrootProvider) {
+		p.workdir = workdir
+	}
+}
+
+// WithBinds adds bind mounts in the "host:target" form, target being a path
+// inside the rootfs. A bare path is mounted at the same location.
+func WithBinds(binds ...string) ChrootOption {
+	return func(p *chrootProvider) {
+		p.binds = append(p.binds, binds...)
+	}
+}
+
+type chrootProvider struct {
+	source  string
+	workdir string
+	binds   []string
+
+	rootfs    string
+	extracted bool
+	prepared  bool
+}
+
+// Provider runs commands chrooted into a rootfs. The source is either an
+// unpacked rootfs directory or a tarball in any format tar(1) can extract,
+// such as an ALT rootfs .tar.xz.
+func Provider(source string, opts ...ChrootOption) *chrootProvider {
+	p := &chrootProvider{
+		source:  source,
+		workdir: "/",
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p
+}
+
+// Prepare extracts the tarball into a temporary directory. A rootfs
+// directory is used in place.
+func (p *chrootProvider) Prepare() error {
+	if p.prepared {
+		return nil
+	}
+
+	info, err := os.Stat(p.source)
+	if err != nil {
+		return fmt.Errorf("failed to access rootfs: %w", err)
+	}
+
+	if info.IsDir() {
+		p.rootfs = p.source
+	} else {
+		dir, err := os.MkdirTemp("", "capytest-rootfs")
+		if err != nil {
+			return fmt.Errorf("failed to create rootfs directory: %w", err)
+		}
+		// Device nodes can not be created without privileges and are
+		// replaced by the host /dev anyway.
+		cmd := exec.Command(DefaultTar, "-x", "-f", p.source, "-C", dir, "--exclude=./dev/*", "--exclude=dev/*")
+		if output, err := cmd.CombinedOutput(); err != nil {
+			os.RemoveAll(dir)
+			return fmt.Errorf("failed to extract %s: %w\n%s", p.source, err, output)
+		}
+		p.rootfs = dir
+		p.extracted = true
+	}
+
+	p.prepared = true
+	return nil
+}
+
+// Cleanup detaches whatever is still mounted inside the rootfs and removes
+// an extracted tarball. Commands mount in their own namespace, so normally
+// nothing is left; the check guards against removing host files through a
+// leftover bind mount.
+func (p *chrootProvider) Cleanup() error {
+	if !p.prepared {
+		return nil
+	}
+
+	if err := unmountAll(p.rootfs); err != nil {
+		return err
+	}
+	if p.extracted {
+		if err := os.RemoveAll(p.rootfs); err != nil {
+			return fmt.Errorf("failed to remove rootfs %s: %w", p.rootfs, err)
+		}
+	}
+
+	p.rootfs = ""
+	p.extracted = false
+	p.prepared = false
+	return nil
+}
+
+func unmountAll(root string) error {
+	root, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return err
+	}
+	var mounts []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 5 && strings.HasPrefix(fields[4], root+"/") {
+			mounts = append(mounts, fields[4])
+		}
+	}
+	f.Close()
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	// Deepest mounts first.
+	sort.Sort(sort.Reverse(sort.StringSlice(mounts)))
+	for _, mountpoint := range mounts {
+		if err := unix.Unmount(mountpoint, unix.MNT_DETACH); err != nil && err != unix.EINVAL {
+			return fmt.Errorf("failed to unmount %s: %w", mountpoint, err)
+		}
+	}
+	return nil
+}
+
+func (p *chrootProvider) command(cmd []string, opts capytest.CommandOptions) (*exec.Cmd, *setupStatus, error) {
+	if !p.prepared {
+		if err := p.Prepare(); err != nil {
+			return nil, nil, fmt.Errorf("failed to prepare rootfs: %w", err)
+		}
+	}
+
+	self, err := os.Executable()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	data, err := json.Marshal(initConfig{
+		Argv:    cmd,
+		Rootfs:  p.rootfs,
+		Workdir: p.workdir,
+		Binds:   p.binds,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	status, err := newSetupStatus()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	c := exec.Command(self)
+	c.Args[0] = "capytest-chroot"
+	c.Env = append(append(os.Environ(), opts.Env...), initEnv+"="+string(data))
+	c.SysProcAttr = &syscall.SysProcAttr{Cloneflags: unix.CLONE_NEWNS}
+	c.ExtraFiles = []*os.File{status.w}
+
+	// Without privileges the mount namespace is created inside a user
+	// namespace; the init keeps the capabilities it needs across exec.
+	if uid, gid := os.Getuid(), os.Getgid(); uid != 0 {
+		c.SysProcAttr.Cloneflags |= unix.CLONE_NEWUSER
+		c.SysProcAttr.UidMappings = []syscall.SysProcIDMap{{ContainerID: uid, HostID: uid, Size: 1}}
+		c.SysProcAttr.GidMappings = []syscall.SysProcIDMap{{ContainerID: gid, HostID: gid, Size: 1}}
+		c.SysProcAttr.AmbientCaps = []uintptr{unix.CAP_SYS_ADMIN, unix.CAP_SYS_CHROOT}
+	}
+
+	return c, status, nil
+}
+
+// setupStatus is the read end of the pipe the init reports setup failures
+// on, see statusFd.
+type setupStatus struct {
+	r, w *os.File
+}
+
+func newSetupStatus() (*setupStatus, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	return &setupStatus{r: r, w: w}, nil
+}
+
+// started closes the write end in this process once the init has it, or
+// both ends if err shows it was not started.
+func (s *setupStatus) started(err error) {
+	s.w.Close()
+	if err != nil {
+		s.r.Close()
+	}
+}
+
+// result returns the setup failure reported by the init, or else err, the
+// result of waiting for the command.
+func (s *setupStatus) result(err error) error {
+	defer s.r.Close()
+	msg, _ := io.ReadAll(s.r)
+	if len(msg) > 0 {
+		return fmt.Errorf("failed to set up chroot: %s", msg)
+	}
+	return err
+}
+
+type session struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout io.ReadCloser
+	stderr io.ReadCloser
+
+	stdoutC chan string
+	stderrC chan string
+	done    chan error
+}
+
+func readPipe(r io.Reader, ch chan string, wg *sync.WaitGroup) {
+	defer wg.Done()
+	buf := make([]byte, 1024)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			ch <- string(buf[:n])
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (s *session) Write(input string) error {
+	_, err := io.WriteString(s.stdin, input)
+	return err
+}
+
+func (s *session) CloseStdin() error {
+	return s.stdin.Close()
+}
+
+func (s *session) Stdout() <-chan string {
+	return s.stdoutC
+}
+
+func (s *session) Stderr() <-chan string {
+	return s.stderrC
+}
+
+func (s *session) Wait() (int, error) {
+	return exitCode(<-s.done)
+}
+
+func (s *session) Interrupt() error {
+	if s.cmd.Process == nil {
+		return os.ErrInvalid
+	}
+	return s.cmd.Process.Signal(syscall.SIGINT)
+}
+
+// Kill kills the command and the processes it started.
+func (s *session) Kill() error {
+	if s.cmd.Process == nil {
+		return os.ErrInvalid
+	}
+	return syscall.Kill(-s.cmd.Process.Pid, syscall.SIGKILL)
+}
+
+func exitCode(err error) (int, error) {
+	if err == nil {
+		return 0, nil
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return exitErr.ExitCode(), nil
+	}
+	return -1, err
+}
+
+func (p *chrootProvider) StartCommand(cmd []string, opts capytest.CommandOptions) (capytest.NotInteractiveSession, error) {
+	c, status, err := p.command(cmd, opts)
+	if err != nil {
+		return nil, err
+	}
+	stdin, err := c.StdinPipe()
+	if err != nil {
+		status.started(err)
+		return nil, err
+	}
+	stdout, err := c.StdoutPipe()
+	if err != nil {
+		status.started(err)
+		return nil, err
+	}
+	stderr, err := c.StderrPipe()
+	if err != nil {
+		status.started(err)
+		return nil, err
+	}
+	// A process group of its own lets Kill reach the children too.
+	c.SysProcAttr.Setpgid = true
+
+	sess := &session{
+		cmd:     c,
+		stdin:   stdin,
+		stdout:  stdout,
+		stderr:  stderr,
+		stdoutC: make(chan string),
+		stderrC: make(chan string),
+		done:    make(chan error, 1),
+	}
+
+	err = c.Start()
+	status.started(err)
+	if err != nil {
+		return nil, err
+	}
+
+	// Reading must finish before Wait closes the pipes.
+	var readers sync.WaitGroup
+	readers.Add(2)
+	go readPipe(sess.stdout, sess.stdoutC, &readers)
+	go readPipe(sess.stderr, sess.stderrC, &readers)
+	go func() {
+		readers.Wait()
+		err := status.result(c.Wait())
+		close(sess.stdoutC)
+		close(sess.stderrC)
+		sess.done <- err
+	}()
+
+	return sess, nil
+}
+
+type interactiveSession struct {
+	cmd    *exec.Cmd
+	pty    *os.File
+	output chan string
+	done   chan error
+}
+
+func (s *interactiveSession) Write(input []byte) error {
+	_, err := s.pty.Write(input)
+	return err
+}
+
+func (s *interactiveSession) Output() <-chan string {
+	return s.output
+}
+
+func (s *interactiveSession) Wait() (int, error) {
+	return exitCode(<-s.done)
+}
+
+func (s *interactiveSession) Interrupt() error {
+	if s.cmd.Process == nil {
+		return os.ErrInvalid
+	}
+	return s.cmd.Process.Signal(syscall.SIGINT)
+}
+
+func (s *interactiveSession) Resize(rows, cols uint16) error {
+	return pty.Setsize(s.pty, &pty.Winsize{Rows: rows, Cols: cols})
+}
+
+func (p *chrootProvider) StartInteractiveCommand(cmd []string, opts capytest.CommandOptions) (capytest.InteractiveSession, error) {
+	c, status, err := p.command(cmd, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	ptmx, err := pty.Start(c)
+	status.started(err)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start interactive command: %w", err)
+	}
+
+	sess := &interactiveSession{
+		cmd:    c,
+		pty:    ptmx,
+		output: make(chan string),
+		done:   make(chan error, 1),
+	}
+
+	go func() {
+		defer close(sess.output)
+		buf := make([]byte, 1024)
+		for {
+			n, err := sess.pty.Read(buf)
+			if n > 0 {
+				sess.output <- string(buf[:n])
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	go func() {
+		sess.done <- status.result(c.Wait())
+	}()
+
+	return sess, nil
+}
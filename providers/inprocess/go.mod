@@ -0,0 +1,3 @@
+module go.alt-gnome.ru/capytest/providers/inprocess
+
+go 1.24.4
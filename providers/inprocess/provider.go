@@ -0,0 +1,298 @@
+package inprocess
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"runtime/debug"
+	"sync"
+
+	"go.alt-gnome.ru/capytest"
+)
+
+// MainFunc is the entry point of a program run in-process. args does not
+// include the program name; the return value is the exit code.
+//
+// With Cobra this is typically:
+//
+//	func(args []string, stdin io.Reader, stdout, stderr io.Writer, env []string) int {
+//		cmd := newRootCmd()
+//		cmd.SetArgs(args)
+//		cmd.SetIn(stdin)
+//		cmd.SetOut(stdout)
+//		cmd.SetErr(stderr)
+//		if err := cmd.Execute(); err != nil {
+//			return 1
+//		}
+//		return 0
+//	}
+type MainFunc func(args []string, stdin io.Reader, stdout, stderr io.Writer, env []string) int
+
+// ErrInterrupted is returned by the read from stdin that is pending when
+// the session is interrupted, or by the next one. Later reads get the input
+// sent after the interrupt, like a shell reading the next command after ^C.
+var ErrInterrupted = errors.New("interrupted")
+
+type InprocessOption func(*inprocessProvider)
+
+// WithProgram registers main under the given command name.
+func WithProgram(name string, main MainFunc) InprocessOption {
+	return func(p *inprocessProvider) {
+		p.programs[name] = main
+	}
+}
+
+type inprocessProvider struct {
+	mu       sync.RWMutex
+	programs map[string]MainFunc
+}
+
+// Provider runs registered Go functions in the test process instead of
+// spawning binaries. The functions share the process with the tests, so
+// they must not call os.Exit or rely on global state between runs.
+func Provider(opts ...InprocessOption) *inprocessProvider {
+	p := &inprocessProvider{
+		programs: map[string]MainFunc{},
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p
+}
+
+// Register adds or replaces a program.
+func (p *inprocessProvider) Register(name string, main MainFunc) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.programs[name] = main
+}
+
+func (p *inprocessProvider) program(name string) (MainFunc, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	main, ok := p.programs[name]
+	if !ok {
+		return nil, fmt.Errorf("program %q is not registered", name)
+	}
+	return main, nil
+}
+
+// Interrupted returns a channel that receives a value when the session the
+// stdin belongs to is interrupted, letting programs emulate SIGINT handling
+// like with signal.Notify. Interrupts that arrive before the previous one
+// was received are merged. It returns nil for readers not created by the
+// provider.
+func Interrupted(stdin io.Reader) <-chan struct{} {
+	if in, ok := stdin.(*input); ok {
+		return in.interrupted
+	}
+	return nil
+}
+
+// IsTerminal reports whether w is the output of an interactive session,
+// the in-process counterpart of checking os.Stdout for a terminal.
+func IsTerminal(w io.Writer) bool {
+	_, ok := w.(*ttyWriter)
+	return ok
+}
+
+// run calls main, turning a panic into exit code 2 with the panic and stack
+// on stderr, like the Go runtime does.
+func run(main MainFunc, args []string, stdin io.Reader, stdout, stderr io.Writer, env []string) (code int) {
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Fprintf(stderr, "panic: %v\n\n%s", r, debug.Stack())
+			code = 2
+		}
+	}()
+	return main(args, stdin, stdout, stderr, env)
+}
+
+func environ(opts capytest.CommandOptions) []string {
+	return append(os.Environ(), opts.Env...)
+}
+
+// input is the stdin of a session. Writes are buffered like in a pipe, so
+// that they never wait for the program to read. An interrupt discards the
+// buffered input and fails one read with ErrInterrupted.
+type input struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	buf  []byte
+	err  error
+
+	// pending is set by an interrupt until a read returns ErrInterrupted.
+	pending     bool
+	interrupted chan struct{}
+}
+
+func newInput() *input {
+	in := &input{interrupted: make(chan struct{}, 1)}
+	in.cond = sync.NewCond(&in.mu)
+	return in
+}
+
+func (in *input) Read(p []byte) (int, error) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	for len(in.buf) == 0 && in.err == nil && !in.pending {
+		in.cond.Wait()
+	}
+	if in.pending {
+		in.pending = false
+		return 0, ErrInterrupted
+	}
+	if len(in.buf) == 0 {
+		return 0, in.err
+	}
+	n := copy(p, in.buf)
+	in.buf = in.buf[n:]
+	return n, nil
+}
+
+func (in *input) write(p []byte) error {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	if in.err != nil {
+		return io.ErrClosedPipe
+	}
+	in.buf = append(in.buf, p...)
+	in.cond.Broadcast()
+	return nil
+}
+
+// closeWithError makes reads fail with err once the buffer is drained.
+func (in *input) closeWithError(err error) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	if in.err == nil {
+		in.err = err
+		in.cond.Broadcast()
+	}
+}
+
+func (in *input) interrupt() {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	if in.err != nil {
+		return
+	}
+	select {
+	case in.interrupted <- struct{}{}:
+	default:
+	}
+	in.buf = nil
+	in.pending = true
+	in.cond.Broadcast()
+}
+
+// chanWriter sends every write to a channel.
+type chanWriter struct {
+	ch chan string
+}
+
+func (w *chanWriter) Write(p []byte) (int, error) {
+	w.ch <- string(p)
+	return len(p), nil
+}
+
+type session struct {
+	stdin *input
+
+	stdoutC chan string
+	stderrC chan string
+	done    chan int
+}
+
+func (p *inprocessProvider) StartCommand(cmd []string, opts capytest.CommandOptions) (capytest.NotInteractiveSession, error) {
+	main, err := p.program(cmd[0])
+	if err != nil {
+		return nil, err
+	}
+
+	sess := &session{
+		stdin:   newInput(),
+		stdoutC: make(chan string),
+		stderrC: make(chan string),
+		done:    make(chan int, 1),
+	}
+
+	go func() {
+		code := run(main, cmd[1:], sess.stdin, &chanWriter{sess.stdoutC}, &chanWriter{sess.stderrC}, environ(opts))
+		sess.stdin.closeWithError(io.EOF)
+		close(sess.stdoutC)
+		close(sess.stderrC)
+		sess.done <- code
+	}()
+
+	return sess, nil
+}
+
+func (s *session) Write(input string) error {
+	return s.stdin.write([]byte(input))
+}
+
+func (s *session) CloseStdin() error {
+	s.stdin.closeWithError(io.EOF)
+	return nil
+}
+
+func (s *session) Stdout() <-chan string {
+	return s.stdoutC
+}
+
+func (s *session) Stderr() <-chan string {
+	return s.stderrC
+}
+
+func (s *session) Wait() (int, error) {
+	return <-s.done, nil
+}
+
+func (s *session) Interrupt() error {
+	s.stdin.interrupt()
+	return nil
+}
+
+func (p *inprocessProvider) StartInteractiveCommand(cmd []string, opts capytest.CommandOptions) (capytest.InteractiveSession, error) {
+	main, err := p.program(cmd[0])
+	if err != nil {
+		return nil, err
+	}
+
+	sess := &interactiveSession{
+		tty:  newTTY(),
+		done: make(chan int, 1),
+	}
+
+	go func() {
+		out := &ttyWriter{sess.tty}
+		code := run(main, cmd[1:], sess.tty.stdin, out, out, environ(opts))
+		sess.tty.close()
+		sess.done <- code
+	}()
+
+	return sess, nil
+}
+
+type interactiveSession struct {
+	tty  *tty
+	done chan int
+}
+
+func (s *interactiveSession) Write(input []byte) error {
+	return s.tty.input(input)
+}
+
+func (s *interactiveSession) Output() <-chan string {
+	return s.tty.output
+}
+
+func (s *interactiveSession) Wait() (int, error) {
+	return <-s.done, nil
+}
+
+func (s *interactiveSession) Interrupt() error {
+	return s.tty.input([]byte{3})
+}
@@ -0,0 +1,99 @@
+package inprocess
+
+import (
+	"io"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// tty emulates the parts of a terminal in canonical mode that tests of
+// line-oriented programs observe: input is echoed and handed to the program
+// line by line, backspace edits the pending line, ^C interrupts, ^D ends
+// the input and output newlines become "\r\n".
+type tty struct {
+	stdin  *input
+	output chan string
+
+	lineMu sync.Mutex
+	line   []byte
+
+	mu     sync.Mutex
+	closed bool
+}
+
+func newTTY() *tty {
+	return &tty{
+		stdin:  newInput(),
+		output: make(chan string),
+	}
+}
+
+func (t *tty) input(data []byte) error {
+	t.lineMu.Lock()
+	defer t.lineMu.Unlock()
+	for _, b := range data {
+		var err error
+		switch b {
+		case 3: // ^C
+			t.line = nil
+			t.write("^C\r\n")
+			t.stdin.interrupt()
+		case 4: // ^D
+			if len(t.line) == 0 {
+				t.stdin.closeWithError(io.EOF)
+			} else {
+				err = t.flush()
+			}
+		case '\r', '\n':
+			t.line = append(t.line, '\n')
+			t.write("\r\n")
+			err = t.flush()
+		case 0x7f, '\b':
+			if len(t.line) > 0 {
+				_, size := utf8.DecodeLastRune(t.line)
+				t.line = t.line[:len(t.line)-size]
+				t.write("\b \b")
+			}
+		default:
+			t.line = append(t.line, b)
+			t.write(string([]byte{b}))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *tty) flush() error {
+	line := t.line
+	t.line = nil
+	return t.stdin.write(line)
+}
+
+func (t *tty) write(s string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.closed {
+		t.output <- s
+	}
+}
+
+func (t *tty) close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.closed = true
+	t.stdin.closeWithError(io.EOF)
+	close(t.output)
+}
+
+// ttyWriter is the program side of the terminal.
+type ttyWriter struct {
+	tty *tty
+}
+
+func (w *ttyWriter) Write(p []byte) (int, error) {
+	w.tty.write(strings.ReplaceAll(string(p), "\n", "\r\n"))
+	return len(p), nil
+}
@@ -0,0 +1,11 @@
+//go:build !unix
+
+package local
+
+import "os/exec"
+
+func newProcessGroup(c *exec.Cmd) {}
+
+func killProcessGroup(c *exec.Cmd) error {
+	return c.Process.Kill()
+}
@@ -5,6 +5,7 @@ import (
 	"io"
 	"os"
 	"os/exec"
+	"sync"
 	"syscall"
 
 	"github.com/creack/pty"
@@ -28,7 +29,8 @@ type session struct {
 	done    chan error
 }
 
-func (s *session) readPipe(r io.Reader, ch chan string) {
+func (s *session) readPipe(r io.Reader, ch chan string, wg *sync.WaitGroup) {
+	defer wg.Done()
 	buf := make([]byte, 1024)
 	for {
 		n, err := r.Read(buf)
@@ -49,6 +51,10 @@ func (s *session) Write(input string) error {
 	return err
 }
 
+func (s *session) CloseStdin() error {
+	return s.stdin.Close()
+}
+
 func (s *session) Stdout() <-chan string {
 	return s.stdoutC
 }
@@ -80,6 +86,7 @@ func (p *localProvider) StartCommand(cmd []string, opts capytest.CommandOptions)
 	if len(opts.Env) > 0 {
 		c.Env = append(os.Environ(), opts.Env...)
 	}
+	newProcessGroup(c)
 	stdin, err := c.StdinPipe()
 	if err != nil {
 		return nil, err
@@ -107,12 +114,17 @@ func (p *localProvider) StartCommand(cmd []string, opts capytest.CommandOptions)
 		return nil, err
 	}
 
-	go sess.readPipe(sess.stdout, sess.stdoutC)
-	go sess.readPipe(sess.stderr, sess.stderrC)
+	// Reading must finish before Wait closes the pipes.
+	var readers sync.WaitGroup
+	readers.Add(2)
+	go sess.readPipe(sess.stdout, sess.stdoutC, &readers)
+	go sess.readPipe(sess.stderr, sess.stderrC, &readers)
 	go func() {
-		sess.done <- c.Wait()
+		readers.Wait()
+		err := c.Wait()
 		close(sess.stdoutC)
 		close(sess.stderrC)
+		sess.done <- err
 	}()
 
 	return sess, nil
@@ -153,6 +165,10 @@ func (s *interactiveSession) Interrupt() error {
 	return s.cmd.Process.Signal(syscall.SIGINT)
 }
 
+func (s *interactiveSession) Resize(rows, cols uint16) error {
+	return pty.Setsize(s.pty, &pty.Winsize{Rows: rows, Cols: cols})
+}
+
 func (p *localProvider) StartInteractiveCommand(cmd []string, opts capytest.CommandOptions) (capytest.InteractiveSession, error) {
 	c := exec.Command(cmd[0], cmd[1:]...)
 	if len(opts.Env) > 0 {
@@ -191,3 +207,11 @@ func (p *localProvider) StartInteractiveCommand(cmd []string, opts capytest.Comm
 
 	return sess, nil
 }
+
+// Kill kills the command and the processes it started.
+func (s *session) Kill() error {
+	if s.cmd.Process == nil {
+		return os.ErrInvalid
+	}
+	return killProcessGroup(s.cmd)
+}
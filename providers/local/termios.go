@@ -0,0 +1,15 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd
+
+package local
+
+import "golang.org/x/sys/unix"
+
+// Echo reads the ECHO flag of the terminal. The termios of the pty master
+// are the ones of the terminal the command sees.
+func (s *interactiveSession) Echo() (bool, error) {
+	termios, err := unix.IoctlGetTermios(int(s.pty.Fd()), ioctlGetTermios)
+	if err != nil {
+		return false, err
+	}
+	return termios.Lflag&unix.ECHO != 0, nil
+}
@@ -0,0 +1,3 @@
+module go.alt-gnome.ru/capytest/providers/nspawn
+
+go 1.24.4
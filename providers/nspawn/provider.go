@@ -0,0 +1,320 @@
+package nspawn
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"go.alt-gnome.ru/capytest"
+	"go.alt-gnome.ru/capytest/providers/local"
+)
+
+var DefaultNspawnCli string = "systemd-nspawn"
+var DefaultSystemdRunCli string = "systemd-run"
+var DefaultSystemctlCli string = "systemctl"
+var DefaultMachinectlCli string = "machinectl"
+
+var DefaultBootTimeout time.Duration = 90 * time.Second
+
+type NspawnOption func(*nspawnProvider)
+
+// WithMachineName sets the machine name. Defaults to a random
+// "capytest-..." name.
+func WithMachineName(name string) NspawnOption {
+	return func(p *nspawnProvider) {
+		p.machine = name
+	}
+}
+
+// WithEphemeral boots a throwaway snapshot of the directory, keeping the
+// directory itself untouched.
+func WithEphemeral(ephemeral bool) NspawnOption {
+	return func(p *nspawnProvider) {
+		p.ephemeral = ephemeral
+	}
+}
+
+// WithNspawnArgs passes extra arguments to systemd-nspawn, e.g. "--bind=...".
+func WithNspawnArgs(args ...string) NspawnOption {
+	return func(p *nspawnProvider) {
+		p.args = append(p.args, args...)
+	}
+}
+
+func WithBootTimeout(timeout time.Duration) NspawnOption {
+	return func(p *nspawnProvider) {
+		p.bootTimeout = timeout
+	}
+}
+
+// WithMachinectlShell runs interactive commands with `machinectl shell`
+// instead of `systemd-run --pty`, which gives a full login session.
+// Commands must then be given by absolute path.
+func WithMachinectlShell() NspawnOption {
+	return func(p *nspawnProvider) {
+		p.machinectlShell = true
+	}
+}
+
+type nspawnProvider struct {
+	directory       string
+	machine         string
+	ephemeral       bool
+	args            []string
+	bootTimeout     time.Duration
+	machinectlShell bool
+
+	local    capytest.Provider
+	nspawn   *exec.Cmd
+	console  *bytes.Buffer
+	exited   chan struct{}
+	units    atomic.Int64
+	prepared bool
+}
+
+// Provider boots the container directory with systemd as init and runs
+// commands in it as transient units, so that service management can be
+// tested end-to-end.
+func Provider(directory string, opts ...NspawnOption) *nspawnProvider {
+	p := &nspawnProvider{
+		directory:   directory,
+		bootTimeout: DefaultBootTimeout,
+		local:       local.Provider(),
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	if p.machine == "" {
+		suffix := make([]byte, 4)
+		rand.Read(suffix)
+		p.machine = "capytest-" + hex.EncodeToString(suffix)
+	}
+	return p
+}
+
+// Machine returns the machine name, e.g. for `machinectl` calls in tests.
+func (p *nspawnProvider) Machine() string {
+	return p.machine
+}
+
+// Prepare boots the container and waits until systemd reports the system as
+// running (or degraded).
+func (p *nspawnProvider) Prepare() error {
+	if p.prepared {
+		return nil
+	}
+
+	args := []string{
+		"--boot", "--quiet", "--console=passive",
+		"--directory=" + p.directory,
+		"--machine=" + p.machine,
+	}
+	if p.ephemeral {
+		args = append(args, "--ephemeral")
+	}
+	args = append(args, p.args...)
+
+	p.console = &bytes.Buffer{}
+	p.nspawn = exec.Command(DefaultNspawnCli, args...)
+	p.nspawn.Stdout = p.console
+	p.nspawn.Stderr = p.console
+	if err := p.nspawn.Start(); err != nil {
+		return fmt.Errorf("failed to start %s: %w", DefaultNspawnCli, err)
+	}
+	p.exited = make(chan struct{})
+	go func() {
+		p.nspawn.Wait()
+		close(p.exited)
+	}()
+
+	if err := p.waitForBoot(); err != nil {
+		p.stop()
+		return err
+	}
+
+	p.prepared = true
+	return nil
+}
+
+func (p *nspawnProvider) waitForBoot() error {
+	deadline := time.After(p.bootTimeout)
+	state := "unknown"
+	for {
+		select {
+		case <-p.exited:
+			return fmt.Errorf("container %s exited during boot: %s\n%s", p.machine, p.nspawn.ProcessState, p.console)
+		case <-deadline:
+			return fmt.Errorf("container %s did not boot within %s (system state: %s)", p.machine, p.bootTimeout, state)
+		case <-time.After(200 * time.Millisecond):
+		}
+
+		// Fails until the machine is registered; afterwards it reports
+		// "initializing" and "starting" until the boot is finished.
+		output, _ := exec.Command(DefaultSystemctlCli, "--machine="+p.machine, "is-system-running").Output()
+		state = strings.TrimSpace(string(output))
+		if state == "running" || state == "degraded" {
+			return nil
+		}
+	}
+}
+
+// Cleanup powers the container off, terminating it when it does not shut
+// down in time.
+func (p *nspawnProvider) Cleanup() error {
+	if !p.prepared {
+		return nil
+	}
+
+	err := p.stop()
+	p.nspawn = nil
+	p.prepared = false
+	return err
+}
+
+func (p *nspawnProvider) stop() error {
+	exec.Command(DefaultMachinectlCli, "poweroff", p.machine).Run()
+	select {
+	case <-p.exited:
+		return nil
+	case <-time.After(30 * time.Second):
+	}
+
+	exec.Command(DefaultMachinectlCli, "terminate", p.machine).Run()
+	select {
+	case <-p.exited:
+		return nil
+	case <-time.After(10 * time.Second):
+	}
+
+	p.nspawn.Process.Kill()
+	<-p.exited
+	return fmt.Errorf("container %s did not shut down and was killed", p.machine)
+}
+
+// unit returns a unique name for the transient unit of a command, used to
+// deliver signals to it.
+func (p *nspawnProvider) unit() string {
+	return fmt.Sprintf("%s-%d", p.machine, p.units.Add(1))
+}
+
+func (p *nspawnProvider) kill(unit string, signal string) error {
+	output, err := exec.Command(DefaultSystemctlCli, "--machine="+p.machine, "kill", "--signal="+signal, unit+".service").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to signal %s: %w: %s", unit, err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+func (p *nspawnProvider) systemdRun(unit string, pty bool, cmd []string, opts capytest.CommandOptions) []string {
+	args := []string{
+		DefaultSystemdRunCli,
+		"--machine=" + p.machine,
+		"--unit=" + unit,
+		"--quiet", "--wait", "--collect",
+		"--service-type=exec",
+	}
+	if pty {
+		args = append(args, "--pty")
+	} else {
+		args = append(args, "--pipe")
+	}
+	for _, e := range opts.Env {
+		args = append(args, "--setenv="+e)
+	}
+	args = append(args, "--")
+	return append(args, cmd...)
+}
+
+func (p *nspawnProvider) StartCommand(cmd []string, opts capytest.CommandOptions) (capytest.NotInteractiveSession, error) {
+	if !p.prepared {
+		if err := p.Prepare(); err != nil {
+			return nil, fmt.Errorf("failed to prepare container: %w", err)
+		}
+	}
+
+	unit := p.unit()
+	sess, err := p.local.StartCommand(p.systemdRun(unit, false, cmd, opts), capytest.CommandOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return &session{NotInteractiveSession: sess, p: p, unit: unit}, nil
+}
+
+func (p *nspawnProvider) StartInteractiveCommand(cmd []string, opts capytest.CommandOptions) (capytest.InteractiveSession, error) {
+	if !p.prepared {
+		if err := p.Prepare(); err != nil {
+			return nil, fmt.Errorf("failed to prepare container: %w", err)
+		}
+	}
+
+	var unit string
+	var argv []string
+	if p.machinectlShell {
+		argv = []string{DefaultMachinectlCli, "shell", "--quiet"}
+		for _, e := range opts.Env {
+			argv = append(argv, "--setenv="+e)
+		}
+		argv = append(argv, "root@"+p.machine)
+		argv = append(argv, cmd...)
+	} else {
+		unit = p.unit()
+		argv = p.systemdRun(unit, true, cmd, opts)
+	}
+
+	sess, err := p.local.StartInteractiveCommand(argv, capytest.CommandOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return &interactiveSession{InteractiveSession: sess, p: p, unit: unit}, nil
+}
+
+// session runs on top of a local systemd-run process; signals go to the
+// unit inside the container rather than to systemd-run.
+type session struct {
+	capytest.NotInteractiveSession
+	p    *nspawnProvider
+	unit string
+}
+
+func (s *session) Interrupt() error {
+	return s.p.kill(s.unit, "SIGINT")
+}
+
+// Kill kills every process of the unit of the command.
+func (s *session) Kill() error {
+	return s.p.kill(s.unit, "SIGKILL")
+}
+
+func (s *session) CloseStdin() error {
+	if c, ok := s.NotInteractiveSession.(capytest.StdinCloser); ok {
+		return c.CloseStdin()
+	}
+	return fmt.Errorf("closing stdin is not supported")
+}
+
+type interactiveSession struct {
+	capytest.InteractiveSession
+	p    *nspawnProvider
+	unit string
+}
+
+// Interrupt signals the unit; `machinectl shell` sessions have no known unit
+// and get ^C through the terminal instead.
+func (s *interactiveSession) Interrupt() error {
+	if s.unit == "" {
+		return s.InteractiveSession.Write([]byte{3})
+	}
+	return s.p.kill(s.unit, "SIGINT")
+}
+
+func (s *interactiveSession) Resize(rows, cols uint16) error {
+	if r, ok := s.InteractiveSession.(capytest.ResizableSession); ok {
+		return r.Resize(rows, cols)
+	}
+	return fmt.Errorf("resize is not supported")
+}
@@ -0,0 +1,644 @@
+package podman
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"go.alt-gnome.ru/capytest"
+)
+
+// DefaultAPIVersion is the libpod REST API version used in request paths.
+var DefaultAPIVersion string = "v4.0.0"
+
+// DefaultExitTimeout is how long Wait polls libpod for the exit code of a
+// command after its output has ended. A command that closes its output but
+// keeps running fails the wait once it passes.
+var DefaultExitTimeout = 10 * time.Second
+
+// DefaultSocketPath returns the libpod socket served by `podman system
+// service`: $CONTAINER_HOST when it points to a unix socket, the system
+// socket for root and the per-user socket otherwise.
+func DefaultSocketPath() string {
+	if host := os.Getenv("CONTAINER_HOST"); strings.HasPrefix(host, "unix://") {
+		return strings.TrimPrefix(host, "unix://")
+	}
+	if os.Getuid() == 0 {
+		return "/run/podman/podman.sock"
+	}
+	runtimeDir := os.Getenv("XDG_RUNTIME_DIR")
+	if runtimeDir == "" {
+		runtimeDir = filepath.Join("/run/user", strconv.Itoa(os.Getuid()))
+	}
+	return filepath.Join(runtimeDir, "podman", "podman.sock")
+}
+
+// apiClient talks to the libpod REST API over a unix socket.
+type apiClient struct {
+	socket string
+	client *http.Client
+}
+
+func newAPIClient(socket string) *apiClient {
+	if socket == "" {
+		socket = DefaultSocketPath()
+	}
+	c := &apiClient{socket: socket}
+	c.client = &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", c.socket)
+			},
+		},
+	}
+	return c
+}
+
+// apiError is the error body returned by libpod.
+type apiError struct {
+	Cause    string `json:"cause"`
+	Message  string `json:"message"`
+	Response int    `json:"response"`
+}
+
+func (c *apiClient) newRequest(method, path string, query url.Values, body any) (*http.Request, error) {
+	u := "http://d/" + DefaultAPIVersion + "/libpod" + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	var r io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		r = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, u, r)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return req, nil
+}
+
+// do performs a request and decodes the JSON response into out. Any status
+// code not listed in ok is turned into an error carrying libpod's message.
+func (c *apiClient) do(method, path string, query url.Values, body, out any, ok ...int) (int, error) {
+	req, err := c.newRequest(method, path, query, body)
+	if err != nil {
+		return 0, err
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("podman API %s %s: %w", method, path, err)
+	}
+	defer resp.Body.Close()
+
+	for _, code := range ok {
+		if resp.StatusCode != code {
+			continue
+		}
+		if out != nil {
+			if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+				return resp.StatusCode, fmt.Errorf("podman API %s %s: failed to decode response: %w", method, path, err)
+			}
+		}
+		return resp.StatusCode, nil
+	}
+
+	return resp.StatusCode, responseError(method, path, resp)
+}
+
+func responseError(method, path string, resp *http.Response) error {
+	data, _ := io.ReadAll(resp.Body)
+	var e apiError
+	if json.Unmarshal(data, &e) == nil && e.Message != "" {
+		return fmt.Errorf("podman API %s %s: %s (status %d)", method, path, e.Message, resp.StatusCode)
+	}
+	return fmt.Errorf("podman API %s %s: unexpected status %d: %s", method, path, resp.StatusCode, strings.TrimSpace(string(data)))
+}
+
+func (c *apiClient) imageExists(image string) (bool, error) {
+	code, err := c.do(http.MethodGet, "/images/"+url.PathEscape(image)+"/exists", nil, nil, nil, http.StatusNoContent, http.StatusNotFound)
+	if err != nil {
+		return false, err
+	}
+	return code == http.StatusNoContent, nil
+}
+
+func (c *apiClient) pullImage(image string) error {
+	req, err := c.newRequest(http.MethodPost, "/images/pull", url.Values{"reference": {image}}, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to pull image %s: %w", image, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return responseError(http.MethodPost, "/images/pull", resp)
+	}
+
+	// The pull progress is streamed as a sequence of JSON objects; a
+	// failure is reported in-band through the "error" field.
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var report struct {
+			Error string `json:"error"`
+		}
+		if err := dec.Decode(&report); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("failed to pull image %s: %w", image, err)
+		}
+		if report.Error != "" {
+			return fmt.Errorf("failed to pull image %s: %s", image, report.Error)
+		}
+	}
+}
+
+type specMount struct {
+	Destination string   `json:"destination"`
+	Source      string   `json:"source"`
+	Type        string   `json:"type"`
+	Options     []string `json:"options,omitempty"`
+}
+
+type specVolume struct {
+	Name    string   `json:"Name"`
+	Dest    string   `json:"Dest"`
+	Options []string `json:"Options,omitempty"`
+}
+
+type specNamespace struct {
+	NSMode string `json:"nsmode"`
+}
+
+// containerSpec is the subset of the libpod SpecGenerator used by the
+// provider.
+type containerSpec struct {
+	Image      string              `json:"image"`
+	Command    []string            `json:"command"`
+	WorkDir    string              `json:"work_dir,omitempty"`
+	Env        map[string]string   `json:"env,omitempty"`
+	Mounts     []specMount         `json:"mounts,omitempty"`
+	Volumes    []specVolume        `json:"volumes,omitempty"`
+	NetNS      *specNamespace      `json:"netns,omitempty"`
+	Networks   map[string]struct{} `json:"Networks,omitempty"`
+	Privileged bool                `json:"privileged,omitempty"`
+	Init       bool                `json:"init"`
+}
+
+func (p *podmanProvider) containerSpec() containerSpec {
+	spec := containerSpec{
+		Image:      p.image,
+		Command:    []string{"sleep", "infinity"},
+		WorkDir:    p.workdir,
+		Privileged: p.privileged,
+		Init:       true,
+	}
+
+	for _, env := range p.envVars {
+		if spec.Env == nil {
+			spec.Env = map[string]string{}
+		}
+		key, value, _ := strings.Cut(env, "=")
+		spec.Env[key] = value
+	}
+
+	// Volumes use the CLI syntax "src:dst[:opts]"; an absolute source is a
+	// bind mount, anything else is a named volume.
+	for _, volume := range p.volumes {
+		parts := strings.SplitN(volume, ":", 3)
+		src, dst := parts[0], parts[0]
+		if len(parts) > 1 {
+			dst = parts[1]
+		}
+		var opts []string
+		if len(parts) > 2 {
+			opts = strings.Split(parts[2], ",")
+		}
+		if strings.HasPrefix(src, "/") {
+			spec.Mounts = append(spec.Mounts, specMount{Destination: dst, Source: src, Type: "bind", Options: opts})
+		} else {
+			spec.Volumes = append(spec.Volumes, specVolume{Name: src, Dest: dst, Options: opts})
+		}
+	}
+
+	switch p.network {
+	case "":
+	case "host", "none", "private", "bridge", "slirp4netns", "pasta":
+		spec.NetNS = &specNamespace{NSMode: p.network}
+	default:
+		spec.NetNS = &specNamespace{NSMode: "bridge"}
+		spec.Networks = map[string]struct{}{p.network: {}}
+	}
+
+	return spec
+}
+
+func (c *apiClient) createContainer(spec containerSpec) (string, error) {
+	var resp struct {
+		ID string `json:"Id"`
+	}
+	if _, err := c.do(http.MethodPost, "/containers/create", nil, spec, &resp, http.StatusCreated); err != nil {
+		return "", fmt.Errorf("failed to create container: %w", err)
+	}
+	return resp.ID, nil
+}
+
+func (c *apiClient) startContainer(id string) error {
+	_, err := c.do(http.MethodPost, "/containers/"+id+"/start", nil, nil, nil, http.StatusNoContent, http.StatusNotModified)
+	return err
+}
+
+func (c *apiClient) isContainerRunning(id string) (bool, error) {
+	var resp struct {
+		State struct {
+			Running bool `json:"Running"`
+		} `json:"State"`
+	}
+	if _, err := c.do(http.MethodGet, "/containers/"+id+"/json", nil, nil, &resp, http.StatusOK); err != nil {
+		return false, err
+	}
+	return resp.State.Running, nil
+}
+
+func (c *apiClient) stopContainer(id string) error {
+	_, err := c.do(http.MethodPost, "/containers/"+id+"/stop", nil, nil, nil, http.StatusNoContent, http.StatusNotModified)
+	return err
+}
+
+func (c *apiClient) removeContainer(id string) error {
+	_, err := c.do(http.MethodDelete, "/containers/"+id, url.Values{"force": {"true"}}, nil, nil, http.StatusOK, http.StatusNoContent)
+	return err
+}
+
+type execConfig struct {
+	AttachStdin  bool     `json:"AttachStdin"`
+	AttachStdout bool     `json:"AttachStdout"`
+	AttachStderr bool     `json:"AttachStderr"`
+	Tty          bool     `json:"Tty"`
+	Cmd          []string `json:"Cmd"`
+	Env          []string `json:"Env,omitempty"`
+}
+
+type execState struct {
+	Running  bool `json:"Running"`
+	ExitCode int  `json:"ExitCode"`
+	Pid      int  `json:"Pid"`
+}
+
+func (c *apiClient) createExec(containerID string, cfg execConfig) (string, error) {
+	var resp struct {
+		ID string `json:"Id"`
+	}
+	if _, err := c.do(http.MethodPost, "/containers/"+containerID+"/exec", nil, cfg, &resp, http.StatusCreated); err != nil {
+		return "", err
+	}
+	return resp.ID, nil
+}
+
+// startExec starts an exec session and hijacks the connection: once the
+// server switches protocols, the returned conn carries stdin and the
+// reader carries the (possibly multiplexed) output.
+func (c *apiClient) startExec(id string, tty bool) (net.Conn, *bufio.Reader, error) {
+	path := "/exec/" + id + "/start"
+	body := map[string]any{"Detach": false, "Tty": tty}
+	if tty {
+		body["h"] = capytest.DefaultTerminalSize.Rows
+		body["w"] = capytest.DefaultTerminalSize.Cols
+	}
+	req, err := c.newRequest(http.MethodPost, path, nil, body)
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "tcp")
+
+	conn, err := net.Dial("unix", c.socket)
+	if err != nil {
+		return nil, nil, fmt.Errorf("podman API %s %s: %w", req.Method, path, err)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("podman API %s %s: %w", req.Method, path, err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols && resp.StatusCode != http.StatusOK {
+		defer conn.Close()
+		return nil, nil, responseError(req.Method, path, resp)
+	}
+
+	return conn, br, nil
+}
+
+func (c *apiClient) resizeExec(id string, rows, cols uint16) error {
+	query := url.Values{
+		"h": {strconv.Itoa(int(rows))},
+		"w": {strconv.Itoa(int(cols))},
+	}
+	_, err := c.do(http.MethodPost, "/exec/"+id+"/resize", query, nil, nil, http.StatusOK, http.StatusCreated)
+	return err
+}
+
+func (c *apiClient) inspectExec(id string) (execState, error) {
+	var state execState
+	_, err := c.do(http.MethodGet, "/exec/"+id+"/json", nil, nil, &state, http.StatusOK)
+	return state, err
+}
+
+// exitCode waits up to DefaultExitTimeout for the exec session to stop
+// running and maps the podman-specific codes the same way the CLI backend
+// does.
+func (c *apiClient) exitCode(id string) (int, error) {
+	deadline := time.Now().Add(DefaultExitTimeout)
+	for {
+		state, err := c.inspectExec(id)
+		if err != nil {
+			return -1, err
+		}
+		if !state.Running {
+			switch state.ExitCode {
+			case 125:
+				return -1, fmt.Errorf("podman exec internal error: exit code %d", state.ExitCode)
+			case 126:
+				return -1, fmt.Errorf("cannot invoke command in container: exit code %d", state.ExitCode)
+			case 127:
+				return -1, fmt.Errorf("command not found in container: exit code %d", state.ExitCode)
+			default:
+				return state.ExitCode, nil
+			}
+		}
+		if time.Now().After(deadline) {
+			return -1, fmt.Errorf("exec session %s is still running %v after its output ended", id, DefaultExitTimeout)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// interrupt delivers SIGINT to the exec'd process. The PID reported by
+// libpod is the host PID, so this only works with a local service.
+func (c *apiClient) interrupt(id string) error {
+	return c.signal(id, syscall.SIGINT)
+}
+
+func (c *apiClient) signal(id string, sig syscall.Signal) error {
+	state, err := c.inspectExec(id)
+	if err != nil {
+		return err
+	}
+	if !state.Running || state.Pid == 0 {
+		return os.ErrProcessDone
+	}
+	return syscall.Kill(state.Pid, sig)
+}
+
+func (p *podmanProvider) apiExec(cmd []string, opts capytest.CommandOptions, tty bool) (string, net.Conn, *bufio.Reader, error) {
+	if !p.prepared {
+		if err := p.Prepare(); err != nil {
+			return "", nil, nil, fmt.Errorf("failed to prepare container: %w", err)
+		}
+	}
+
+	id, err := p.api.createExec(p.containerID, execConfig{
+		AttachStdin:  true,
+		AttachStdout: true,
+		AttachStderr: true,
+		Tty:          tty,
+		Cmd:          cmd,
+		Env:          opts.Env,
+	})
+	if err != nil {
+		return "", nil, nil, fmt.Errorf("failed to create exec session: %w", err)
+	}
+
+	conn, br, err := p.api.startExec(id, tty)
+	if err != nil {
+		return "", nil, nil, fmt.Errorf("failed to start exec session: %w", err)
+	}
+	return id, conn, br, nil
+}
+
+func (p *podmanProvider) apiStartCommand(cmd []string, opts capytest.CommandOptions) (capytest.NotInteractiveSession, error) {
+	id, conn, br, err := p.apiExec(cmd, opts, false)
+	if err != nil {
+		return nil, err
+	}
+
+	sess := &apiSession{
+		api:     p.api,
+		execID:  id,
+		conn:    conn,
+		stdoutC: make(chan string),
+		stderrC: make(chan string),
+		done:    make(chan struct{}),
+	}
+
+	go func() {
+		defer close(sess.done)
+		defer conn.Close()
+		sess.demux(br)
+		close(sess.stdoutC)
+		close(sess.stderrC)
+		sess.exitCode, sess.err = sess.api.exitCode(id)
+	}()
+
+	return sess, nil
+}
+
+func (p *podmanProvider) apiStartInteractiveCommand(cmd []string, opts capytest.CommandOptions) (capytest.InteractiveSession, error) {
+	marker := newSessionMarker()
+	opts.Env = append([]string{marker}, opts.Env...)
+	id, conn, br, err := p.apiExec(cmd, opts, true)
+	if err != nil {
+		return nil, err
+	}
+
+	sess := &apiInteractiveSession{
+		api:      p.api,
+		execID:   id,
+		conn:     conn,
+		output:   make(chan string),
+		done:     make(chan struct{}),
+		provider: p,
+		marker:   marker,
+	}
+
+	go func() {
+		defer close(sess.done)
+		defer conn.Close()
+		buf := make([]byte, 1024)
+		for {
+			n, err := br.Read(buf)
+			if n > 0 {
+				sess.output <- string(buf[:n])
+			}
+			if err != nil {
+				break
+			}
+		}
+		close(sess.output)
+		sess.exitCode, sess.err = sess.api.exitCode(id)
+	}()
+
+	return sess, nil
+}
+
+// apiSession is a non-TTY exec session. Its output uses the Docker
+// multiplexed stream format: every frame starts with an 8-byte header
+// holding the stream type and the big-endian payload size.
+type apiSession struct {
+	api    *apiClient
+	execID string
+	conn   net.Conn
+
+	writeMu sync.Mutex
+
+	stdoutC chan string
+	stderrC chan string
+
+	done     chan struct{}
+	exitCode int
+	err      error
+}
+
+func (s *apiSession) demux(r io.Reader) {
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			return
+		}
+		payload := make([]byte, binary.BigEndian.Uint32(header[4:]))
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return
+		}
+		switch header[0] {
+		case 1:
+			s.stdoutC <- string(payload)
+		case 2:
+			s.stderrC <- string(payload)
+		}
+	}
+}
+
+func (s *apiSession) Write(input string) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	_, err := io.WriteString(s.conn, input)
+	return err
+}
+
+// CloseStdin half-closes the hijacked connection, which libpod passes on
+// as EOF.
+func (s *apiSession) CloseStdin() error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	if c, ok := s.conn.(interface{ CloseWrite() error }); ok {
+		return c.CloseWrite()
+	}
+	return fmt.Errorf("closing stdin is not supported")
+}
+
+func (s *apiSession) Stdout() <-chan string {
+	return s.stdoutC
+}
+
+func (s *apiSession) Stderr() <-chan string {
+	return s.stderrC
+}
+
+func (s *apiSession) Wait() (int, error) {
+	<-s.done
+	return s.exitCode, s.err
+}
+
+func (s *apiSession) Interrupt() error {
+	return s.api.interrupt(s.execID)
+}
+
+// Kill kills the command and closes the connection, which ends the output
+// even if children of the command keep it open.
+func (s *apiSession) Kill() error {
+	err := s.api.signal(s.execID, syscall.SIGKILL)
+	s.conn.Close()
+	if errors.Is(err, os.ErrProcessDone) {
+		return nil
+	}
+	return err
+}
+
+// apiInteractiveSession is a TTY exec session; output is a raw byte stream.
+type apiInteractiveSession struct {
+	api    *apiClient
+	execID string
+	conn   net.Conn
+
+	writeMu sync.Mutex
+
+	output chan string
+
+	done     chan struct{}
+	exitCode int
+	err      error
+
+	// provider and marker find the terminal in the container for Echo.
+	provider *podmanProvider
+	marker   string
+}
+
+func (s *apiInteractiveSession) Write(input []byte) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	_, err := s.conn.Write(input)
+	return err
+}
+
+func (s *apiInteractiveSession) Output() <-chan string {
+	return s.output
+}
+
+func (s *apiInteractiveSession) Wait() (int, error) {
+	<-s.done
+	return s.exitCode, s.err
+}
+
+// Interrupt sends ^C through the terminal, letting the line discipline
+// inside the container deliver SIGINT to the foreground process group.
+func (s *apiInteractiveSession) Interrupt() error {
+	return s.Write([]byte{3})
+}
+
+func (s *apiInteractiveSession) Resize(rows, cols uint16) error {
+	return s.api.resizeExec(s.execID, rows, cols)
+}
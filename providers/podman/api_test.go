@@ -0,0 +1,526 @@
+package podman
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/creack/pty"
+	"go.alt-gnome.ru/capytest"
+)
+
+// fakeExec is an exec session of fakeLibpod. Commands are run on the host
+// instead of inside a container.
+type fakeExec struct {
+	cfg     execConfig
+	running bool
+	code    int
+	pid     int
+	ptmx    *os.File
+	resizes []string
+}
+
+// fakeLibpod serves the subset of the libpod REST API used by the provider
+// on a unix socket.
+type fakeLibpod struct {
+	t      *testing.T
+	socket string
+
+	mu         sync.Mutex
+	images     map[string]bool
+	pulled     []string
+	specs      []containerSpec
+	running    map[string]bool
+	removed    []string
+	execs      map[string]*fakeExec
+	nextExecID int
+
+	// neverExit keeps reporting exec sessions as running after their
+	// commands exit.
+	neverExit bool
+}
+
+func newFakeLibpod(t *testing.T, images ...string) *fakeLibpod {
+	t.Helper()
+
+	dir, err := os.MkdirTemp("", "capytest-podman")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	f := &fakeLibpod{
+		t:       t,
+		socket:  filepath.Join(dir, "podman.sock"),
+		images:  map[string]bool{},
+		running: map[string]bool{},
+		execs:   map[string]*fakeExec{},
+	}
+	for _, image := range images {
+		f.images[image] = true
+	}
+
+	l, err := net.Listen("unix", f.socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	prefix := "/" + DefaultAPIVersion + "/libpod"
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET "+prefix+"/images/{name}/exists", f.imageExists)
+	mux.HandleFunc("POST "+prefix+"/images/pull", f.pull)
+	mux.HandleFunc("POST "+prefix+"/containers/create", f.create)
+	mux.HandleFunc("POST "+prefix+"/containers/{id}/start", f.start)
+	mux.HandleFunc("GET "+prefix+"/containers/{id}/json", f.inspect)
+	mux.HandleFunc("POST "+prefix+"/containers/{id}/stop", f.stop)
+	mux.HandleFunc("DELETE "+prefix+"/containers/{id}", f.remove)
+	mux.HandleFunc("POST "+prefix+"/containers/{id}/exec", f.createExec)
+	mux.HandleFunc("POST "+prefix+"/exec/{id}/start", f.startExec)
+	mux.HandleFunc("POST "+prefix+"/exec/{id}/resize", f.resizeExec)
+	mux.HandleFunc("GET "+prefix+"/exec/{id}/json", f.inspectExec)
+
+	srv := &http.Server{Handler: mux}
+	go srv.Serve(l)
+	t.Cleanup(func() { srv.Close() })
+
+	return f
+}
+
+func (f *fakeLibpod) writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (f *fakeLibpod) notFound(w http.ResponseWriter, what string) {
+	f.writeJSON(w, http.StatusNotFound, apiError{Cause: "no such object", Message: what + ": no such object", Response: 404})
+}
+
+func (f *fakeLibpod) imageExists(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.images[r.PathValue("name")] {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	f.notFound(w, r.PathValue("name"))
+}
+
+func (f *fakeLibpod) pull(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ref := r.URL.Query().Get("reference")
+	f.pulled = append(f.pulled, ref)
+	if strings.HasPrefix(ref, "missing") {
+		f.writeJSON(w, http.StatusOK, map[string]string{"error": "manifest unknown"})
+		return
+	}
+	f.images[ref] = true
+	f.writeJSON(w, http.StatusOK, map[string]any{"stream": "Pulling " + ref + "\n"})
+}
+
+func (f *fakeLibpod) create(w http.ResponseWriter, r *http.Request) {
+	var spec containerSpec
+	if err := json.NewDecoder(r.Body).Decode(&spec); err != nil {
+		f.writeJSON(w, http.StatusBadRequest, apiError{Message: err.Error(), Response: 400})
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.specs = append(f.specs, spec)
+	id := fmt.Sprintf("ctr%d", len(f.specs))
+	f.running[id] = false
+	f.writeJSON(w, http.StatusCreated, map[string]any{"Id": id, "Warnings": []string{}})
+}
+
+func (f *fakeLibpod) start(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.running[r.PathValue("id")] = true
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (f *fakeLibpod) inspect(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	running, ok := f.running[r.PathValue("id")]
+	if !ok {
+		f.notFound(w, r.PathValue("id"))
+		return
+	}
+	f.writeJSON(w, http.StatusOK, map[string]any{"State": map[string]any{"Running": running}})
+}
+
+func (f *fakeLibpod) stop(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.running[r.PathValue("id")] = false
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (f *fakeLibpod) remove(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.running, r.PathValue("id"))
+	f.removed = append(f.removed, r.PathValue("id"))
+	f.writeJSON(w, http.StatusOK, []map[string]any{{"Id": r.PathValue("id")}})
+}
+
+func (f *fakeLibpod) createExec(w http.ResponseWriter, r *http.Request) {
+	var cfg execConfig
+	if err := json.NewDecoder(r.Body).Decode(&cfg); err != nil {
+		f.writeJSON(w, http.StatusBadRequest, apiError{Message: err.Error(), Response: 400})
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.running[r.PathValue("id")] {
+		f.writeJSON(w, http.StatusConflict, apiError{Message: "container is not running", Response: 409})
+		return
+	}
+	f.nextExecID++
+	id := strconv.Itoa(f.nextExecID)
+	f.execs[id] = &fakeExec{cfg: cfg}
+	f.writeJSON(w, http.StatusCreated, map[string]string{"Id": id})
+}
+
+func (f *fakeLibpod) startExec(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	e, ok := f.execs[r.PathValue("id")]
+	f.mu.Unlock()
+	if !ok {
+		f.notFound(w, r.PathValue("id"))
+		return
+	}
+
+	var body struct {
+		Detach, Tty bool
+		H           uint16 `json:"h"`
+		W           uint16 `json:"w"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Tty != e.cfg.Tty {
+		f.writeJSON(w, http.StatusBadRequest, apiError{Message: "bad exec start request", Response: 400})
+		return
+	}
+
+	conn, brw, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		f.t.Errorf("hijack: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	c := exec.Command(e.cfg.Cmd[0], e.cfg.Cmd[1:]...)
+	c.Env = append(os.Environ(), e.cfg.Env...)
+
+	// The process is started before the upgrade is acknowledged, so that
+	// the client may resize the terminal right away.
+	upgrade := func() {
+		brw.WriteString("HTTP/1.1 101 UPGRADED\r\nContent-Type: application/vnd.docker.multiplexed-stream\r\nConnection: Upgrade\r\nUpgrade: tcp\r\n\r\n")
+		brw.Flush()
+	}
+
+	if e.cfg.Tty {
+		f.mu.Lock()
+		e.resizes = append(e.resizes, fmt.Sprintf("%dx%d", body.H, body.W))
+		f.mu.Unlock()
+		ptmx, err := pty.StartWithSize(c, &pty.Winsize{Rows: body.H, Cols: body.W})
+		if err != nil {
+			f.t.Errorf("pty start: %v", err)
+			return
+		}
+		defer ptmx.Close()
+		f.setRunning(e, c.Process.Pid, ptmx)
+		upgrade()
+		go io.Copy(ptmx, brw)
+		io.Copy(conn, ptmx)
+	} else {
+		var mu sync.Mutex
+		c.Stdout = &frameWriter{mu: &mu, w: conn, stream: 1}
+		c.Stderr = &frameWriter{mu: &mu, w: conn, stream: 2}
+		stdin, _ := c.StdinPipe()
+		if err := c.Start(); err != nil {
+			f.t.Errorf("start: %v", err)
+			return
+		}
+		f.setRunning(e, c.Process.Pid, nil)
+		upgrade()
+		go io.Copy(stdin, brw)
+	}
+
+	err = c.Wait()
+	f.mu.Lock()
+	e.running = f.neverExit
+	e.code = c.ProcessState.ExitCode()
+	if exitErr, ok := err.(*exec.ExitError); ok && !exitErr.Exited() {
+		e.code = 130
+	}
+	f.mu.Unlock()
+}
+
+func (f *fakeLibpod) setRunning(e *fakeExec, pid int, ptmx *os.File) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	e.running = true
+	e.pid = pid
+	e.ptmx = ptmx
+}
+
+// resizes returns the terminal sizes the exec session was given.
+func (f *fakeLibpod) resizes(id string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.execs[id].resizes)
+}
+
+func (f *fakeLibpod) resizeExec(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	e, ok := f.execs[r.PathValue("id")]
+	if !ok {
+		f.notFound(w, r.PathValue("id"))
+		return
+	}
+	h, _ := strconv.Atoi(r.URL.Query().Get("h"))
+	cols, _ := strconv.Atoi(r.URL.Query().Get("w"))
+	e.resizes = append(e.resizes, fmt.Sprintf("%dx%d", h, cols))
+	if e.ptmx != nil {
+		pty.Setsize(e.ptmx, &pty.Winsize{Rows: uint16(h), Cols: uint16(cols)})
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (f *fakeLibpod) inspectExec(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	e, ok := f.execs[r.PathValue("id")]
+	if !ok {
+		f.notFound(w, r.PathValue("id"))
+		return
+	}
+	f.writeJSON(w, http.StatusOK, execState{Running: e.running, ExitCode: e.code, Pid: e.pid})
+}
+
+type frameWriter struct {
+	mu     *sync.Mutex
+	w      io.Writer
+	stream byte
+}
+
+func (w *frameWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	header := make([]byte, 8)
+	header[0] = w.stream
+	binary.BigEndian.PutUint32(header[4:], uint32(len(p)))
+	if _, err := w.w.Write(append(header, p...)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func collect(ch <-chan string) <-chan string {
+	res := make(chan string, 1)
+	go func() {
+		var b strings.Builder
+		for s := range ch {
+			b.WriteString(s)
+		}
+		res <- b.String()
+	}()
+	return res
+}
+
+func TestAPIPrepareAndCleanup(t *testing.T) {
+	f := newFakeLibpod(t)
+	p := Provider(
+		WithAPI(f.socket),
+		WithImage("alt:sisyphus"),
+		WithWorkdir("/src"),
+		WithVolumes("/tmp:/mnt/tmp:ro", "cache:/var/cache"),
+		WithEnvVars("LANG=C"),
+		WithNetwork("none"),
+	)
+
+	if err := p.Prepare(); err != nil {
+		t.Fatalf("Prepare: %v", err)
+	}
+	if len(f.pulled) != 1 || f.pulled[0] != "alt:sisyphus" {
+		t.Errorf("expected image to be pulled once, got %v", f.pulled)
+	}
+
+	spec := f.specs[0]
+	if !spec.Init || strings.Join(spec.Command, " ") != "sleep infinity" {
+		t.Errorf("unexpected command spec: init=%v command=%v", spec.Init, spec.Command)
+	}
+	if spec.WorkDir != "/src" || spec.Env["LANG"] != "C" || spec.NetNS == nil || spec.NetNS.NSMode != "none" {
+		t.Errorf("unexpected spec: %+v", spec)
+	}
+	if len(spec.Mounts) != 1 || spec.Mounts[0].Source != "/tmp" || spec.Mounts[0].Destination != "/mnt/tmp" || spec.Mounts[0].Options[0] != "ro" {
+		t.Errorf("unexpected mounts: %+v", spec.Mounts)
+	}
+	if len(spec.Volumes) != 1 || spec.Volumes[0].Name != "cache" || spec.Volumes[0].Dest != "/var/cache" {
+		t.Errorf("unexpected volumes: %+v", spec.Volumes)
+	}
+
+	if err := p.Cleanup(); err != nil {
+		t.Fatalf("Cleanup: %v", err)
+	}
+	if len(f.removed) != 1 || f.removed[0] != "ctr1" {
+		t.Errorf("expected container to be removed, got %v", f.removed)
+	}
+}
+
+func TestAPIPullError(t *testing.T) {
+	f := newFakeLibpod(t)
+	p := Provider(WithAPI(f.socket), WithImage("missing:latest"))
+
+	err := p.Prepare()
+	if err == nil || !strings.Contains(err.Error(), "manifest unknown") {
+		t.Fatalf("expected pull error, got %v", err)
+	}
+}
+
+func TestAPIStartCommand(t *testing.T) {
+	f := newFakeLibpod(t, DefaultImage)
+	p := Provider(WithAPI(f.socket))
+	defer p.Cleanup()
+
+	sess, err := p.StartCommand(
+		[]string{"sh", "-c", `echo out; echo err >&2; read x; echo "got $x $GREETING"; exit 3`},
+		capytest.CommandOptions{Env: []string{"GREETING=hi"}},
+	)
+	if err != nil {
+		t.Fatalf("StartCommand: %v", err)
+	}
+	stdout, stderr := collect(sess.Stdout()), collect(sess.Stderr())
+
+	if err := sess.Write("line\n"); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	code, err := sess.Wait()
+	if err != nil {
+		t.Fatalf("Wait: %v", err)
+	}
+	if code != 3 {
+		t.Errorf("unexpected exit code: got %d, want 3", code)
+	}
+	if got := <-stdout; got != "out\ngot line hi\n" {
+		t.Errorf("unexpected stdout: %q", got)
+	}
+	if got := <-stderr; got != "err\n" {
+		t.Errorf("unexpected stderr: %q", got)
+	}
+}
+
+func TestAPIExitTimeout(t *testing.T) {
+	defer func(d time.Duration) { DefaultExitTimeout = d }(DefaultExitTimeout)
+	DefaultExitTimeout = 200 * time.Millisecond
+
+	f := newFakeLibpod(t, DefaultImage)
+	f.neverExit = true
+	p := Provider(WithAPI(f.socket))
+	defer p.Cleanup()
+
+	sess, err := p.StartCommand([]string{"true"}, capytest.CommandOptions{})
+	if err != nil {
+		t.Fatalf("StartCommand: %v", err)
+	}
+	collect(sess.Stdout())
+	collect(sess.Stderr())
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := sess.Wait()
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil || !strings.Contains(err.Error(), "still running") {
+			t.Errorf("expected a timeout, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Wait did not return")
+	}
+}
+
+func TestAPICommandNotFound(t *testing.T) {
+	f := newFakeLibpod(t, DefaultImage)
+	p := Provider(WithAPI(f.socket))
+	defer p.Cleanup()
+
+	sess, err := p.StartCommand([]string{"sh", "-c", "exit 127"}, capytest.CommandOptions{})
+	if err != nil {
+		t.Fatalf("StartCommand: %v", err)
+	}
+	collect(sess.Stdout())
+	collect(sess.Stderr())
+
+	if _, err := sess.Wait(); err == nil || !strings.Contains(err.Error(), "command not found") {
+		t.Errorf("expected command not found error, got %v", err)
+	}
+}
+
+func TestAPIInteractive(t *testing.T) {
+	f := newFakeLibpod(t, DefaultImage)
+	p := Provider(WithAPI(f.socket))
+	defer p.Cleanup()
+
+	sess, err := p.StartInteractiveCommand(
+		[]string{"sh", "-c", `stty size; read x; stty size; echo "got $x"`},
+		capytest.CommandOptions{},
+	)
+	if err != nil {
+		t.Fatalf("StartInteractiveCommand: %v", err)
+	}
+	output := collect(sess.Output())
+
+	// Give the shell time to print the initial size before resizing.
+	time.Sleep(200 * time.Millisecond)
+	if err := sess.(capytest.ResizableSession).Resize(40, 120); err != nil {
+		t.Fatalf("Resize: %v", err)
+	}
+	if err := sess.Write([]byte("hello\n")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	code, err := sess.Wait()
+	if err != nil || code != 0 {
+		t.Fatalf("Wait: code=%d err=%v", code, err)
+	}
+
+	out := <-output
+	for _, want := range []string{"24 80", "40 120", "got hello"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output does not contain %q\noutput: %q", want, out)
+		}
+	}
+	if got := strings.Join(f.resizes("1"), ","); got != "24x80,40x120" {
+		t.Errorf("unexpected resizes: %s", got)
+	}
+}
+
+func TestAPIWithRunner(t *testing.T) {
+	f := newFakeLibpod(t, DefaultImage)
+	ts := capytest.NewTestSuite(t, Provider(WithAPI(f.socket)))
+
+	ts.Run("echo", func(t *testing.T, r capytest.Runner) {
+		r.Command("echo", "hello").
+			ExpectSuccess().
+			ExpectStdoutEqual("hello\n").
+			Run(t)
+	})
+}
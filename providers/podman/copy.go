@@ -0,0 +1,208 @@
+package podman
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// CopyTo copies a host file or directory to path inside the container,
+// creating missing parent directories.
+func (p *podmanProvider) CopyTo(hostPath, target string) error {
+	if !p.prepared {
+		if err := p.Prepare(); err != nil {
+			return fmt.Errorf("failed to prepare container: %w", err)
+		}
+	}
+
+	var archive bytes.Buffer
+	if err := writeArchive(&archive, hostPath, target); err != nil {
+		return fmt.Errorf("failed to archive %s: %w", hostPath, err)
+	}
+
+	if p.api != nil {
+		return p.api.putArchive(p.containerID, "/", &archive)
+	}
+
+	cmd := exec.Command(DefaultPodmanCli, "cp", "-", p.containerID+":/")
+	cmd.Stdin = &archive
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to copy %s to container: %w: %s", hostPath, err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// CopyFrom copies the contents of the directory source inside the container
+// into the host directory hostPath.
+func (p *podmanProvider) CopyFrom(source, hostPath string) error {
+	if !p.prepared {
+		if err := p.Prepare(); err != nil {
+			return fmt.Errorf("failed to prepare container: %w", err)
+		}
+	}
+
+	var archive io.Reader
+	if p.api != nil {
+		r, err := p.api.getArchive(p.containerID, source)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		archive = r
+	} else {
+		cmd := exec.Command(DefaultPodmanCli, "cp", p.containerID+":"+source, "-")
+		output, err := cmd.Output()
+		if err != nil {
+			if exitErr, ok := err.(*exec.ExitError); ok {
+				err = fmt.Errorf("%w: %s", err, strings.TrimSpace(string(exitErr.Stderr)))
+			}
+			return fmt.Errorf("failed to copy %s from container: %w", source, err)
+		}
+		archive = bytes.NewReader(output)
+	}
+
+	if err := extractArchive(archive, hostPath); err != nil {
+		return fmt.Errorf("failed to copy %s from container: %w", source, err)
+	}
+	return nil
+}
+
+// writeArchive writes a tar archive rooted at "/" holding hostPath as
+// target, together with the parent directories of target.
+func writeArchive(w io.Writer, hostPath, target string) error {
+	tw := tar.NewWriter(w)
+
+	target = strings.TrimPrefix(path.Clean(target), "/")
+	var parent string
+	for _, dir := range strings.Split(path.Dir(target), "/") {
+		if dir == "." {
+			break
+		}
+		parent = path.Join(parent, dir)
+		if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: parent + "/", Mode: 0o755}); err != nil {
+			return err
+		}
+	}
+
+	err := filepath.Walk(hostPath, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(hostPath, file)
+		if err != nil {
+			return err
+		}
+
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = path.Join(target, filepath.ToSlash(rel))
+		if info.IsDir() {
+			hdr.Name += "/"
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// extractArchive extracts regular files and directories from an archive of
+// a single directory into dir, dropping the name of the archived directory.
+func extractArchive(r io.Reader, dir string) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		_, rel, _ := strings.Cut(strings.TrimPrefix(hdr.Name, "./"), "/")
+		rel = path.Clean("/" + rel)
+		target := filepath.Join(dir, filepath.FromSlash(rel))
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0o755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+				return err
+			}
+			f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.FileMode(hdr.Mode).Perm())
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(f, tr)
+			f.Close()
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (c *apiClient) putArchive(id, dir string, archive *bytes.Buffer) error {
+	apiPath := "/containers/" + url.PathEscape(id) + "/archive"
+	req, err := c.newRequest(http.MethodPut, apiPath, url.Values{"path": {dir}}, nil)
+	if err != nil {
+		return err
+	}
+	req.Body = io.NopCloser(archive)
+	req.ContentLength = int64(archive.Len())
+	req.Header.Set("Content-Type", "application/x-tar")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("podman API %s %s: %w", http.MethodPut, apiPath, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return responseError(http.MethodPut, apiPath, resp)
+	}
+	return nil
+}
+
+func (c *apiClient) getArchive(id, source string) (io.ReadCloser, error) {
+	apiPath := "/containers/" + url.PathEscape(id) + "/archive"
+	req, err := c.newRequest(http.MethodGet, apiPath, url.Values{"path": {source}}, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("podman API %s %s: %w", http.MethodGet, apiPath, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, responseError(http.MethodGet, apiPath, resp)
+	}
+	return resp.Body, nil
+}
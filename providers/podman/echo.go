@@ -0,0 +1,88 @@
+package podman
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"go.alt-gnome.ru/capytest"
+)
+
+// sessionEnv marks the processes of an interactive session, so that the
+// terminal they run in can be found in the container.
+const sessionEnv = "CAPYTEST_SESSION"
+
+var sessionCount atomic.Int64
+
+func newSessionMarker() string {
+	return fmt.Sprintf("%s=%d-%d", sessionEnv, os.Getpid(), sessionCount.Add(1))
+}
+
+// echoScript prints the settings of the terminal of the first process whose
+// environment holds $1. The terminal is looked for on stdin, stdout and
+// stderr, since any of them may be redirected.
+const echoScript = `for p in /proc/[0-9]*; do
+	if { tr '\0' '\n' < "$p/environ"; } 2>/dev/null | grep -qxF "$1"; then
+		for fd in 0 1 2; do
+			{ stty -a < "$p/fd/$fd"; } 2>/dev/null && exit
+		done
+	fi
+done
+echo "no process of the session has a terminal" >&2
+exit 1`
+
+// terminalEcho reads the ECHO flag of the terminal of the session marked
+// with marker. podman exec puts the terminal on the host in raw mode, so
+// the flag is read by stty inside the container, which needs sh, tr, grep
+// and stty in the image, as in coreutils or busybox, and /proc mounted.
+func (p *podmanProvider) terminalEcho(marker string) (bool, error) {
+	sess, err := p.StartCommand([]string{"sh", "-c", echoScript, "sh", marker}, capytest.CommandOptions{})
+	if err != nil {
+		return false, err
+	}
+
+	var stdout, stderr strings.Builder
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for out := range sess.Stdout() {
+			stdout.WriteString(out)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for out := range sess.Stderr() {
+			stderr.WriteString(out)
+		}
+	}()
+	wg.Wait()
+
+	code, err := sess.Wait()
+	if err != nil {
+		return false, err
+	}
+	if code != 0 {
+		return false, fmt.Errorf("failed to read terminal settings: %s", strings.TrimSpace(stderr.String()))
+	}
+
+	for _, flag := range strings.Fields(stdout.String()) {
+		switch flag {
+		case "echo":
+			return true, nil
+		case "-echo":
+			return false, nil
+		}
+	}
+	return false, fmt.Errorf("no echo flag in stty output: %q", stdout.String())
+}
+
+func (s *interactiveSession) Echo() (bool, error) {
+	return s.provider.terminalEcho(s.marker)
+}
+
+func (s *apiInteractiveSession) Echo() (bool, error) {
+	return s.provider.terminalEcho(s.marker)
+}
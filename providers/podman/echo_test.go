@@ -0,0 +1,58 @@
+package podman
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"go.alt-gnome.ru/capytest"
+)
+
+func TestAPIEcho(t *testing.T) {
+	f := newFakeLibpod(t, DefaultImage)
+	p := Provider(WithAPI(f.socket))
+	defer p.Cleanup()
+
+	tests := []struct {
+		name   string
+		script string
+		echo   bool
+	}{
+		{"echo on", `echo ready; read x`, true},
+		{"echo off", `stty -echo; echo ready; read x`, false},
+		{"stdin redirected", `stty -echo; echo ready; exec sleep 1 </dev/null`, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sess, err := p.StartInteractiveCommand([]string{"sh", "-c", tt.script}, capytest.CommandOptions{})
+			if err != nil {
+				t.Fatalf("StartInteractiveCommand: %v", err)
+			}
+
+			var out strings.Builder
+			timeout := time.After(5 * time.Second)
+			for !strings.Contains(out.String(), "ready") {
+				select {
+				case s := <-sess.Output():
+					out.WriteString(s)
+				case <-timeout:
+					t.Fatalf("command is not ready, output: %q", out.String())
+				}
+			}
+
+			echo, err := sess.(capytest.EchoSession).Echo()
+			if err != nil {
+				t.Errorf("Echo: %v", err)
+			} else if echo != tt.echo {
+				t.Errorf("Echo() = %v, want %v", echo, tt.echo)
+			}
+
+			output := collect(sess.Output())
+			sess.Write([]byte("\n"))
+			if code, err := sess.Wait(); err != nil || code != 0 {
+				t.Errorf("Wait: code=%d err=%v", code, err)
+			}
+			<-output
+		})
+	}
+}
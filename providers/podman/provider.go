@@ -5,6 +5,7 @@ import (
 	"io"
 	"os"
 	"os/exec"
+	"sync"
 	"syscall"
 	"time"
 
@@ -53,6 +54,15 @@ func WithPrivileged(privileged bool) PodmanOption {
 	}
 }
 
+// WithAPI makes the provider talk to the libpod REST API on the given unix
+// socket (see `podman system service`) instead of running the podman CLI.
+// An empty socket selects DefaultSocketPath().
+func WithAPI(socket string) PodmanOption {
+	return func(p *podmanProvider) {
+		p.api = newAPIClient(socket)
+	}
+}
+
 type podmanProvider struct {
 	image       string
 	workdir     string
@@ -60,6 +70,7 @@ type podmanProvider struct {
 	envVars     []string
 	network     string
 	privileged  bool
+	api         *apiClient
 	containerID string
 	prepared    bool
 }
@@ -112,12 +123,19 @@ func (p *podmanProvider) Cleanup() error {
 		return nil
 	}
 
-	stopCmd := exec.Command(DefaultPodmanCli, "stop", p.containerID)
-	stopCmd.Run()
+	if p.api != nil {
+		p.api.stopContainer(p.containerID)
+		if err := p.api.removeContainer(p.containerID); err != nil {
+			return fmt.Errorf("failed to remove container %s: %w", p.containerID, err)
+		}
+	} else {
+		stopCmd := exec.Command(DefaultPodmanCli, "stop", p.containerID)
+		stopCmd.Run()
 
-	rmCmd := exec.Command(DefaultPodmanCli, "rm", p.containerID)
-	if err := rmCmd.Run(); err != nil {
-		return fmt.Errorf("failed to remove container %s: %w", p.containerID, err)
+		rmCmd := exec.Command(DefaultPodmanCli, "rm", p.containerID)
+		if err := rmCmd.Run(); err != nil {
+			return fmt.Errorf("failed to remove container %s: %w", p.containerID, err)
+		}
 	}
 
 	p.containerID = ""
@@ -126,11 +144,17 @@ func (p *podmanProvider) Cleanup() error {
 }
 
 func (p *podmanProvider) PullImage() error {
+	if p.api != nil {
+		return p.api.pullImage(p.image)
+	}
 	cmd := exec.Command(DefaultPodmanCli, "pull", p.image)
 	return cmd.Run()
 }
 
 func (p *podmanProvider) ImageExists() (bool, error) {
+	if p.api != nil {
+		return p.api.imageExists(p.image)
+	}
 	cmd := exec.Command(DefaultPodmanCli, "image", "exists", p.image)
 	err := cmd.Run()
 	if err != nil {
@@ -143,6 +167,10 @@ func (p *podmanProvider) ImageExists() (bool, error) {
 }
 
 func (p *podmanProvider) createContainer() (string, error) {
+	if p.api != nil {
+		return p.api.createContainer(p.containerSpec())
+	}
+
 	createCmd := []string{DefaultPodmanCli, "create", "--init"}
 
 	// Добавляем опции
@@ -185,8 +213,13 @@ func (p *podmanProvider) createContainer() (string, error) {
 }
 
 func (p *podmanProvider) startContainer() error {
-	cmd := exec.Command(DefaultPodmanCli, "start", p.containerID)
-	if err := cmd.Run(); err != nil {
+	var err error
+	if p.api != nil {
+		err = p.api.startContainer(p.containerID)
+	} else {
+		err = exec.Command(DefaultPodmanCli, "start", p.containerID).Run()
+	}
+	if err != nil {
 		return fmt.Errorf("failed to start container %s: %w", p.containerID, err)
 	}
 
@@ -204,6 +237,9 @@ func (p *podmanProvider) startContainer() error {
 }
 
 func (p *podmanProvider) isContainerRunning() (bool, error) {
+	if p.api != nil {
+		return p.api.isContainerRunning(p.containerID)
+	}
 	cmd := exec.Command(DefaultPodmanCli, "container", "inspect", p.containerID, "--format", "{{.State.Running}}")
 	output, err := cmd.Output()
 	if err != nil {
@@ -213,6 +249,10 @@ func (p *podmanProvider) isContainerRunning() (bool, error) {
 }
 
 func (p *podmanProvider) StartCommand(cmd []string, opts capytest.CommandOptions) (capytest.NotInteractiveSession, error) {
+	if p.api != nil {
+		return p.apiStartCommand(cmd, opts)
+	}
+
 	if !p.prepared {
 		if err := p.Prepare(); err != nil {
 			return nil, fmt.Errorf("failed to prepare container: %w", err)
@@ -255,25 +295,35 @@ func (p *podmanProvider) StartCommand(cmd []string, opts capytest.CommandOptions
 		return nil, err
 	}
 
-	go sess.readPipe(sess.stdout, sess.stdoutC)
-	go sess.readPipe(sess.stderr, sess.stderrC)
+	// Reading must finish before Wait closes the pipes.
+	var readers sync.WaitGroup
+	readers.Add(2)
+	go sess.readPipe(sess.stdout, sess.stdoutC, &readers)
+	go sess.readPipe(sess.stderr, sess.stderrC, &readers)
 	go func() {
-		sess.done <- c.Wait()
+		readers.Wait()
+		err := c.Wait()
 		close(sess.stdoutC)
 		close(sess.stderrC)
+		sess.done <- err
 	}()
 
 	return sess, nil
 }
 
 func (p *podmanProvider) StartInteractiveCommand(cmd []string, opts capytest.CommandOptions) (capytest.InteractiveSession, error) {
+	if p.api != nil {
+		return p.apiStartInteractiveCommand(cmd, opts)
+	}
+
 	if !p.prepared {
 		if err := p.Prepare(); err != nil {
 			return nil, fmt.Errorf("failed to prepare container: %w", err)
 		}
 	}
 
-	execCmd := []string{DefaultPodmanCli, "exec", "-it"}
+	marker := newSessionMarker()
+	execCmd := []string{DefaultPodmanCli, "exec", "-it", "-e", marker}
 	for _, e := range opts.Env {
 		execCmd = append(execCmd, "-e", e)
 	}
@@ -288,10 +338,12 @@ func (p *podmanProvider) StartInteractiveCommand(cmd []string, opts capytest.Com
 	}
 
 	sess := &interactiveSession{
-		cmd:    c,
-		pty:    ptmx,
-		output: make(chan string),
-		done:   make(chan error, 1),
+		cmd:      c,
+		pty:      ptmx,
+		output:   make(chan string),
+		done:     make(chan error, 1),
+		provider: p,
+		marker:   marker,
 	}
 
 	go func() {
@@ -335,6 +387,10 @@ func (s *notInteractiveSession) Write(input string) error {
 	return err
 }
 
+func (s *notInteractiveSession) CloseStdin() error {
+	return s.stdin.Close()
+}
+
 func (s *notInteractiveSession) Stdout() <-chan string {
 	return s.stdoutC
 }
@@ -376,7 +432,18 @@ func (s *notInteractiveSession) Interrupt() error {
 	return s.cmd.Process.Signal(syscall.SIGINT)
 }
 
-func (s *notInteractiveSession) readPipe(r io.Reader, ch chan string) {
+// Kill kills the podman exec client, which ends the session. podman does
+// not pass the signal on, so a command ignoring the interrupt keeps running
+// in the container until it is stopped by Cleanup.
+func (s *notInteractiveSession) Kill() error {
+	if s.cmd.Process == nil {
+		return os.ErrInvalid
+	}
+	return s.cmd.Process.Kill()
+}
+
+func (s *notInteractiveSession) readPipe(r io.Reader, ch chan string, wg *sync.WaitGroup) {
+	defer wg.Done()
 	buf := make([]byte, 1024)
 	for {
 		n, err := r.Read(buf)
@@ -394,6 +461,10 @@ type interactiveSession struct {
 	pty    *os.File
 	output chan string
 	done   chan error
+
+	// provider and marker find the terminal in the container for Echo.
+	provider *podmanProvider
+	marker   string
 }
 
 func (s *interactiveSession) Write(input []byte) error {
@@ -432,3 +503,9 @@ func (s *interactiveSession) Interrupt() error {
 	}
 	return s.cmd.Process.Signal(syscall.SIGINT)
 }
+
+// Resize changes the size of the host pty; podman exec forwards the new size
+// to the terminal inside the container.
+func (s *interactiveSession) Resize(rows, cols uint16) error {
+	return pty.Setsize(s.pty, &pty.Winsize{Rows: rows, Cols: cols})
+}
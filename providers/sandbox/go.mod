@@ -0,0 +1,8 @@
+module go.alt-gnome.ru/capytest/providers/sandbox
+
+go 1.24.4
+
+require (
+	github.com/creack/pty v1.1.24
+	golang.org/x/sys v0.35.0
+)
@@ -0,0 +1,235 @@
+//go:build linux
+
+package sandbox
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// initEnv carries the initConfig to the re-executed test binary. The
+// sandbox init runs from this package's init function, before the tests
+// of the binary get a chance to start.
+const initEnv = "CAPYTEST_SANDBOX_INIT"
+
+// statusFd is the write end of the status pipe. The init writes there why
+// it failed to set up the sandbox; the pipe is closed on exec, so that exit
+// codes of the command are never mistaken for setup failures.
+const statusFd = 3
+
+type initConfig struct {
+	Argv     []string `json:"argv"`
+	Dir      string   `json:"dir"`
+	Root     string   `json:"root"`
+	Tmp      string   `json:"tmp"`
+	Writable []string `json:"writable,omitempty"`
+	Network  bool     `json:"network"`
+
+	// Setup is set when the init has to build the filesystem itself rather
+	// than run inside one prepared by bubblewrap.
+	Setup bool `json:"setup"`
+}
+
+func init() {
+	if data, ok := os.LookupEnv(initEnv); ok {
+		os.Exit(runInit(data))
+	}
+}
+
+func runInit(data string) int {
+	unix.CloseOnExec(statusFd)
+
+	var cfg initConfig
+	if err := json.Unmarshal([]byte(data), &cfg); err != nil {
+		return initFailed(fmt.Errorf("invalid config: %w", err))
+	}
+
+	if cfg.Setup {
+		if err := setupFilesystem(cfg); err != nil {
+			return initFailed(err)
+		}
+		if !cfg.Network {
+			if err := loopbackUp(); err != nil {
+				return initFailed(err)
+			}
+		}
+		if err := unix.Prctl(unix.PR_CAP_AMBIENT, unix.PR_CAP_AMBIENT_CLEAR_ALL, 0, 0, 0); err != nil {
+			return initFailed(fmt.Errorf("failed to drop capabilities: %w", err))
+		}
+	}
+
+	var env []string
+	for _, e := range os.Environ() {
+		if !strings.HasPrefix(e, initEnv+"=") {
+			env = append(env, e)
+		}
+	}
+
+	path, err := exec.LookPath(cfg.Argv[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "capytest-sandbox: %v\n", err)
+		return 127
+	}
+
+	// The command gets its own process group, so that it alone receives
+	// the signals forwarded below. On a terminal the group is moved to the
+	// foreground, making ^C reach the command directly.
+	c := exec.Command(path, cfg.Argv[1:]...)
+	c.Args[0] = cfg.Argv[0]
+	c.Env = env
+	c.Stdin, c.Stdout, c.Stderr = os.Stdin, os.Stdout, os.Stderr
+	c.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if _, err := unix.IoctlGetTermios(0, unix.TCGETS); err == nil {
+		c.SysProcAttr.Foreground = true
+		c.SysProcAttr.Ctty = 0
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, unix.SIGINT, unix.SIGTERM, unix.SIGHUP, unix.SIGQUIT, unix.SIGUSR1, unix.SIGUSR2)
+
+	if err := c.Start(); err != nil {
+		return initFailed(err)
+	}
+	go func() {
+		for sig := range sigs {
+			c.Process.Signal(sig)
+		}
+	}()
+
+	err = c.Wait()
+	if status, ok := c.ProcessState.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return 128 + int(status.Signal())
+	}
+	if err != nil && c.ProcessState == nil {
+		return initFailed(err)
+	}
+	return c.ProcessState.ExitCode()
+}
+
+func initFailed(err error) int {
+	status := os.NewFile(statusFd, "status")
+	if _, werr := fmt.Fprint(status, err); werr != nil {
+		fmt.Fprintf(os.Stderr, "capytest-sandbox: %v\n", err)
+	}
+	return 125
+}
+
+// setupFilesystem builds the view of the sandbox in the private mount
+// namespace: a read-only recursive bind of the host root, a fresh /proc for
+// the new PID namespace, the scratch /tmp and the writable paths, and then
+// enters it.
+func setupFilesystem(cfg initConfig) error {
+	if err := unix.Mount("", "/", "", unix.MS_REC|unix.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("failed to make mounts private: %w", err)
+	}
+	if err := unix.Mount("/", cfg.Root, "", unix.MS_BIND|unix.MS_REC, ""); err != nil {
+		return fmt.Errorf("failed to bind root: %w", err)
+	}
+	if err := makeReadOnly(cfg.Root); err != nil {
+		return fmt.Errorf("failed to make root read-only: %w", err)
+	}
+
+	proc := filepath.Join(cfg.Root, "proc")
+	if err := unix.Mount("proc", proc, "proc", unix.MS_NOSUID|unix.MS_NODEV|unix.MS_NOEXEC, ""); err != nil {
+		return fmt.Errorf("failed to mount /proc: %w", err)
+	}
+	if err := unix.Mount(cfg.Tmp, filepath.Join(cfg.Root, "tmp"), "", unix.MS_BIND, ""); err != nil {
+		return fmt.Errorf("failed to mount /tmp: %w", err)
+	}
+	for _, path := range cfg.Writable {
+		if err := unix.Mount(path, filepath.Join(cfg.Root, path), "", unix.MS_BIND|unix.MS_REC, ""); err != nil {
+			return fmt.Errorf("failed to mount %s: %w", path, err)
+		}
+	}
+
+	if err := unix.Chroot(cfg.Root); err != nil {
+		return fmt.Errorf("failed to chroot: %w", err)
+	}
+	if err := unix.Chdir(cfg.Dir); err != nil {
+		return unix.Chdir("/")
+	}
+	return nil
+}
+
+// makeReadOnly marks every mount below root read-only. Kernels without
+// mount_setattr(2) get each mount remounted one by one, keeping the flags
+// that are locked in a user namespace.
+func makeReadOnly(root string) error {
+	err := unix.MountSetattr(unix.AT_FDCWD, root, unix.AT_RECURSIVE, &unix.MountAttr{Attr_set: unix.MOUNT_ATTR_RDONLY})
+	if !errors.Is(err, unix.ENOSYS) {
+		return err
+	}
+
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 {
+			continue
+		}
+		mountpoint := fields[4]
+		if mountpoint != root && !strings.HasPrefix(mountpoint, root+"/") {
+			continue
+		}
+		var st unix.Statfs_t
+		if err := unix.Statfs(mountpoint, &st); err != nil {
+			continue
+		}
+		flags := uintptr(unix.MS_REMOUNT | unix.MS_BIND | unix.MS_RDONLY)
+		for stFlag, msFlag := range lockedFlags {
+			if st.Flags&stFlag != 0 {
+				flags |= msFlag
+			}
+		}
+		if err := unix.Mount("", mountpoint, "", flags, ""); err != nil && mountpoint == root {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// lockedFlags maps statfs(2) flags to the mount flags that have to be kept
+// when remounting.
+var lockedFlags = map[int64]uintptr{
+	unix.ST_NOSUID:     unix.MS_NOSUID,
+	unix.ST_NODEV:      unix.MS_NODEV,
+	unix.ST_NOEXEC:     unix.MS_NOEXEC,
+	unix.ST_NOATIME:    unix.MS_NOATIME,
+	unix.ST_NODIRATIME: unix.MS_NODIRATIME,
+	unix.ST_RELATIME:   unix.MS_RELATIME,
+}
+
+// loopbackUp brings up "lo" in the new network namespace, which starts with
+// every interface down.
+func loopbackUp() error {
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+
+	ifr, err := unix.NewIfreq("lo")
+	if err != nil {
+		return err
+	}
+	ifr.SetUint16(unix.IFF_UP | unix.IFF_LOOPBACK | unix.IFF_RUNNING)
+	if err := unix.IoctlIfreq(fd, unix.SIOCSIFFLAGS, ifr); err != nil {
+		return fmt.Errorf("failed to bring up loopback: %w", err)
+	}
+	return nil
+}
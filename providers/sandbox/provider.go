@@ -0,0 +1,490 @@
+//go:build linux
+
+package sandbox
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"syscall"
+
+	"github.com/creack/pty"
+	"go.alt-gnome.ru/capytest"
+	"golang.org/x/sys/unix"
+)
+
+var DefaultBubblewrap string = "bwrap"
+
+type SandboxOption func(*sandboxProvider)
+
+// WithoutNetwork runs commands in an empty network namespace that only has
+// the loopback interface.
+func WithoutNetwork() SandboxOption {
+	return func(p *sandboxProvider) {
+		p.network = false
+	}
+}
+
+// WithWritablePaths keeps the given host paths writable inside the sandbox.
+// Everything else except /tmp is read-only.
+func WithWritablePaths(paths ...string) SandboxOption {
+	return func(p *sandboxProvider) {
+		p.writable = append(p.writable, paths...)
+	}
+}
+
+// WithBubblewrap sets up the namespaces with bubblewrap when it is found in
+// PATH, which also works on systems that restrict unprivileged user
+// namespaces to setuid helpers. Otherwise the sandbox is created directly.
+func WithBubblewrap() SandboxOption {
+	return func(p *sandboxProvider) {
+		p.bubblewrap = true
+	}
+}
+
+type sandboxProvider struct {
+	network    bool
+	writable   []string
+	bubblewrap bool
+
+	dir      string
+	prepared bool
+}
+
+// Provider runs commands on the local host inside fresh user, mount, pid and
+// (optionally) network namespaces. The host root is visible read-only and
+// /tmp is a scratch directory shared by all commands of a test.
+func Provider(opts ...SandboxOption) *sandboxProvider {
+	p := &sandboxProvider{
+		network: true,
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p
+}
+
+// Prepare creates the scratch directory mounted at /tmp.
+func (p *sandboxProvider) Prepare() error {
+	if p.prepared {
+		return nil
+	}
+
+	dir, err := os.MkdirTemp("", "capytest-sandbox")
+	if err != nil {
+		return fmt.Errorf("failed to create sandbox directory: %w", err)
+	}
+	for _, sub := range []string{"root", "tmp"} {
+		if err := os.Mkdir(filepath.Join(dir, sub), 0o755); err != nil {
+			os.RemoveAll(dir)
+			return fmt.Errorf("failed to create sandbox directory: %w", err)
+		}
+	}
+	if err := os.Chmod(filepath.Join(dir, "tmp"), 0o1777); err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+
+	p.dir = dir
+	p.prepared = true
+	return nil
+}
+
+// Cleanup removes the scratch directory. Mounts live in the namespaces of
+// the commands and disappear with them.
+func (p *sandboxProvider) Cleanup() error {
+	if !p.prepared {
+		return nil
+	}
+
+	if err := os.RemoveAll(p.dir); err != nil {
+		return fmt.Errorf("failed to remove sandbox directory %s: %w", p.dir, err)
+	}
+
+	p.dir = ""
+	p.prepared = false
+	return nil
+}
+
+// command returns the command starting the init of the sandbox, which
+// runs cmd, and the target of its signals.
+func (p *sandboxProvider) command(cmd []string, opts capytest.CommandOptions) (*exec.Cmd, *target, error) {
+	if !p.prepared {
+		if err := p.Prepare(); err != nil {
+			return nil, nil, fmt.Errorf("failed to prepare sandbox: %w", err)
+		}
+	}
+
+	self, err := os.Executable()
+	if err != nil {
+		return nil, nil, err
+	}
+	cwd, err := os.Getwd()
+	if err != nil {
+		return nil, nil, err
+	}
+	status, err := newSetupStatus()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cfg := initConfig{
+		Argv:     cmd,
+		Dir:      cwd,
+		Root:     filepath.Join(p.dir, "root"),
+		Tmp:      filepath.Join(p.dir, "tmp"),
+		Writable: p.writable,
+		Network:  p.network,
+	}
+
+	var c *exec.Cmd
+	var info, infoW *os.File
+	if bwrap, err := exec.LookPath(DefaultBubblewrap); p.bubblewrap && err == nil {
+		// bubblewrap does the mounts; the init only forwards signals. It
+		// runs as PID 1 so that signals sent to the PID reported on the
+		// info fd reach it.
+		args := []string{
+			"--die-with-parent", "--unshare-user", "--unshare-pid", "--as-pid-1",
+			"--ro-bind", "/", "/",
+			"--dev-bind", "/dev", "/dev",
+			"--proc", "/proc",
+			"--bind", cfg.Tmp, "/tmp",
+		}
+		for _, path := range p.writable {
+			args = append(args, "--bind", path, path)
+		}
+		if !p.network {
+			args = append(args, "--unshare-net")
+		}
+		args = append(args, "--chdir", cwd, "--info-fd", "4", "--", self)
+
+		info, infoW, err = os.Pipe()
+		if err != nil {
+			status.started(err)
+			return nil, nil, err
+		}
+		c = exec.Command(bwrap, args...)
+	} else {
+		cfg.Setup = true
+
+		uid, gid := os.Getuid(), os.Getgid()
+		flags := uintptr(unix.CLONE_NEWUSER | unix.CLONE_NEWNS | unix.CLONE_NEWPID)
+		if !p.network {
+			flags |= unix.CLONE_NEWNET
+		}
+		c = exec.Command(self)
+		c.SysProcAttr = &syscall.SysProcAttr{
+			Cloneflags:  flags,
+			UidMappings: []syscall.SysProcIDMap{{ContainerID: uid, HostID: uid, Size: 1}},
+			GidMappings: []syscall.SysProcIDMap{{ContainerID: gid, HostID: gid, Size: 1}},
+			// The init keeps the capabilities it gets in the new user
+			// namespace across exec to set up the mounts; it drops them
+			// before starting the command.
+			AmbientCaps: []uintptr{unix.CAP_SYS_ADMIN, unix.CAP_NET_ADMIN, unix.CAP_SYS_CHROOT},
+		}
+	}
+
+	t := &target{cmd: c, info: info, infoW: infoW, status: status}
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		t.started(err)
+		return nil, nil, err
+	}
+	c.Args[0] = "capytest-sandbox"
+	c.Env = append(append(os.Environ(), opts.Env...), initEnv+"="+string(data))
+	c.ExtraFiles = []*os.File{status.w}
+	if infoW != nil {
+		c.ExtraFiles = append(c.ExtraFiles, infoW)
+	}
+
+	return c, t, nil
+}
+
+// setupStatus is the read end of the pipe the init reports setup failures
+// on, see statusFd.
+type setupStatus struct {
+	r, w *os.File
+}
+
+func newSetupStatus() (*setupStatus, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	return &setupStatus{r: r, w: w}, nil
+}
+
+// started closes the write end in this process once the init has it, or
+// both ends if err shows it was not started.
+func (s *setupStatus) started(err error) {
+	s.w.Close()
+	if err != nil {
+		s.r.Close()
+	}
+}
+
+// result returns the setup failure reported by the init, or else err, the
+// result of waiting for the command.
+func (s *setupStatus) result(err error) error {
+	defer s.r.Close()
+	msg, _ := io.ReadAll(s.r)
+	if len(msg) > 0 {
+		return fmt.Errorf("failed to set up sandbox: %s", msg)
+	}
+	return err
+}
+
+// target tracks the process that receives signals: the init itself, or the
+// init inside bubblewrap once its PID is read from the info fd.
+type target struct {
+	cmd    *exec.Cmd
+	info   *os.File
+	infoW  *os.File
+	status *setupStatus
+
+	once sync.Once
+	pid  int
+}
+
+// started closes the write ends of the pipes in this process once the
+// init has them, or all of them if err shows it was not started.
+func (t *target) started(err error) {
+	t.status.started(err)
+	if t.info != nil {
+		t.infoW.Close()
+		if err != nil {
+			t.info.Close()
+		}
+	}
+}
+
+// wait waits for the init and returns its setup failure, if any.
+func (t *target) wait() error {
+	return t.status.result(t.cmd.Wait())
+}
+
+func (t *target) process() (*os.Process, error) {
+	if t.info == nil {
+		if t.cmd.Process == nil {
+			return nil, os.ErrInvalid
+		}
+		return t.cmd.Process, nil
+	}
+
+	t.once.Do(func() {
+		defer t.info.Close()
+		var info struct {
+			ChildPid int `json:"child-pid"`
+		}
+		if json.NewDecoder(t.info).Decode(&info) == nil {
+			t.pid = info.ChildPid
+		}
+	})
+	if t.pid == 0 {
+		return nil, os.ErrInvalid
+	}
+	return os.FindProcess(t.pid)
+}
+
+func (t *target) interrupt() error {
+	proc, err := t.process()
+	if err != nil {
+		return err
+	}
+	return proc.Signal(syscall.SIGINT)
+}
+
+type session struct {
+	*target
+	stdin  io.WriteCloser
+	stdout io.ReadCloser
+	stderr io.ReadCloser
+
+	stdoutC chan string
+	stderrC chan string
+	done    chan error
+}
+
+func readPipe(r io.Reader, ch chan string, wg *sync.WaitGroup) {
+	defer wg.Done()
+	buf := make([]byte, 1024)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			ch <- string(buf[:n])
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (s *session) Write(input string) error {
+	_, err := io.WriteString(s.stdin, input)
+	return err
+}
+
+func (s *session) CloseStdin() error {
+	return s.stdin.Close()
+}
+
+func (s *session) Stdout() <-chan string {
+	return s.stdoutC
+}
+
+func (s *session) Stderr() <-chan string {
+	return s.stderrC
+}
+
+func (s *session) Wait() (int, error) {
+	return exitCode(<-s.done)
+}
+
+func (s *session) Interrupt() error {
+	return s.interrupt()
+}
+
+// Kill kills the init of the sandbox, which takes the processes of its PID
+// namespace with it.
+func (s *session) Kill() error {
+	proc, err := s.process()
+	if err != nil {
+		return err
+	}
+	return proc.Kill()
+}
+
+func exitCode(err error) (int, error) {
+	if err == nil {
+		return 0, nil
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return exitErr.ExitCode(), nil
+	}
+	return -1, err
+}
+
+func (p *sandboxProvider) StartCommand(cmd []string, opts capytest.CommandOptions) (capytest.NotInteractiveSession, error) {
+	c, t, err := p.command(cmd, opts)
+	if err != nil {
+		return nil, err
+	}
+	stdin, err := c.StdinPipe()
+	if err != nil {
+		t.started(err)
+		return nil, err
+	}
+	stdout, err := c.StdoutPipe()
+	if err != nil {
+		t.started(err)
+		return nil, err
+	}
+	stderr, err := c.StderrPipe()
+	if err != nil {
+		t.started(err)
+		return nil, err
+	}
+
+	sess := &session{
+		target:  t,
+		stdin:   stdin,
+		stdout:  stdout,
+		stderr:  stderr,
+		stdoutC: make(chan string),
+		stderrC: make(chan string),
+		done:    make(chan error, 1),
+	}
+
+	err = c.Start()
+	sess.started(err)
+	if err != nil {
+		return nil, err
+	}
+
+	// Reading must finish before Wait closes the pipes.
+	var readers sync.WaitGroup
+	readers.Add(2)
+	go readPipe(sess.stdout, sess.stdoutC, &readers)
+	go readPipe(sess.stderr, sess.stderrC, &readers)
+	go func() {
+		readers.Wait()
+		err := sess.wait()
+		close(sess.stdoutC)
+		close(sess.stderrC)
+		sess.done <- err
+	}()
+
+	return sess, nil
+}
+
+type interactiveSession struct {
+	*target
+	pty    *os.File
+	output chan string
+	done   chan error
+}
+
+func (s *interactiveSession) Write(input []byte) error {
+	_, err := s.pty.Write(input)
+	return err
+}
+
+func (s *interactiveSession) Output() <-chan string {
+	return s.output
+}
+
+func (s *interactiveSession) Wait() (int, error) {
+	return exitCode(<-s.done)
+}
+
+func (s *interactiveSession) Interrupt() error {
+	return s.interrupt()
+}
+
+func (s *interactiveSession) Resize(rows, cols uint16) error {
+	return pty.Setsize(s.pty, &pty.Winsize{Rows: rows, Cols: cols})
+}
+
+func (p *sandboxProvider) StartInteractiveCommand(cmd []string, opts capytest.CommandOptions) (capytest.InteractiveSession, error) {
+	c, t, err := p.command(cmd, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	ptmx, err := pty.Start(c)
+	t.started(err)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start interactive command: %w", err)
+	}
+
+	sess := &interactiveSession{
+		target: t,
+		pty:    ptmx,
+		output: make(chan string),
+		done:   make(chan error, 1),
+	}
+
+	go func() {
+		defer close(sess.output)
+		buf := make([]byte, 1024)
+		for {
+			n, err := sess.pty.Read(buf)
+			if n > 0 {
+				sess.output <- string(buf[:n])
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	go func() {
+		sess.done <- sess.wait()
+	}()
+
+	return sess, nil
+}
@@ -0,0 +1,10 @@
+module go.alt-gnome.ru/capytest/providers/ssh
+
+go 1.24.4
+
+require (
+	github.com/creack/pty v1.1.24
+	golang.org/x/crypto v0.41.0
+)
+
+require golang.org/x/sys v0.35.0 // indirect
@@ -0,0 +1,485 @@
+package ssh
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"go.alt-gnome.ru/capytest"
+	gossh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+var DefaultTerm string = "xterm"
+var DefaultTimeout time.Duration = 10 * time.Second
+
+type SSHOption func(*sshProvider)
+
+// WithUser sets the remote user. Defaults to $USER.
+func WithUser(user string) SSHOption {
+	return func(p *sshProvider) {
+		p.user = user
+	}
+}
+
+// WithPrivateKey authenticates with a PEM encoded private key.
+func WithPrivateKey(pemBytes []byte) SSHOption {
+	return func(p *sshProvider) {
+		p.keys = append(p.keys, pemBytes)
+	}
+}
+
+// WithPrivateKeyFile authenticates with a PEM encoded private key read from
+// the given file when the provider is prepared.
+func WithPrivateKeyFile(path string) SSHOption {
+	return func(p *sshProvider) {
+		p.keyFiles = append(p.keyFiles, path)
+	}
+}
+
+// WithAgent authenticates with the keys of the agent listening on
+// $SSH_AUTH_SOCK.
+func WithAgent() SSHOption {
+	return func(p *sshProvider) {
+		p.useAgent = true
+	}
+}
+
+func WithPassword(password string) SSHOption {
+	return func(p *sshProvider) {
+		p.password = password
+	}
+}
+
+// WithKnownHosts verifies the host key against the given known_hosts files.
+// Without any host key option ~/.ssh/known_hosts is used.
+func WithKnownHosts(files ...string) SSHOption {
+	return func(p *sshProvider) {
+		p.knownHosts = append(p.knownHosts, files...)
+	}
+}
+
+func WithHostKeyCallback(cb gossh.HostKeyCallback) SSHOption {
+	return func(p *sshProvider) {
+		p.hostKeyCallback = cb
+	}
+}
+
+// WithInsecureIgnoreHostKey disables host key verification. Only meant for
+// throwaway VMs.
+func WithInsecureIgnoreHostKey() SSHOption {
+	return WithHostKeyCallback(gossh.InsecureIgnoreHostKey())
+}
+
+func WithTimeout(timeout time.Duration) SSHOption {
+	return func(p *sshProvider) {
+		p.timeout = timeout
+	}
+}
+
+type sshProvider struct {
+	addr            string
+	user            string
+	keys            [][]byte
+	keyFiles        []string
+	useAgent        bool
+	password        string
+	knownHosts      []string
+	hostKeyCallback gossh.HostKeyCallback
+	timeout         time.Duration
+
+	client    *gossh.Client
+	agentConn net.Conn
+	prepared  bool
+}
+
+// Provider runs commands on the host reachable at addr ("host" or
+// "host:port") over SSH.
+func Provider(addr string, opts ...SSHOption) *sshProvider {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "22")
+	}
+	p := &sshProvider{
+		addr:    addr,
+		user:    os.Getenv("USER"),
+		timeout: DefaultTimeout,
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p
+}
+
+func (p *sshProvider) clientConfig() (*gossh.ClientConfig, error) {
+	var signers []gossh.Signer
+	for _, path := range p.keyFiles {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read private key: %w", err)
+		}
+		p.keys = append(p.keys, data)
+	}
+	p.keyFiles = nil
+	for _, key := range p.keys {
+		signer, err := gossh.ParsePrivateKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse private key: %w", err)
+		}
+		signers = append(signers, signer)
+	}
+
+	var auth []gossh.AuthMethod
+	if len(signers) > 0 {
+		auth = append(auth, gossh.PublicKeys(signers...))
+	}
+	if p.useAgent {
+		conn, err := net.Dial("unix", os.Getenv("SSH_AUTH_SOCK"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to ssh agent: %w", err)
+		}
+		p.agentConn = conn
+		auth = append(auth, gossh.PublicKeysCallback(agent.NewClient(conn).Signers))
+	}
+	if p.password != "" {
+		auth = append(auth, gossh.Password(p.password))
+	}
+	if len(auth) == 0 {
+		return nil, errors.New("no ssh authentication method configured")
+	}
+
+	hostKeyCallback := p.hostKeyCallback
+	if hostKeyCallback == nil {
+		files := p.knownHosts
+		if len(files) == 0 {
+			home, err := os.UserHomeDir()
+			if err != nil {
+				return nil, err
+			}
+			files = []string{filepath.Join(home, ".ssh", "known_hosts")}
+		}
+		cb, err := knownhosts.New(files...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load known hosts: %w", err)
+		}
+		hostKeyCallback = cb
+	}
+
+	return &gossh.ClientConfig{
+		User:            p.user,
+		Auth:            auth,
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         p.timeout,
+	}, nil
+}
+
+// Prepare connects to the remote host.
+func (p *sshProvider) Prepare() error {
+	if p.prepared {
+		return nil
+	}
+
+	config, err := p.clientConfig()
+	if err != nil {
+		return err
+	}
+
+	client, err := gossh.Dial("tcp", p.addr, config)
+	if err != nil {
+		if p.agentConn != nil {
+			p.agentConn.Close()
+			p.agentConn = nil
+		}
+		return fmt.Errorf("failed to connect to %s: %w", p.addr, err)
+	}
+	p.client = client
+
+	p.prepared = true
+	return nil
+}
+
+func (p *sshProvider) Cleanup() error {
+	if !p.prepared {
+		return nil
+	}
+
+	err := p.client.Close()
+	if p.agentConn != nil {
+		p.agentConn.Close()
+		p.agentConn = nil
+	}
+
+	p.client = nil
+	p.prepared = false
+	return err
+}
+
+// newSession opens a session and passes the environment. Servers usually
+// only accept variables listed in AcceptEnv, so the rejected ones are set
+// through env(1) in front of the command instead.
+func (p *sshProvider) newSession(cmd []string, opts capytest.CommandOptions) (*gossh.Session, string, error) {
+	if !p.prepared {
+		if err := p.Prepare(); err != nil {
+			return nil, "", err
+		}
+	}
+
+	s, err := p.client.NewSession()
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to open ssh session: %w", err)
+	}
+
+	var rejected []string
+	for _, e := range opts.Env {
+		key, value, _ := strings.Cut(e, "=")
+		if err := s.Setenv(key, value); err != nil {
+			rejected = append(rejected, e)
+		}
+	}
+
+	var b strings.Builder
+	if len(rejected) > 0 {
+		b.WriteString("env")
+		for _, e := range rejected {
+			b.WriteString(" " + shellQuote(e))
+		}
+		b.WriteString(" ")
+	}
+	for i, arg := range cmd {
+		if i > 0 {
+			b.WriteString(" ")
+		}
+		b.WriteString(shellQuote(arg))
+	}
+
+	return s, b.String(), nil
+}
+
+func shellQuote(s string) string {
+	if s != "" && strings.IndexFunc(s, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("-_./=:,+@%", r))
+	}) < 0 {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+func (p *sshProvider) StartCommand(cmd []string, opts capytest.CommandOptions) (capytest.NotInteractiveSession, error) {
+	s, command, err := p.newSession(cmd, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	stdin, err := s.StdinPipe()
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	stdout, err := s.StdoutPipe()
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	stderr, err := s.StderrPipe()
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+
+	sess := &session{
+		session: s,
+		stdin:   stdin,
+		stdoutC: make(chan string),
+		stderrC: make(chan string),
+		done:    make(chan error, 1),
+	}
+
+	if err := s.Start(command); err != nil {
+		s.Close()
+		return nil, fmt.Errorf("failed to start command: %w", err)
+	}
+
+	var readers sync.WaitGroup
+	readers.Add(2)
+	go readPipe(stdout, sess.stdoutC, &readers)
+	go readPipe(stderr, sess.stderrC, &readers)
+	go func() {
+		err := s.Wait()
+		readers.Wait()
+		s.Close()
+		close(sess.stdoutC)
+		close(sess.stderrC)
+		sess.done <- err
+	}()
+
+	return sess, nil
+}
+
+func (p *sshProvider) StartInteractiveCommand(cmd []string, opts capytest.CommandOptions) (capytest.InteractiveSession, error) {
+	s, command, err := p.newSession(cmd, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	modes := gossh.TerminalModes{
+		gossh.ECHO:          1,
+		gossh.TTY_OP_ISPEED: 38400,
+		gossh.TTY_OP_OSPEED: 38400,
+	}
+	if err := s.RequestPty(DefaultTerm, 24, 80, modes); err != nil {
+		s.Close()
+		return nil, fmt.Errorf("failed to request pty: %w", err)
+	}
+
+	stdin, err := s.StdinPipe()
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	stdout, err := s.StdoutPipe()
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+
+	sess := &interactiveSession{
+		session: s,
+		stdin:   stdin,
+		output:  make(chan string),
+		done:    make(chan error, 1),
+	}
+
+	if err := s.Start(command); err != nil {
+		s.Close()
+		return nil, fmt.Errorf("failed to start interactive command: %w", err)
+	}
+
+	var readers sync.WaitGroup
+	readers.Add(1)
+	go readPipe(stdout, sess.output, &readers)
+	go func() {
+		err := s.Wait()
+		readers.Wait()
+		s.Close()
+		close(sess.output)
+		sess.done <- err
+	}()
+
+	return sess, nil
+}
+
+func readPipe(r io.Reader, ch chan string, wg *sync.WaitGroup) {
+	defer wg.Done()
+	buf := make([]byte, 1024)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			ch <- string(buf[:n])
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// signals maps the names used in the SSH protocol to their numbers, so that
+// a command killed by a signal is reported as 128+n like a shell does.
+var signals = map[string]int{
+	"HUP": 1, "INT": 2, "QUIT": 3, "ILL": 4, "ABRT": 6, "FPE": 8, "KILL": 9,
+	"SEGV": 11, "PIPE": 13, "ALRM": 14, "TERM": 15, "USR1": 10, "USR2": 12,
+}
+
+func exitStatus(err error) (int, error) {
+	if err == nil {
+		return 0, nil
+	}
+	var exitErr *gossh.ExitError
+	if errors.As(err, &exitErr) {
+		if sig := exitErr.Signal(); sig != "" {
+			if n, ok := signals[sig]; ok {
+				return 128 + n, nil
+			}
+			return -1, fmt.Errorf("command killed by signal %s", sig)
+		}
+		return exitErr.ExitStatus(), nil
+	}
+	return -1, err
+}
+
+type session struct {
+	session *gossh.Session
+	stdin   io.WriteCloser
+
+	stdoutC chan string
+	stderrC chan string
+	done    chan error
+}
+
+func (s *session) Write(input string) error {
+	_, err := io.WriteString(s.stdin, input)
+	return err
+}
+
+func (s *session) CloseStdin() error {
+	return s.stdin.Close()
+}
+
+func (s *session) Stdout() <-chan string {
+	return s.stdoutC
+}
+
+func (s *session) Stderr() <-chan string {
+	return s.stderrC
+}
+
+func (s *session) Wait() (int, error) {
+	return exitStatus(<-s.done)
+}
+
+func (s *session) Interrupt() error {
+	return s.session.Signal(gossh.SIGINT)
+}
+
+// Kill sends SIGKILL and closes the session, which ends it even if the
+// server doesn't support signals.
+func (s *session) Kill() error {
+	s.session.Signal(gossh.SIGKILL)
+	return s.session.Close()
+}
+
+type interactiveSession struct {
+	session *gossh.Session
+	stdin   io.WriteCloser
+
+	output chan string
+	done   chan error
+}
+
+func (s *interactiveSession) Write(input []byte) error {
+	_, err := s.stdin.Write(input)
+	return err
+}
+
+func (s *interactiveSession) Output() <-chan string {
+	return s.output
+}
+
+func (s *interactiveSession) Wait() (int, error) {
+	return exitStatus(<-s.done)
+}
+
+// Interrupt sends ^C through the remote terminal. Unlike signal requests,
+// which OpenSSH only honours since 8.1, this works with any server.
+func (s *interactiveSession) Interrupt() error {
+	return s.Write([]byte{3})
+}
+
+func (s *interactiveSession) Resize(rows, cols uint16) error {
+	return s.session.WindowChange(int(rows), int(cols))
+}
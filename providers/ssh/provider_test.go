@@ -0,0 +1,410 @@
+package ssh
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/creack/pty"
+	"go.alt-gnome.ru/capytest"
+	gossh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// testServer is an in-process stand-in for sshd. Exec requests are run with
+// "sh -c" on the local host, with a pty when one was requested.
+type testServer struct {
+	t       *testing.T
+	addr    string
+	hostKey gossh.Signer
+
+	// acceptEnv lists the variables accepted through "env" requests, like
+	// AcceptEnv in sshd_config.
+	acceptEnv []string
+
+	mu      sync.Mutex
+	resizes []string
+}
+
+func newTestServer(t *testing.T, authorized gossh.PublicKey) *testServer {
+	t.Helper()
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostKey, err := gossh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &gossh.ServerConfig{
+		PublicKeyCallback: func(_ gossh.ConnMetadata, key gossh.PublicKey) (*gossh.Permissions, error) {
+			if string(key.Marshal()) == string(authorized.Marshal()) {
+				return nil, nil
+			}
+			return nil, io.EOF
+		},
+		PasswordCallback: func(_ gossh.ConnMetadata, password []byte) (*gossh.Permissions, error) {
+			if string(password) == "secret" {
+				return nil, nil
+			}
+			return nil, io.EOF
+		},
+	}
+	config.AddHostKey(hostKey)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	s := &testServer{t: t, addr: l.Addr().String(), hostKey: hostKey, acceptEnv: []string{"LANG"}}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serveConn(conn, config)
+		}
+	}()
+	return s
+}
+
+func (s *testServer) serveConn(conn net.Conn, config *gossh.ServerConfig) {
+	_, chans, reqs, err := gossh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go gossh.DiscardRequests(reqs)
+	for newCh := range chans {
+		if newCh.ChannelType() != "session" {
+			newCh.Reject(gossh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		ch, reqs, err := newCh.Accept()
+		if err != nil {
+			continue
+		}
+		go s.serveSession(ch, reqs)
+	}
+}
+
+func (s *testServer) serveSession(ch gossh.Channel, reqs <-chan *gossh.Request) {
+	defer ch.Close()
+
+	var (
+		env     []string
+		winsize *pty.Winsize
+		ptmx    *os.File
+		cmd     *exec.Cmd
+		exited  = make(chan struct{})
+	)
+
+	for req := range reqs {
+		switch req.Type {
+		case "env":
+			var kv struct{ Key, Value string }
+			gossh.Unmarshal(req.Payload, &kv)
+			accepted := false
+			for _, name := range s.acceptEnv {
+				accepted = accepted || name == kv.Key
+			}
+			if accepted {
+				env = append(env, kv.Key+"="+kv.Value)
+			}
+			req.Reply(accepted, nil)
+		case "pty-req":
+			var p struct {
+				Term             string
+				Cols, Rows, W, H uint32
+				Modes            string
+			}
+			gossh.Unmarshal(req.Payload, &p)
+			winsize = &pty.Winsize{Rows: uint16(p.Rows), Cols: uint16(p.Cols)}
+			req.Reply(true, nil)
+		case "window-change":
+			cols, rows := binary.BigEndian.Uint32(req.Payload), binary.BigEndian.Uint32(req.Payload[4:])
+			s.mu.Lock()
+			s.resizes = append(s.resizes, fmt.Sprintf("%dx%d", rows, cols))
+			s.mu.Unlock()
+			if ptmx != nil {
+				pty.Setsize(ptmx, &pty.Winsize{Rows: uint16(rows), Cols: uint16(cols)})
+			}
+		case "signal":
+			var sig struct{ Name string }
+			gossh.Unmarshal(req.Payload, &sig)
+			if cmd != nil && cmd.Process != nil && sig.Name == "INT" {
+				syscall.Kill(-cmd.Process.Pid, syscall.SIGINT)
+			}
+		case "exec":
+			var e struct{ Command string }
+			gossh.Unmarshal(req.Payload, &e)
+			cmd = exec.Command("sh", "-c", e.Command)
+			cmd.Env = append(os.Environ(), env...)
+
+			var err error
+			if winsize != nil {
+				ptmx, err = pty.StartWithSize(cmd, winsize)
+				if err == nil {
+					go io.Copy(ptmx, ch)
+					go func() {
+						io.Copy(ch, ptmx)
+					}()
+				}
+			} else {
+				cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+				cmd.Stdout = ch
+				cmd.Stderr = ch.Stderr()
+				stdin, _ := cmd.StdinPipe()
+				go io.Copy(stdin, ch)
+				err = cmd.Start()
+			}
+			req.Reply(err == nil, nil)
+			if err != nil {
+				return
+			}
+			go func() {
+				defer close(exited)
+				cmd.Wait()
+				if ptmx != nil {
+					// Drain what is left in the terminal before reporting
+					// the exit status.
+					time.Sleep(50 * time.Millisecond)
+				}
+				status := cmd.ProcessState.Sys().(syscall.WaitStatus)
+				if status.Signaled() {
+					name := signalName(status.Signal())
+					ch.SendRequest("exit-signal", false, gossh.Marshal(struct {
+						Signal     string
+						CoreDumped bool
+						Error      string
+						Lang       string
+					}{Signal: name}))
+				} else {
+					ch.SendRequest("exit-status", false, gossh.Marshal(struct{ Status uint32 }{uint32(status.ExitStatus())}))
+				}
+				ch.Close()
+			}()
+		default:
+			req.Reply(false, nil)
+		}
+	}
+	<-exited
+}
+
+func signalName(sig syscall.Signal) string {
+	for name, n := range signals {
+		if syscall.Signal(n) == sig {
+			return name
+		}
+	}
+	return sig.String()
+}
+
+func newKey(t *testing.T) (ed25519.PrivateKey, gossh.PublicKey, []byte) {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := gossh.NewPublicKey(priv.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := gossh.MarshalPrivateKey(priv, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return priv, pub, pem.EncodeToMemory(block)
+}
+
+func collect(ch <-chan string) <-chan string {
+	res := make(chan string, 1)
+	go func() {
+		var b strings.Builder
+		for s := range ch {
+			b.WriteString(s)
+		}
+		res <- b.String()
+	}()
+	return res
+}
+
+func TestStartCommand(t *testing.T) {
+	_, pub, key := newKey(t)
+	srv := newTestServer(t, pub)
+
+	p := Provider(srv.addr, WithUser("tester"), WithPrivateKey(key), WithHostKeyCallback(gossh.FixedHostKey(srv.hostKey.PublicKey())))
+	if err := p.Prepare(); err != nil {
+		t.Fatalf("Prepare: %v", err)
+	}
+	defer p.Cleanup()
+
+	sess, err := p.StartCommand(
+		[]string{"sh", "-c", `read x; echo "$x $LANG $GREETING"; echo 'it'"'"'s' >&2; exit 4`},
+		capytest.CommandOptions{Env: []string{"LANG=C", "GREETING=hello world"}},
+	)
+	if err != nil {
+		t.Fatalf("StartCommand: %v", err)
+	}
+	stdout, stderr := collect(sess.Stdout()), collect(sess.Stderr())
+	if err := sess.Write("input\n"); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	code, err := sess.Wait()
+	if err != nil || code != 4 {
+		t.Errorf("Wait: code=%d err=%v, want code 4", code, err)
+	}
+	if got := <-stdout; got != "input C hello world\n" {
+		t.Errorf("unexpected stdout: %q", got)
+	}
+	if got := <-stderr; got != "it's\n" {
+		t.Errorf("unexpected stderr: %q", got)
+	}
+}
+
+func TestInterruptReportsSignal(t *testing.T) {
+	_, pub, key := newKey(t)
+	srv := newTestServer(t, pub)
+
+	p := Provider(srv.addr, WithPrivateKey(key), WithInsecureIgnoreHostKey())
+	defer p.Cleanup()
+
+	sess, err := p.StartCommand([]string{"sleep", "10"}, capytest.CommandOptions{})
+	if err != nil {
+		t.Fatalf("StartCommand: %v", err)
+	}
+	collect(sess.Stdout())
+	collect(sess.Stderr())
+
+	time.Sleep(100 * time.Millisecond)
+	if err := sess.Interrupt(); err != nil {
+		t.Fatalf("Interrupt: %v", err)
+	}
+
+	code, err := sess.Wait()
+	if err != nil || code != 130 {
+		t.Errorf("Wait: code=%d err=%v, want code 130", code, err)
+	}
+}
+
+func TestInteractiveCommand(t *testing.T) {
+	_, pub, key := newKey(t)
+	srv := newTestServer(t, pub)
+
+	p := Provider(srv.addr, WithPrivateKey(key), WithInsecureIgnoreHostKey())
+	defer p.Cleanup()
+
+	sess, err := p.StartInteractiveCommand(
+		[]string{"sh", "-c", `stty size; read x; stty size; echo "got $x"`},
+		capytest.CommandOptions{},
+	)
+	if err != nil {
+		t.Fatalf("StartInteractiveCommand: %v", err)
+	}
+	output := collect(sess.Output())
+
+	time.Sleep(200 * time.Millisecond)
+	if err := sess.(capytest.ResizableSession).Resize(40, 120); err != nil {
+		t.Fatalf("Resize: %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if err := sess.Write([]byte("hello\n")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	code, err := sess.Wait()
+	if err != nil || code != 0 {
+		t.Fatalf("Wait: code=%d err=%v", code, err)
+	}
+
+	out := <-output
+	for _, want := range []string{"24 80", "40 120", "got hello"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output does not contain %q\noutput: %q", want, out)
+		}
+	}
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if got := strings.Join(srv.resizes, ","); got != "40x120" {
+		t.Errorf("unexpected window changes: %s", got)
+	}
+}
+
+func TestAgentAuth(t *testing.T) {
+	priv, pub, _ := newKey(t)
+	srv := newTestServer(t, pub)
+
+	keyring := agent.NewKeyring()
+	if err := keyring.Add(agent.AddedKey{PrivateKey: priv}); err != nil {
+		t.Fatal(err)
+	}
+	dir, err := os.MkdirTemp("", "capytest-agent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sock := filepath.Join(dir, "agent.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go agent.ServeAgent(keyring, conn)
+		}
+	}()
+	t.Setenv("SSH_AUTH_SOCK", sock)
+
+	ts := capytest.NewTestSuite(t, Provider(srv.addr, WithAgent(), WithInsecureIgnoreHostKey()))
+	ts.Run("echo", func(t *testing.T, r capytest.Runner) {
+		r.Command("echo", "hello").
+			ExpectSuccess().
+			ExpectStdoutEqual("hello\n").
+			Run(t)
+	})
+}
+
+func TestPasswordAuthAndKnownHosts(t *testing.T) {
+	_, pub, _ := newKey(t)
+	srv := newTestServer(t, pub)
+
+	knownHosts := filepath.Join(t.TempDir(), "known_hosts")
+	host, port, _ := net.SplitHostPort(srv.addr)
+	line := "[" + host + "]:" + port + " " + string(gossh.MarshalAuthorizedKey(srv.hostKey.PublicKey()))
+	if err := os.WriteFile(knownHosts, []byte(line), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	p := Provider(srv.addr, WithPassword("secret"), WithKnownHosts(knownHosts))
+	if err := p.Prepare(); err != nil {
+		t.Fatalf("Prepare: %v", err)
+	}
+	p.Cleanup()
+
+	p = Provider(srv.addr, WithPassword("wrong"), WithKnownHosts(knownHosts))
+	if err := p.Prepare(); err == nil {
+		t.Errorf("expected authentication failure")
+	}
+}
@@ -0,0 +1,338 @@
+package capytest
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// DefaultReportDir is where reports of the commands run by the builders are
+// written: a JSON stream with one CommandRecord per line, a JUnit XML file
+// with a test case per command and an HTML page (see WriteHTMLReport), all
+// named after the test binary.
+// Reports are disabled while it is empty. CAPYTEST_REPORT_DIR overrides it.
+var DefaultReportDir = ""
+
+func reportDir() string {
+	if dir := os.Getenv("CAPYTEST_REPORT_DIR"); dir != "" {
+		return dir
+	}
+	return DefaultReportDir
+}
+
+// CommandRecord describes a command run by a CommandBuilder or a
+// PipelineBuilder.
+type CommandRecord struct {
+	Test     string        `json:"test"`
+	Provider string        `json:"provider"`
+	Argv     []string      `json:"argv,omitempty"`
+	Env      []string      `json:"env,omitempty"`
+	Start    time.Time     `json:"start"`
+	Duration time.Duration `json:"duration"`
+	ExitCode int           `json:"exit_code"`
+	Stdout   string        `json:"stdout,omitempty"`
+	Stderr   string        `json:"stderr,omitempty"`
+
+	// Transcript is the terminal output of an interactive command, and
+	// Events its input and output as they happened.
+	Transcript string          `json:"transcript,omitempty"`
+	Events     []TerminalEvent `json:"events,omitempty"`
+	Steps      []StepRecord    `json:"steps,omitempty"`
+
+	// Stages are the commands of a pipeline.
+	Stages []StageRecord `json:"stages,omitempty"`
+
+	Expectations []ExpectationRecord `json:"expectations,omitempty"`
+
+	// Error is set when the command could not be run.
+	Error string `json:"error,omitempty"`
+}
+
+// StepRecord describes a step of an interactive command.
+type StepRecord struct {
+	Action       string              `json:"action"`
+	Input        string              `json:"input,omitempty"`
+	Output       string              `json:"output,omitempty"`
+	Expectations []ExpectationRecord `json:"expectations,omitempty"`
+
+	// Branch is the pattern of the case taken by ExpectOneOf.
+	Branch string `json:"branch,omitempty"`
+}
+
+// TerminalEvent is input ("i"), output ("o") or a resize ("r", with data
+// "COLSxROWS") of an interactive command, Time seconds after it started,
+// like an event of an asciinema recording.
+type TerminalEvent struct {
+	Time float64 `json:"time"`
+	Kind string  `json:"kind"`
+	Data string  `json:"data"`
+}
+
+// StageRecord describes a command of a pipeline.
+type StageRecord struct {
+	Argv     []string `json:"argv"`
+	ExitCode int      `json:"exit_code"`
+	Stderr   string   `json:"stderr,omitempty"`
+}
+
+// ExpectationRecord is the result of an expectation; Message explains a
+// failure.
+type ExpectationRecord struct {
+	Description string `json:"description"`
+	Passed      bool   `json:"passed"`
+	Message     string `json:"message,omitempty"`
+
+	// Diff is the difference between the snapshot and the output, set when
+	// a snapshot does not match.
+	Diff string `json:"diff,omitempty"`
+}
+
+// Failed reports whether the command could not be run or an expectation on
+// it or on one of its steps failed.
+func (r *CommandRecord) Failed() bool {
+	return r.Error != "" || len(r.failures()) > 0
+}
+
+func (r *CommandRecord) failures() []string {
+	var msgs []string
+	add := func(exps []ExpectationRecord) {
+		for _, e := range exps {
+			if !e.Passed {
+				msgs = append(msgs, e.Message)
+			}
+		}
+	}
+	for _, s := range r.Steps {
+		add(s.Expectations)
+	}
+	add(r.Expectations)
+	return msgs
+}
+
+// Name is the command line, with the stages of a pipeline joined by "|".
+func (r *CommandRecord) Name() string {
+	if len(r.Stages) == 0 {
+		return strings.Join(r.Argv, " ")
+	}
+	stages := make([]string, len(r.Stages))
+	for i, s := range r.Stages {
+		stages[i] = strings.Join(s.Argv, " ")
+	}
+	return strings.Join(stages, " | ")
+}
+
+// check reports a failed expectation through t, with the secrets masked,
+// and adds the result to exps.
+func check(t *testing.T, s *Secrets, exps *[]ExpectationRecord, desc string, ok bool, format string, args ...any) {
+	t.Helper()
+	e := ExpectationRecord{Description: desc, Passed: ok}
+	if !ok {
+		e.Message = s.sprintf(format, args...)
+		t.Error(e.Message)
+	}
+	*exps = append(*exps, e)
+}
+
+// providerName is the package name of the provider, e.g. "podman".
+func providerName(p Provider) string {
+	typ := reflect.TypeOf(p)
+	for typ.Kind() == reflect.Pointer {
+		typ = typ.Elem()
+	}
+	if path := typ.PkgPath(); path != "" {
+		return path[strings.LastIndex(path, "/")+1:]
+	}
+	return typ.String()
+}
+
+// reporter writes the records of the test binary. The JSON stream, the
+// JUnit file and the HTML page grow with every command, so they are
+// complete even if the tests are interrupted.
+type reporter struct {
+	mu     sync.Mutex
+	stream *os.File
+	junit  *trailerFile
+	html   *trailerFile
+}
+
+var reports reporter
+
+// reportName is the import path of the package under test with the slashes
+// replaced, so that packages with the same last element don't share
+// reports. Programs other than test binaries are named after os.Args[0].
+func reportName() string {
+	if info, ok := debug.ReadBuildInfo(); ok && strings.HasSuffix(info.Path, ".test") {
+		return unsafeFileChars.ReplaceAllString(strings.TrimSuffix(info.Path, ".test"), "_")
+	}
+	return strings.TrimSuffix(filepath.Base(os.Args[0]), ".test")
+}
+
+func (r *reporter) add(t *testing.T, rec *CommandRecord) {
+	t.Helper()
+
+	dir := reportDir()
+	if dir == "" {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.write(dir, rec); err != nil {
+		t.Logf("failed to write report: %v", err)
+	}
+}
+
+func (r *reporter) write(dir string, rec *CommandRecord) error {
+	if r.stream == nil {
+		if err := r.open(dir); err != nil {
+			return err
+		}
+	}
+	if err := json.NewEncoder(r.stream).Encode(rec); err != nil {
+		return err
+	}
+	suite, err := xml.MarshalIndent(junitSuiteOf(rec), "  ", "  ")
+	if err != nil {
+		return err
+	}
+	if err := r.junit.insert(append(suite, '\n')); err != nil {
+		return err
+	}
+
+	cmd, err := htmlCommand(rec)
+	if err != nil {
+		return err
+	}
+	return r.html.insert(cmd)
+}
+
+// junitSuite is written for every command, named after its test, which
+// lets the file grow without rewriting counts.
+type junitSuite struct {
+	XMLName  xml.Name    `xml:"testsuite"`
+	Name     string      `xml:"name,attr"`
+	Tests    int         `xml:"tests,attr"`
+	Failures int         `xml:"failures,attr"`
+	Time     string      `xml:"time,attr"`
+	Cases    []junitCase `xml:"testcase"`
+}
+
+type junitCase struct {
+	Name      string        `xml:"name,attr"`
+	Classname string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	Stdout    string        `xml:"system-out,omitempty"`
+	Stderr    string        `xml:"system-err,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+func junitSuiteOf(rec *CommandRecord) junitSuite {
+	time := fmt.Sprintf("%.3f", rec.Duration.Seconds())
+	c := junitCase{
+		Name:      rec.Name(),
+		Classname: rec.Test,
+		Time:      time,
+		Stdout:    rec.Stdout + rec.Transcript,
+		Stderr:    rec.Stderr,
+	}
+	for _, stage := range rec.Stages {
+		if stage.Stderr != "" {
+			c.Stderr += fmt.Sprintf("[%s]\n%s", strings.Join(stage.Argv, " "), stage.Stderr)
+		}
+	}
+	suite := junitSuite{Name: rec.Test, Tests: 1, Time: time}
+	if rec.Failed() {
+		msgs := rec.failures()
+		if rec.Error != "" {
+			msgs = append([]string{rec.Error}, msgs...)
+		}
+		c.Failure = &junitFailure{Message: firstLine(msgs[0]), Text: strings.Join(msgs, "\n")}
+		suite.Failures = 1
+	}
+	suite.Cases = []junitCase{c}
+	return suite
+}
+
+// open creates the report files in dir. The reporter keeps them only once
+// all of them are created, so that a failure is retried with the next
+// record.
+func (r *reporter) open(dir string) error {
+	base := filepath.Join(dir, reportName())
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	stream, err := os.Create(base + ".jsonl")
+	if err != nil {
+		return err
+	}
+
+	header := fmt.Sprintf("%s<testsuites name=%q>\n", xml.Header, reportName())
+	junit, err := createTrailerFile(base+".xml", header, "</testsuites>\n")
+	if err != nil {
+		stream.Close()
+		return err
+	}
+
+	header, footer, err := htmlParts(reportName())
+	if err != nil {
+		stream.Close()
+		junit.f.Close()
+		return err
+	}
+	html, err := createTrailerFile(base+".html", header, footer)
+	if err != nil {
+		stream.Close()
+		junit.f.Close()
+		return err
+	}
+
+	r.stream, r.junit, r.html = stream, junit, html
+	return nil
+}
+
+// trailerFile is a file that grows by inserting data before a fixed
+// trailer, so that it is complete after every write.
+type trailerFile struct {
+	f       *os.File
+	trailer []byte
+	end     int64
+}
+
+func createTrailerFile(path, header, trailer string) (*trailerFile, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.WriteString(header + trailer); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &trailerFile{f: f, trailer: []byte(trailer), end: int64(len(header))}, nil
+}
+
+func (f *trailerFile) insert(data []byte) error {
+	if _, err := f.f.WriteAt(append(data, f.trailer...), f.end); err != nil {
+		return err
+	}
+	f.end += int64(len(data))
+	return nil
+}
+
+func firstLine(s string) string {
+	line, _, _ := strings.Cut(s, "\n")
+	return line
+}
@@ -0,0 +1,125 @@
+package capytest
+
+import (
+	"bufio"
+	"encoding/json"
+	"encoding/xml"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReportName(t *testing.T) {
+	if got, want := reportName(), "go.alt-gnome.ru_capytest"; got != want {
+		t.Errorf("reportName() = %q, want %q", got, want)
+	}
+}
+
+func TestReporterWrite(t *testing.T) {
+	dir := t.TempDir()
+	records := []*CommandRecord{
+		{Test: "TestA", Argv: []string{"echo", "a"}, Stdout: "a\n"},
+		{
+			Test:     "TestB",
+			Argv:     []string{"false"},
+			ExitCode: 1,
+			Expectations: []ExpectationRecord{
+				{Description: "exit code 0", Message: "exit code = 1, want 0\nmore"},
+			},
+		},
+	}
+
+	var r reporter
+	for i, rec := range records {
+		if err := r.write(dir, rec); err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			t.Cleanup(func() {
+				r.stream.Close()
+				r.junit.f.Close()
+				r.html.f.Close()
+			})
+		}
+
+		// Both files must be complete after every command.
+		var suites struct {
+			Suites []junitSuite `xml:"testsuite"`
+		}
+		data, err := os.ReadFile(filepath.Join(dir, reportName()+".xml"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := xml.Unmarshal(data, &suites); err != nil {
+			t.Fatalf("invalid JUnit report: %v\n%s", err, data)
+		}
+		if len(suites.Suites) != i+1 {
+			t.Fatalf("JUnit report has %d suites, want %d", len(suites.Suites), i+1)
+		}
+	}
+
+	f, err := os.Open(filepath.Join(dir, reportName()+".jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var tests []string
+	for sc := bufio.NewScanner(f); sc.Scan(); {
+		var rec CommandRecord
+		if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+			t.Fatal(err)
+		}
+		tests = append(tests, rec.Test)
+	}
+	if len(tests) != 2 || tests[0] != "TestA" || tests[1] != "TestB" {
+		t.Errorf("JSON stream has tests %q, want [TestA TestB]", tests)
+	}
+
+	var suites struct {
+		Suites []junitSuite `xml:"testsuite"`
+	}
+	data, _ := os.ReadFile(filepath.Join(dir, reportName()+".xml"))
+	if err := xml.Unmarshal(data, &suites); err != nil {
+		t.Fatal(err)
+	}
+	a, b := suites.Suites[0], suites.Suites[1]
+	if a.Name != "TestA" || a.Failures != 0 || a.Cases[0].Name != "echo a" || a.Cases[0].Stdout != "a\n" {
+		t.Errorf("first suite = %+v", a)
+	}
+	if b.Name != "TestB" || b.Failures != 1 || b.Cases[0].Failure == nil || b.Cases[0].Failure.Message != "exit code = 1, want 0" {
+		t.Errorf("second suite = %+v", b)
+	}
+}
+
+func TestReporterRetriesSetup(t *testing.T) {
+	dir := t.TempDir()
+	// A directory in place of the HTML report fails its creation.
+	html := filepath.Join(dir, reportName()+".html")
+	if err := os.Mkdir(html, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	var r reporter
+	rec := &CommandRecord{Test: "TestA", Argv: []string{"true"}}
+	if err := r.write(dir, rec); err == nil {
+		t.Fatal("write succeeded without the HTML report")
+	}
+	if err := r.write(dir, rec); err == nil {
+		t.Fatal("write succeeded without the HTML report")
+	}
+
+	if err := os.Remove(html); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.write(dir, rec); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		r.stream.Close()
+		r.junit.f.Close()
+		r.html.f.Close()
+	})
+	if _, err := os.Stat(html); err != nil {
+		t.Error(err)
+	}
+}
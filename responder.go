@@ -0,0 +1,121 @@
+package capytest
+
+import (
+	"fmt"
+	"regexp"
+	"testing"
+)
+
+// ResponderOption configures a rule added with CommandBuilder.OnOutput.
+type ResponderOption func(*responder)
+
+// WithMaxCount makes the rule answer at most n times.
+func WithMaxCount(n int) ResponderOption {
+	return func(r *responder) {
+		r.maxCount = n
+	}
+}
+
+// WithRequired fails the test if the rule never answered.
+func WithRequired() ResponderOption {
+	return func(r *responder) {
+		r.required = true
+	}
+}
+
+// responderWindow is how much of the output after the last answer a rule
+// keeps searching. It bounds the cost of every chunk of output in long
+// sessions; a prompt has to fit in it to be answered.
+const responderWindow = 4096
+
+// responder answers output matching pattern with response, for prompts
+// that may or may not appear, in any order.
+type responder struct {
+	pattern  string
+	re       *regexp.Regexp
+	response string
+	maxCount int
+	required bool
+
+	// text is the output the next match is searched in, and count how
+	// many times the rule answered. err is the first error writing the
+	// response.
+	text  string
+	count int
+	err   error
+}
+
+func (c *commandBuilder) OnOutput(pattern, response string, opts ...ResponderOption) CommandBuilder {
+	r := &responder{pattern: pattern, response: response}
+	for _, opt := range opts {
+		opt(r)
+	}
+	c.responders = append(c.responders, r)
+	return c
+}
+
+// respond answers the prompts that appeared in the output so far. It is
+// called by the goroutine reading the output with every new chunk of it.
+func (c *commandBuilder) respond(session InteractiveSession, output string, cast *castRecorder) {
+	for _, r := range c.responders {
+		if r.re == nil || r.maxCount > 0 && r.count >= r.maxCount {
+			continue
+		}
+		r.text += output
+		for r.maxCount == 0 || r.count < r.maxCount {
+			loc := r.re.FindStringIndex(r.text)
+			if loc == nil {
+				break
+			}
+			if loc[0] == loc[1] {
+				// An empty match answers nothing; look past it, or the
+				// rule would answer the same spot forever.
+				if loc[1] >= len(r.text) {
+					break
+				}
+				r.text = r.text[loc[1]+1:]
+				continue
+			}
+			r.text = r.text[loc[1]:]
+			r.count++
+
+			cast.input([]byte(r.response))
+			c.log.send([]byte(r.response))
+			if err := session.Write([]byte(r.response)); err != nil && r.err == nil {
+				r.err = err
+			}
+		}
+		if len(r.text) > responderWindow {
+			r.text = r.text[len(r.text)-responderWindow:]
+		}
+	}
+}
+
+// compileResponders reports invalid patterns before the command starts.
+func (c *commandBuilder) compileResponders(t *testing.T) {
+	t.Helper()
+	for _, r := range c.responders {
+		re, err := regexp.Compile(r.pattern)
+		if err != nil {
+			c.fatal(t, "invalid OnOutput pattern %q: %v", r.pattern, err)
+		}
+		if re.MatchString("") {
+			c.fatal(t, "invalid OnOutput pattern %q: it matches empty output", r.pattern)
+		}
+		r.re = re
+	}
+}
+
+func (c *commandBuilder) validateResponders(t *testing.T) {
+	t.Helper()
+	for _, r := range c.responders {
+		if r.err != nil {
+			check(t, &c.secrets, &c.record.Expectations, fmt.Sprintf("prompt %q answered", r.pattern), false,
+				"failed to answer %q: %v", r.pattern, r.err)
+		}
+		if r.required {
+			check(t, &c.secrets, &c.record.Expectations, fmt.Sprintf("prompt %q answered", r.pattern), r.count > 0,
+				"no output matched %q, so it was never answered", r.pattern)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package capytest
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+type fakeSession struct {
+	InteractiveSession
+	written []string
+	err     error
+}
+
+func (s *fakeSession) Write(data []byte) error {
+	s.written = append(s.written, string(data))
+	return s.err
+}
+
+func TestRespondSkipsEmptyMatches(t *testing.T) {
+	// \bx? matches the empty string at every word boundary, but not
+	// empty output, so it passes compileResponders.
+	r := &responder{pattern: `\bx?`, re: regexp.MustCompile(`\bx?`), response: "y\n"}
+	c := &commandBuilder{responders: []*responder{r}}
+	session := &fakeSession{}
+
+	c.respond(session, "a x b", newCastRecorder(nil, 24, 80))
+
+	if len(session.written) != 1 || r.count != 1 {
+		t.Errorf("answered %d times with %q, want once", r.count, session.written)
+	}
+}
+
+func TestRespondKeepsWriteError(t *testing.T) {
+	r := &responder{pattern: `\?`, re: regexp.MustCompile(`\?`), response: "y\n"}
+	c := &commandBuilder{responders: []*responder{r}}
+	session := &fakeSession{err: errors.New("closed")}
+
+	c.respond(session, "continue? ok? ", newCastRecorder(nil, 24, 80))
+
+	if r.count != 2 || r.err == nil || r.err.Error() != "closed" {
+		t.Errorf("count = %d, err = %v; want 2 answers and the write error", r.count, r.err)
+	}
+}
+
+func TestRespondAcrossChunks(t *testing.T) {
+	r := &responder{pattern: `Continue\? \[y/N\]`, re: regexp.MustCompile(`Continue\? \[y/N\]`), response: "y\n"}
+	c := &commandBuilder{responders: []*responder{r}}
+	session := &fakeSession{}
+	cast := newCastRecorder(nil, 24, 80)
+
+	for _, chunk := range []string{"installing\nContin", "ue? [y", "/N] ", "done\n", "Continue? [y/N] "} {
+		c.respond(session, chunk, cast)
+	}
+
+	if r.count != 2 || len(session.written) != 2 {
+		t.Errorf("answered %d times with %q, want twice", r.count, session.written)
+	}
+}
+
+func TestRespondKeepsBoundedOutput(t *testing.T) {
+	r := &responder{pattern: `password: `, re: regexp.MustCompile(`password: `), response: "secret\n"}
+	c := &commandBuilder{responders: []*responder{r}}
+	session := &fakeSession{}
+	cast := newCastRecorder(nil, 24, 80)
+
+	line := strings.Repeat("x", 99) + "\n"
+	for range 1000 {
+		c.respond(session, line, cast)
+		if len(r.text) > responderWindow {
+			t.Fatalf("searching %d bytes, want at most %d", len(r.text), responderWindow)
+		}
+	}
+	c.respond(session, "password: ", cast)
+
+	if r.count != 1 {
+		t.Errorf("answered %d times, want once", r.count)
+	}
+}
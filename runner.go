@@ -1,9 +1,24 @@
 package capytest
 
-import "testing"
+import (
+	"strings"
+	"testing"
+)
 
 type Runner interface {
 	Command(name string, args ...string) CommandBuilder
+
+	// Stub places a fake executable with the given name on PATH for the
+	// commands of this runner. Calling it again returns the same stub.
+	Stub(name string) *Stub
+
+	// Start starts a command in the background for the duration of t, see
+	// Process.
+	Start(t *testing.T, name string, args ...string) *Process
+
+	// Pipeline connects the stdout of every command to the stdin of the
+	// next one, see Cmd for building the stages.
+	Pipeline(stages ...[]string) PipelineBuilder
 }
 
 type Executable interface {
@@ -12,12 +27,54 @@ type Executable interface {
 
 type runner struct {
 	p Provider
+	t *testing.T
+
+	stubs stubs
+
+	verbose   bool
+	lineLimit int
+
+	// secrets are shared by the commands of the runner.
+	secrets *Secrets
 }
 
 func (r *runner) Command(name string, args ...string) CommandBuilder {
-	return &commandBuilder{provider: r.p, cmd: append([]string{name}, args...)}
+	return &commandBuilder{
+		runner:   r,
+		provider: r.p,
+		cmd:      append([]string{name}, args...),
+		secrets:  Secrets{parent: r.secrets},
+	}
 }
 
 func NewRunner(p Provider) Runner {
-	return &runner{p}
+	return newRunner(p)
+}
+
+func newRunner(p Provider) *runner {
+	verbose, lineLimit := verboseFromEnv()
+	return &runner{p: p, verbose: verbose, lineLimit: lineLimit, secrets: &Secrets{}}
+}
+
+// exec runs a helper command through the provider and returns its stdout.
+func (r *runner) exec(cmd ...string) (string, int, error) {
+	session, err := r.p.StartCommand(cmd, CommandOptions{})
+	if err != nil {
+		return "", -1, err
+	}
+
+	var stdout strings.Builder
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for range session.Stderr() {
+		}
+	}()
+	for out := range session.Stdout() {
+		stdout.WriteString(out)
+	}
+	<-done
+
+	code, err := session.Wait()
+	return stdout.String(), code, err
 }
@@ -0,0 +1,549 @@
+package capytest
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A Scenario is a test written as a plain-text script instead of Go, for
+// people who know the CLI better than Go. The script is followed by
+// embedded files, in the txtar format:
+//
+//	# Comments start with '#'.
+//	env GREETING=hello
+//	exec echo $GREETING
+//	stdout hello
+//
+//	! exec cat missing.txt
+//	stderr 'No such file'
+//
+//	stdin input.txt
+//	exec sort
+//	cmp stdout sorted.txt
+//
+//	exec bc -q
+//	sendline 2+2
+//	expect 4
+//	sendline quit
+//
+//	-- input.txt --
+//	b
+//	a
+//	-- sorted.txt --
+//	a
+//	b
+//
+// Every line is a command with arguments separated by spaces. Arguments in
+// single quotes are taken literally; double quotes allow Go escapes such as
+// "\t". $NAME and ${NAME} are replaced with variables set by env, and $WORK
+// with the directory holding the embedded files.
+//
+// The commands are:
+//
+//	env NAME=VALUE...       set variables for the next commands
+//	stdin FILE              write an embedded file to the stdin of the next exec
+//	[!] exec PROG ARGS...   run a program, expecting success (or failure with !)
+//	status CODE             expect the last program to exit with CODE
+//	[!] stdout [-re] TEXT   expect stdout to contain TEXT (or match the regex)
+//	[!] stderr [-re] TEXT   same for stderr
+//	cmp stdout|stderr FILE  expect stdout or stderr to equal an embedded file
+//	send TEXT               write TEXT to the terminal
+//	sendline TEXT           write TEXT and a newline
+//	expect [-re] TEXT       wait until the output contains TEXT
+//	interrupt               send Ctrl-C
+//	sleep DURATION          pause, e.g. 500ms
+//
+// A program followed by send, sendline, expect, interrupt or sleep runs in
+// a terminal, like a command with steps, and its output is checked with
+// expect rather than stdout and stderr.
+type Scenario struct {
+	// Name is the name used in error messages, usually the file name.
+	Name string
+	// Files are the embedded files, by name.
+	Files map[string]string
+
+	lines []scenarioLine
+}
+
+type scenarioLine struct {
+	num  int
+	text string
+	neg  bool
+	verb string
+	args []scenarioWord
+}
+
+// scenarioWord is an argument made of quoted and unquoted parts; variables
+// are expanded in the parts that are not single-quoted.
+type scenarioWord []scenarioWordPart
+
+type scenarioWordPart struct {
+	text    string
+	literal bool
+}
+
+func (w scenarioWord) raw() string {
+	var b strings.Builder
+	for _, part := range w {
+		b.WriteString(part.text)
+	}
+	return b.String()
+}
+
+func (w scenarioWord) expand(lookup func(string) string) string {
+	var b strings.Builder
+	for _, part := range w {
+		if part.literal {
+			b.WriteString(part.text)
+		} else {
+			b.WriteString(os.Expand(part.text, lookup))
+		}
+	}
+	return b.String()
+}
+
+// ParseScenario parses a scenario script, reporting syntax errors and
+// commands used out of place.
+func ParseScenario(name string, data []byte) (*Scenario, error) {
+	s := &Scenario{Name: name, Files: map[string]string{}}
+
+	text := strings.ReplaceAll(string(data), "\r\n", "\n")
+	lines := strings.SplitAfter(text, "\n")
+
+	var file string
+	for i, line := range lines {
+		if name, ok := fileMarker(line); ok {
+			file = name
+			if _, dup := s.Files[file]; dup {
+				return nil, fmt.Errorf("%s:%d: duplicate file %s", s.Name, i+1, file)
+			}
+			s.Files[file] = ""
+			continue
+		}
+		if file != "" {
+			if line != "" && !strings.HasSuffix(line, "\n") {
+				line += "\n"
+			}
+			s.Files[file] += line
+			continue
+		}
+
+		l, err := parseScenarioLine(strings.TrimSpace(line))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", s.Name, i+1, err)
+		}
+		if l.verb == "" {
+			continue
+		}
+		l.num = i + 1
+		s.lines = append(s.lines, l)
+	}
+
+	if err := s.check(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// fileMarker reports whether line is a "-- name --" file marker.
+func fileMarker(line string) (string, bool) {
+	line = strings.TrimRight(line, "\n")
+	if !strings.HasPrefix(line, "-- ") || !strings.HasSuffix(line, " --") || len(line) < 7 {
+		return "", false
+	}
+	name := strings.TrimSpace(line[3 : len(line)-3])
+	return name, name != ""
+}
+
+func parseScenarioLine(line string) (scenarioLine, error) {
+	l := scenarioLine{text: line}
+	if line == "" || strings.HasPrefix(line, "#") {
+		return l, nil
+	}
+
+	var words []scenarioWord
+	var word scenarioWord
+	inWord := false
+	flush := func() {
+		if inWord {
+			words = append(words, word)
+		}
+		word, inWord = nil, false
+	}
+
+	for i := 0; i < len(line); {
+		switch c := line[i]; {
+		case c == ' ' || c == '\t':
+			flush()
+			i++
+		case c == '\'':
+			end := strings.IndexByte(line[i+1:], '\'')
+			if end < 0 {
+				return l, fmt.Errorf("unterminated quote")
+			}
+			word = append(word, scenarioWordPart{text: line[i+1 : i+1+end], literal: true})
+			inWord = true
+			i += end + 2
+		case c == '"':
+			end := i + 1
+			for end < len(line) && line[end] != '"' {
+				if line[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(line) {
+				return l, fmt.Errorf("unterminated quote")
+			}
+			s, err := strconv.Unquote(line[i : end+1])
+			if err != nil {
+				return l, fmt.Errorf("invalid quoted string %s", line[i:end+1])
+			}
+			word = append(word, scenarioWordPart{text: s})
+			inWord = true
+			i = end + 1
+		default:
+			end := i
+			for end < len(line) && !strings.ContainsRune(" \t'\"", rune(line[end])) {
+				end++
+			}
+			word = append(word, scenarioWordPart{text: line[i:end]})
+			inWord = true
+			i = end
+		}
+	}
+	flush()
+
+	if len(words) > 0 && words[0].raw() == "!" {
+		l.neg = true
+		words = words[1:]
+	}
+	if len(words) == 0 {
+		return l, fmt.Errorf("missing command after !")
+	}
+	l.verb = words[0].raw()
+	l.args = words[1:]
+	return l, nil
+}
+
+// check validates the arguments of every line and that the output checks
+// follow a program they apply to.
+func (s *Scenario) check() error {
+	var (
+		hasExec     bool
+		interactive bool
+		outputCheck bool
+		hasStdin    bool
+		pendingIn   bool
+	)
+
+	for _, l := range s.lines {
+		fail := func(format string, args ...any) error {
+			return fmt.Errorf("%s:%d: %s", s.Name, l.num, fmt.Sprintf(format, args...))
+		}
+		nargs := func(n int) error {
+			if len(l.args) != n {
+				return fail("%s takes %d argument(s), got %d", l.verb, n, len(l.args))
+			}
+			return nil
+		}
+
+		if l.neg {
+			switch l.verb {
+			case "exec", "stdout", "stderr":
+			default:
+				return fail("%s cannot be negated", l.verb)
+			}
+		}
+
+		switch l.verb {
+		case "env":
+			if len(l.args) == 0 {
+				return fail("env takes NAME=VALUE arguments")
+			}
+			for _, arg := range l.args {
+				if !strings.Contains(arg.raw(), "=") {
+					return fail("env argument %q is not NAME=VALUE", arg.raw())
+				}
+			}
+		case "stdin":
+			if err := nargs(1); err != nil {
+				return err
+			}
+			if _, ok := s.Files[l.args[0].raw()]; !ok {
+				return fail("no embedded file %s", l.args[0].raw())
+			}
+			pendingIn = true
+		case "exec":
+			if len(l.args) == 0 {
+				return fail("exec takes a program to run")
+			}
+			hasExec, interactive, outputCheck = true, false, false
+			hasStdin, pendingIn = pendingIn, false
+		case "status":
+			if err := nargs(1); err != nil {
+				return err
+			}
+			if _, err := strconv.Atoi(l.args[0].raw()); err != nil {
+				return fail("invalid exit code %q", l.args[0].raw())
+			}
+		case "stdout", "stderr", "expect":
+			re := len(l.args) > 0 && l.args[0].raw() == "-re"
+			if re && l.neg {
+				return fail("! %s cannot be used with -re", l.verb)
+			}
+			want := 1
+			if re {
+				want = 2
+			}
+			if len(l.args) != want {
+				return fail("%s takes [-re] TEXT", l.verb)
+			}
+		case "cmp":
+			if err := nargs(2); err != nil {
+				return err
+			}
+			if stream := l.args[0].raw(); stream != "stdout" && stream != "stderr" {
+				return fail("cmp compares stdout or stderr, not %s", stream)
+			}
+			if _, ok := s.Files[l.args[1].raw()]; !ok {
+				return fail("no embedded file %s", l.args[1].raw())
+			}
+		case "send", "sendline":
+			if err := nargs(1); err != nil {
+				return err
+			}
+		case "interrupt":
+			if err := nargs(0); err != nil {
+				return err
+			}
+		case "sleep":
+			if err := nargs(1); err != nil {
+				return err
+			}
+			if _, err := time.ParseDuration(l.args[0].raw()); err != nil {
+				return fail("invalid duration %q", l.args[0].raw())
+			}
+		default:
+			return fail("unknown command %s", l.verb)
+		}
+
+		switch l.verb {
+		case "status", "stdout", "stderr", "cmp", "send", "sendline", "expect", "interrupt", "sleep":
+			if !hasExec {
+				return fail("%s must follow exec", l.verb)
+			}
+		}
+		switch l.verb {
+		case "stdout", "stderr", "cmp":
+			if interactive {
+				return fail("%s cannot check a program run in a terminal; use expect", l.verb)
+			}
+			outputCheck = true
+		case "send", "sendline", "expect", "interrupt", "sleep":
+			if outputCheck {
+				return fail("%s cannot follow stdout, stderr or cmp checks of the same program", l.verb)
+			}
+			if hasStdin {
+				return fail("%s cannot be used with stdin; use send", l.verb)
+			}
+			interactive = true
+		}
+	}
+
+	if pendingIn {
+		return fmt.Errorf("%s: stdin is not followed by exec", s.Name)
+	}
+	return nil
+}
+
+// scenarioCommand is the program being configured while the script is run.
+type scenarioCommand struct {
+	builder CommandBuilder
+	steps   StepBuilder
+
+	// action and expect tell what the current step already has, so that
+	// the next line starts a new step when needed.
+	action bool
+	expect bool
+}
+
+func (c *scenarioCommand) step(action bool) StepBuilder {
+	switch {
+	case c.steps == nil:
+		c.steps = c.builder.Do()
+	case action && (c.action || c.expect), !action && c.expect:
+		c.steps = c.steps.Then()
+		c.action, c.expect = false, false
+	}
+	if action {
+		c.action = true
+	} else {
+		c.expect = true
+	}
+	return c.steps
+}
+
+func (c *scenarioCommand) run(t *testing.T) {
+	t.Helper()
+	if c.steps != nil {
+		c.steps.Done()
+	}
+	c.builder.Run(t)
+}
+
+// Run runs the scenario with the runner. The embedded files are written to
+// a temporary directory, copied into the provider if it supports it.
+func (s *Scenario) Run(t *testing.T, r Runner) {
+	t.Helper()
+
+	work := t.TempDir()
+	for name, content := range s.Files {
+		path := filepath.Join(work, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatalf("failed to write %s: %v", name, err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatalf("failed to write %s: %v", name, err)
+		}
+	}
+	if rr, ok := r.(*runner); ok {
+		if fc, ok := rr.p.(FileCopier); ok {
+			if err := fc.CopyTo(work, work); err != nil {
+				t.Fatalf("failed to copy scenario files: %v", err)
+			}
+		}
+	}
+
+	vars := map[string]string{"WORK": work}
+	env := []string{"WORK=" + work}
+	lookup := func(name string) string { return vars[name] }
+	args := func(l scenarioLine) []string {
+		out := make([]string, len(l.args))
+		for i, arg := range l.args {
+			out[i] = arg.expand(lookup)
+		}
+		return out
+	}
+
+	var cmd *scenarioCommand
+	var stdin *string
+	flush := func() {
+		t.Helper()
+		if cmd != nil {
+			cmd.run(t)
+			cmd = nil
+		}
+	}
+
+	for _, l := range s.lines {
+		t.Logf("%s:%d: %s", s.Name, l.num, l.text)
+		a := args(l)
+
+		switch l.verb {
+		case "env":
+			for _, kv := range a {
+				key, value, _ := strings.Cut(kv, "=")
+				vars[key] = value
+				env = append(env, kv)
+			}
+		case "stdin":
+			flush()
+			content := s.Files[a[0]]
+			stdin = &content
+		case "exec":
+			flush()
+			b := r.Command(a[0], a[1:]...)
+			for _, kv := range env {
+				key, value, _ := strings.Cut(kv, "=")
+				b.WithEnv(key, value)
+			}
+			if stdin != nil {
+				b.WithStdin(*stdin)
+				stdin = nil
+			}
+			if l.neg {
+				b.ExpectFailure()
+			} else {
+				b.ExpectSuccess()
+			}
+			cmd = &scenarioCommand{builder: b}
+		case "status":
+			code, _ := strconv.Atoi(a[0])
+			cmd.builder.ExpectExitCode(code)
+		case "stdout", "stderr":
+			stdout := l.verb == "stdout"
+			switch {
+			case a[0] == "-re" && stdout:
+				cmd.builder.ExpectStdoutRegex(a[1])
+			case a[0] == "-re":
+				cmd.builder.ExpectStderrRegex(a[1])
+			case l.neg && stdout:
+				cmd.builder.ExpectStdoutNotContains(a[0])
+			case l.neg:
+				cmd.builder.ExpectStderrNotContains(a[0])
+			case stdout:
+				cmd.builder.ExpectStdoutContains(a[0])
+			default:
+				cmd.builder.ExpectStderrContains(a[0])
+			}
+		case "cmp":
+			if a[0] == "stdout" {
+				cmd.builder.ExpectStdoutEqual(s.Files[a[1]])
+			} else {
+				cmd.builder.ExpectStderrEqual(s.Files[a[1]])
+			}
+		case "send":
+			cmd.step(true).SendString(a[0])
+		case "sendline":
+			cmd.step(true).SendLine(a[0])
+		case "interrupt":
+			cmd.step(true).Interrupt()
+		case "sleep":
+			d, _ := time.ParseDuration(a[0])
+			cmd.step(true).Wait(d)
+		case "expect":
+			if a[0] == "-re" {
+				cmd.step(false).ExpectOutputRegex(a[1])
+			} else {
+				cmd.step(false).ExpectOutputContains(a[0])
+			}
+		}
+	}
+	flush()
+}
+
+// RunScenarios runs every scenario file matching the glob pattern as a
+// subtest named after the file, with the provider prepared for each.
+func RunScenarios(t *testing.T, p Provider, pattern string) {
+	t.Helper()
+
+	files, err := filepath.Glob(pattern)
+	if err != nil {
+		t.Fatalf("invalid scenario pattern %q: %v", pattern, err)
+	}
+	if len(files) == 0 {
+		t.Fatalf("no scenario files match %q", pattern)
+	}
+
+	suite := NewTestSuite(t, p)
+	for _, file := range files {
+		name := strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+		suite.Run(name, func(t *testing.T, r Runner) {
+			data, err := os.ReadFile(file)
+			if err != nil {
+				t.Fatalf("failed to read scenario: %v", err)
+			}
+			s, err := ParseScenario(file, data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.Run(t, r)
+		})
+	}
+}
@@ -0,0 +1,172 @@
+package capytest
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// secretMask replaces secrets in logs, reports and recordings.
+const secretMask = "***"
+
+// Secrets holds values such as tokens and passwords that are replaced by
+// "***" in failure messages, streamed logs, reports, terminal recordings
+// and snapshots, so that tests can pass them with WithEnv, SendLine or Type.
+// The commands of a TestSuite share its Secrets, and a command can add its
+// own with CommandBuilder.WithSecrets.
+type Secrets struct {
+	mu     sync.Mutex
+	values []string
+	parent *Secrets
+}
+
+// Add registers secret values; empty values are ignored.
+func (s *Secrets) Add(values ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, v := range values {
+		if v != "" && !slices.Contains(s.values, v) {
+			s.values = append(s.values, v)
+		}
+	}
+}
+
+// all returns the values of s and its parents, longest first, so that a
+// secret containing another one is masked as a whole.
+func (s *Secrets) all() []string {
+	var values []string
+	for ; s != nil; s = s.parent {
+		s.mu.Lock()
+		values = append(values, s.values...)
+		s.mu.Unlock()
+	}
+	sort.SliceStable(values, func(i, j int) bool {
+		return len(values[i]) > len(values[j])
+	})
+	return values
+}
+
+// Mask replaces every secret in text with "***". A nil *Secrets masks
+// nothing.
+func (s *Secrets) Mask(text string) string {
+	for _, v := range s.all() {
+		text = strings.ReplaceAll(text, v, secretMask)
+	}
+	return text
+}
+
+// sprintf formats a message with the secrets masked, also in string
+// arguments formatted with %q, where they would be escaped.
+func (s *Secrets) sprintf(format string, args ...any) string {
+	masked := make([]any, len(args))
+	for i, arg := range args {
+		switch v := arg.(type) {
+		case string:
+			masked[i] = s.Mask(v)
+		case []byte:
+			masked[i] = s.Mask(string(v))
+		default:
+			masked[i] = arg
+		}
+	}
+	return s.Mask(fmt.Sprintf(format, masked...))
+}
+
+// maskEvents masks the input and the output of a terminal session as two
+// streams, so that a secret split across events, e.g. typed or echoed one
+// character at a time, is masked too. The mask is put in the event where
+// the secret starts, and the rest of it is removed from the others.
+func (s *Secrets) maskEvents(events []TerminalEvent) {
+	values := s.all()
+	if len(values) == 0 {
+		return
+	}
+	for _, kind := range []string{"i", "o"} {
+		var stream []*TerminalEvent
+		var joined strings.Builder
+		for i := range events {
+			if events[i].Kind == kind {
+				stream = append(stream, &events[i])
+				joined.WriteString(events[i].Data)
+			}
+		}
+		text := joined.String()
+
+		// Longer secrets are found first, as in Mask.
+		masked := make([]bool, len(text))
+		starts := make([]bool, len(text))
+		for _, v := range values {
+			for off := 0; ; {
+				i := strings.Index(text[off:], v)
+				if i < 0 {
+					break
+				}
+				i += off
+				off = i + len(v)
+				if !slices.Contains(masked[i:off], true) {
+					starts[i] = true
+					for j := i; j < off; j++ {
+						masked[j] = true
+					}
+				}
+			}
+		}
+
+		pos := 0
+		for _, e := range stream {
+			var b strings.Builder
+			for i := 0; i < len(e.Data); i, pos = i+1, pos+1 {
+				if starts[pos] {
+					b.WriteString(secretMask)
+				}
+				if !masked[pos] {
+					b.WriteByte(e.Data[i])
+				}
+			}
+			e.Data = b.String()
+		}
+	}
+}
+
+func (s *Secrets) maskAll(texts []string) []string {
+	if len(texts) == 0 {
+		return texts
+	}
+	masked := make([]string, len(texts))
+	for i, text := range texts {
+		masked[i] = s.Mask(text)
+	}
+	return masked
+}
+
+func (s *Secrets) maskExpectations(exps []ExpectationRecord) {
+	for i := range exps {
+		exps[i].Description = s.Mask(exps[i].Description)
+		exps[i].Message = s.Mask(exps[i].Message)
+	}
+}
+
+// mask removes the secrets from the record before it is reported.
+func (r *CommandRecord) mask(s *Secrets) {
+	r.Argv = s.maskAll(r.Argv)
+	r.Env = s.maskAll(r.Env)
+	r.Stdout = s.Mask(r.Stdout)
+	r.Stderr = s.Mask(r.Stderr)
+	r.Transcript = s.Mask(r.Transcript)
+	r.Error = s.Mask(r.Error)
+	s.maskEvents(r.Events)
+	for i := range r.Steps {
+		step := &r.Steps[i]
+		step.Input = s.Mask(step.Input)
+		step.Output = s.Mask(step.Output)
+		step.Branch = s.Mask(step.Branch)
+		s.maskExpectations(step.Expectations)
+	}
+	for i := range r.Stages {
+		r.Stages[i].Argv = s.maskAll(r.Stages[i].Argv)
+		r.Stages[i].Stderr = s.Mask(r.Stages[i].Stderr)
+	}
+	s.maskExpectations(r.Expectations)
+}
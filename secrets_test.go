@@ -0,0 +1,35 @@
+package capytest
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMaskEvents(t *testing.T) {
+	var s Secrets
+	s.Add("hunter2", "hunter")
+
+	events := []TerminalEvent{
+		{Kind: "o", Data: "Password: "},
+		{Kind: "i", Data: "h"},
+		{Kind: "o", Data: "h"},
+		{Kind: "i", Data: "unt"},
+		{Kind: "o", Data: "unter2"},
+		{Kind: "i", Data: "er2\n"},
+		{Kind: "o", Data: "\r\nok, hunter\r\n"},
+	}
+	s.maskEvents(events)
+
+	want := []TerminalEvent{
+		{Kind: "o", Data: "Password: "},
+		{Kind: "i", Data: "***"},
+		{Kind: "o", Data: "***"},
+		{Kind: "i", Data: ""},
+		{Kind: "o", Data: ""},
+		{Kind: "i", Data: "\n"},
+		{Kind: "o", Data: "\r\nok, ***\r\n"},
+	}
+	if !reflect.DeepEqual(events, want) {
+		t.Errorf("maskEvents() =\n%+v\nwant\n%+v", events, want)
+	}
+}
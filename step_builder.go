@@ -6,13 +6,88 @@ type StepBuilder interface {
 	Send(input []byte) StepBuilder
 	SendString(input string) StepBuilder
 	SendLine(line string) StepBuilder
+
+	// SendKeys sends keys such as KeyUp, KeyF1 or Ctrl('c'), encoded for
+	// the mode of the terminal: cursor keys are sent as application keys
+	// if the program enabled them.
+	SendKeys(keys ...Key) StepBuilder
+
+	// Paste sends text as if pasted into the terminal, wrapped in
+	// bracketed paste markers if the program enabled bracketed paste.
+	Paste(text string) StepBuilder
+
+	// Type writes text one character at a time, for programs that drop or
+	// misparse input arriving in a single burst. The characters are
+	// DefaultTypeDelay apart unless the command sets WithInputPacing or
+	// the options say otherwise.
+	Type(text string, opts ...TypeOption) StepBuilder
+
+	// SendSecret sends secret followed by a newline, like SendLine, and
+	// masks it in the logs, reports and recordings of the command, even
+	// where the program echoes it back.
+	SendSecret(secret string) StepBuilder
+
 	Wait(duration time.Duration) StepBuilder
 	Interrupt() StepBuilder
 	Terminate() StepBuilder
 
+	// Resize changes the terminal size of the command, which needs a
+	// provider whose sessions implement ResizableSession.
+	Resize(rows, cols uint16) StepBuilder
+
+	// ExpectOutputContains waits up to DefaultWaitTimeout for substr to
+	// appear in the output of the step.
 	ExpectOutputContains(substr string) StepBuilder
 	ExpectOutputRegex(pattern string) StepBuilder
 
+	// ExpectOneOf waits up to DefaultWaitTimeout until the output matches
+	// the pattern of one of the cases and runs the steps of that case, like
+	// a multi-pattern expect in Tcl. The case matching earliest in the
+	// output wins; ties go to the first case. Which case was taken is
+	// logged and reported.
+	//
+	// Like every step, the first step of the case and the step after
+	// ExpectOneOf look at the output that arrives during them, and also
+	// at the output that came with the case.
+	ExpectOneOf(cases ...Case) StepBuilder
+
+	// ExpectOutputNotContains fails if substr appears in the output of the
+	// step, watched until the other expectations of the step are met and
+	// for at least DefaultNegativeWindow.
+	ExpectOutputNotContains(substr string) StepBuilder
+
+	// ExpectNoOutputFor expects nothing to be printed for the duration
+	// after the input of the step. The terminal echo of the input counts
+	// as output.
+	ExpectNoOutputFor(d time.Duration) StepBuilder
+
+	// ExpectQuiet waits until nothing has been printed for d, and fails if
+	// the output doesn't stop within DefaultWaitTimeout.
+	ExpectQuiet(d time.Duration) StepBuilder
+
+	// ExpectExit expects the command to exit with code after the input of
+	// the step, within DefaultWaitTimeout or the duration set with
+	// ExpectExitWithin.
+	ExpectExit(code int) StepBuilder
+
+	// ExpectExitWithin expects the command to exit within d, with any code
+	// unless ExpectExit is used as well.
+	ExpectExitWithin(d time.Duration) StepBuilder
+
+	// ExpectStillRunning expects the command not to have exited once the
+	// other expectations of the step are met.
+	ExpectStillRunning() StepBuilder
+
+	// ExpectEchoDisabled expects the terminal not to echo input once the
+	// other expectations of the step are met, as when the program reads a
+	// password. It waits up to DefaultWaitTimeout for the program to turn
+	// echo off, and needs a provider whose sessions implement EchoSession.
+	ExpectEchoDisabled() StepBuilder
+
+	// ExpectEchoEnabled expects the terminal to echo input, e.g. once the
+	// password has been read.
+	ExpectEchoEnabled() StepBuilder
+
 	Then() StepBuilder
 	Done() CommandBuilder
 }
@@ -25,17 +100,53 @@ const (
 	waitAction
 	interruptAction
 	terminateAction
+	keysAction
+	pasteAction
+	typeAction
+	secretAction
+	resizeAction
 )
 
+// DefaultNegativeWindow is how long ExpectOutputNotContains watches the
+// output at least.
+var DefaultNegativeWindow = 500 * time.Millisecond
+
 type expectation struct {
-	outputContains string
-	outputRegex    string
+	outputContains    string
+	outputRegex       string
+	oneOf             []branch
+	outputNotContains []string
+	noOutputFor       time.Duration
+	quiet             time.Duration
+	exitCode          *int
+	exitWithin        time.Duration
+	stillRunning      bool
+	echo              *bool
+}
+
+// Case is a branch of ExpectOneOf.
+type Case struct {
+	// Pattern is a regex matched against the output.
+	Pattern string
+
+	// Steps adds the steps to run when the case is taken to the given
+	// builder and returns the last one. It may be nil when there is
+	// nothing more to do in this case.
+	Steps func(s StepBuilder) StepBuilder
+}
+
+type branch struct {
+	pattern string
+	steps   []step
 }
 
 type step struct {
 	action      stepAction
 	data        []byte
+	keys        []Key
+	typeOpts    []TypeOption
 	duration    time.Duration
+	rows, cols  uint16
 	expectation expectation
 }
 
@@ -62,6 +173,31 @@ func (s *stepBuilder) SendLine(line string) StepBuilder {
 	return s
 }
 
+func (s *stepBuilder) SendKeys(keys ...Key) StepBuilder {
+	s.currentStep.action = keysAction
+	s.currentStep.keys = keys
+	return s
+}
+
+func (s *stepBuilder) Paste(text string) StepBuilder {
+	s.currentStep.action = pasteAction
+	s.currentStep.data = []byte(text)
+	return s
+}
+
+func (s *stepBuilder) Type(text string, opts ...TypeOption) StepBuilder {
+	s.currentStep.action = typeAction
+	s.currentStep.data = []byte(text)
+	s.currentStep.typeOpts = opts
+	return s
+}
+
+func (s *stepBuilder) SendSecret(secret string) StepBuilder {
+	s.currentStep.action = secretAction
+	s.currentStep.data = []byte(secret + "\n")
+	return s
+}
+
 func (s *stepBuilder) Wait(duration time.Duration) StepBuilder {
 	s.currentStep.action = waitAction
 	s.currentStep.duration = duration
@@ -78,6 +214,12 @@ func (s *stepBuilder) Terminate() StepBuilder {
 	return s
 }
 
+func (s *stepBuilder) Resize(rows, cols uint16) StepBuilder {
+	s.currentStep.action = resizeAction
+	s.currentStep.rows, s.currentStep.cols = rows, cols
+	return s
+}
+
 func (s *stepBuilder) ExpectOutputContains(substr string) StepBuilder {
 	s.currentStep.expectation.outputContains = substr
 	return s
@@ -88,6 +230,67 @@ func (s *stepBuilder) ExpectOutputRegex(pattern string) StepBuilder {
 	return s
 }
 
+func (s *stepBuilder) ExpectOneOf(cases ...Case) StepBuilder {
+	for _, c := range cases {
+		b := branch{pattern: c.Pattern}
+		if c.Steps != nil {
+			// The steps of the case are collected by a builder of their own.
+			parent := &commandBuilder{}
+			first := &stepBuilder{parent: parent, currentStep: &step{}}
+			last := first
+			if sb, ok := c.Steps(first).(*stepBuilder); ok {
+				last = sb
+			}
+			last.Done()
+			b.steps = parent.steps
+		}
+		s.currentStep.expectation.oneOf = append(s.currentStep.expectation.oneOf, b)
+	}
+	return s
+}
+
+func (s *stepBuilder) ExpectOutputNotContains(substr string) StepBuilder {
+	s.currentStep.expectation.outputNotContains = append(s.currentStep.expectation.outputNotContains, substr)
+	return s
+}
+
+func (s *stepBuilder) ExpectNoOutputFor(d time.Duration) StepBuilder {
+	s.currentStep.expectation.noOutputFor = d
+	return s
+}
+
+func (s *stepBuilder) ExpectQuiet(d time.Duration) StepBuilder {
+	s.currentStep.expectation.quiet = d
+	return s
+}
+
+func (s *stepBuilder) ExpectExit(code int) StepBuilder {
+	s.currentStep.expectation.exitCode = &code
+	return s
+}
+
+func (s *stepBuilder) ExpectExitWithin(d time.Duration) StepBuilder {
+	s.currentStep.expectation.exitWithin = d
+	return s
+}
+
+func (s *stepBuilder) ExpectStillRunning() StepBuilder {
+	s.currentStep.expectation.stillRunning = true
+	return s
+}
+
+func (s *stepBuilder) ExpectEchoDisabled() StepBuilder {
+	echo := false
+	s.currentStep.expectation.echo = &echo
+	return s
+}
+
+func (s *stepBuilder) ExpectEchoEnabled() StepBuilder {
+	echo := true
+	s.currentStep.expectation.echo = &echo
+	return s
+}
+
 func (s *stepBuilder) Then() StepBuilder {
 	s.parent.steps = append(s.parent.steps, *s.currentStep)
 
@@ -0,0 +1,324 @@
+package capytest
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Stub is a fake executable placed on PATH in front of the real one. It
+// answers with programmed responses and records every invocation.
+type Stub struct {
+	name string
+	dir  string
+
+	mu           sync.Mutex
+	responses    []*StubResponse
+	captureStdin bool
+}
+
+// StubResponse is what a stub prints and returns for the invocations
+// matching its pattern.
+type StubResponse struct {
+	pattern string
+	stdout  string
+	stderr  string
+	code    int
+}
+
+// StubCall is a recorded invocation of a stub.
+type StubCall struct {
+	// Args are the arguments, without the command name.
+	Args []string
+
+	// Env is the environment as "KEY=VALUE" entries.
+	Env []string
+
+	// Stdin is the standard input, recorded only with CaptureStdin.
+	Stdin string
+
+	// Dir is the working directory.
+	Dir string
+}
+
+// On adds a response for the invocations whose arguments, joined by single
+// spaces, match the shell glob pattern, e.g. "clone *". Responses are tried
+// in the order they were added. Invocations matching no response print
+// nothing and exit with 0.
+func (s *Stub) On(pattern string) *StubResponse {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r := &StubResponse{pattern: pattern}
+	s.responses = append(s.responses, r)
+	return r
+}
+
+// CaptureStdin makes the stub read its standard input until EOF and record
+// it. Callers that keep stdin open would block, so it is off by default.
+func (s *Stub) CaptureStdin() *Stub {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.captureStdin = true
+	return s
+}
+
+func (r *StubResponse) Stdout(stdout string) *StubResponse {
+	r.stdout = stdout
+	return r
+}
+
+func (r *StubResponse) Stderr(stderr string) *StubResponse {
+	r.stderr = stderr
+	return r
+}
+
+func (r *StubResponse) ExitCode(code int) *StubResponse {
+	r.code = code
+	return r
+}
+
+// Calls returns the invocations recorded so far, oldest first.
+func (s *Stub) Calls() []StubCall {
+	callsDir := filepath.Join(s.dir, "calls")
+	entries, err := os.ReadDir(callsDir)
+	if err != nil {
+		return nil
+	}
+
+	var ids []int
+	for _, e := range entries {
+		if id, err := strconv.Atoi(e.Name()); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+
+	var calls []StubCall
+	for _, id := range ids {
+		dir := filepath.Join(callsDir, strconv.Itoa(id))
+		read := func(name string) string {
+			data, _ := os.ReadFile(filepath.Join(dir, name))
+			return string(data)
+		}
+
+		call := StubCall{
+			Stdin: read("stdin"),
+			Dir:   strings.TrimSuffix(read("cwd"), "\n"),
+		}
+		if argv := read("argv"); argv != "" {
+			call.Args = strings.Split(strings.TrimSuffix(argv, "\x00"), "\x00")
+		}
+		// Values spanning several lines continue the previous entry.
+		for _, line := range strings.Split(strings.TrimSuffix(read("env"), "\n"), "\n") {
+			if !strings.Contains(line, "=") && len(call.Env) > 0 {
+				call.Env[len(call.Env)-1] += "\n" + line
+				continue
+			}
+			call.Env = append(call.Env, line)
+		}
+		calls = append(calls, call)
+	}
+	return calls
+}
+
+// stubShim records the invocation into a new numbered directory, mkdir
+// being atomic for concurrent calls, and answers with the first matching
+// response. Its helpers are looked up on the PATH without the stubs, so
+// that stubs of cat or mkdir don't run the shim again; env records the
+// PATH of the caller.
+const stubShim = `#!/bin/sh
+stub=%s
+caller_path=$PATH
+PATH=%s
+mkdir -p "$stub/calls"
+n=1
+while ! mkdir "$stub/calls/$n" 2>/dev/null; do n=$((n+1)); done
+call="$stub/calls/$n"
+printf '%%s\0' "$@" > "$call/argv"
+env=$(command -v env)
+PATH=$caller_path "$env" > "$call/env"
+pwd > "$call/cwd"
+if [ -e "$stub/capture-stdin" ]; then cat > "$call/stdin"; fi
+for response in "$stub"/responses/*; do
+	[ -d "$response" ] || continue
+	pattern=$(cat "$response/pattern")
+	case "$*" in
+	$pattern)
+		cat "$response/stdout"
+		cat "$response/stderr" >&2
+		exit "$(cat "$response/code")"
+		;;
+	esac
+done
+exit 0
+`
+
+// write generates the shim in bin, running its helpers from path, and the
+// responses of the stub.
+func (s *Stub) write(bin, path string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := os.MkdirAll(filepath.Join(s.dir, "calls"), 0o777); err != nil {
+		return err
+	}
+	responses := filepath.Join(s.dir, "responses")
+	if err := os.RemoveAll(responses); err != nil {
+		return err
+	}
+	for i, r := range s.responses {
+		dir := filepath.Join(responses, fmt.Sprintf("%04d", i))
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return err
+		}
+		files := map[string]string{
+			"pattern": r.pattern,
+			"stdout":  r.stdout,
+			"stderr":  r.stderr,
+			"code":    strconv.Itoa(r.code),
+		}
+		for name, content := range files {
+			if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+				return err
+			}
+		}
+	}
+
+	captureStdin := filepath.Join(s.dir, "capture-stdin")
+	if s.captureStdin {
+		if err := os.WriteFile(captureStdin, nil, 0o644); err != nil {
+			return err
+		}
+	} else {
+		os.Remove(captureStdin)
+	}
+
+	shim := fmt.Sprintf(stubShim, shellQuote(s.dir), shellQuote(path))
+	return os.WriteFile(filepath.Join(bin, s.name), []byte(shim), 0o755)
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// stubs holds the stubs of a runner in a per-test directory:
+// bin/ with the shims, which is prepended to PATH, and a directory per stub
+// with its responses and recorded calls.
+type stubs struct {
+	mu    sync.Mutex
+	dir   string
+	stubs map[string]*Stub
+	path  string
+
+	// cleanupT is the last test the directory of a runner made by
+	// NewRunner is removed after; it is written again for the next one.
+	cleanupT *testing.T
+}
+
+func (r *runner) Stub(name string) *Stub {
+	r.stubs.mu.Lock()
+	defer r.stubs.mu.Unlock()
+
+	if s, ok := r.stubs.stubs[name]; ok {
+		return s
+	}
+
+	if r.stubs.dir == "" {
+		dir, err := os.MkdirTemp("", "capytest-stub")
+		if err != nil {
+			if r.t != nil {
+				r.t.Fatalf("failed to create stub directory: %v", err)
+			}
+			panic(fmt.Sprintf("capytest: failed to create stub directory: %v", err))
+		}
+		// The commands may run as another user, e.g. in a container.
+		os.Chmod(dir, 0o755)
+		r.stubs.dir = dir
+		if r.t != nil {
+			r.t.Cleanup(func() { os.RemoveAll(dir) })
+		}
+	}
+	if r.stubs.stubs == nil {
+		r.stubs.stubs = map[string]*Stub{}
+	}
+
+	s := &Stub{name: name, dir: filepath.Join(r.stubs.dir, name)}
+	r.stubs.stubs[name] = s
+	return s
+}
+
+// prepareStubs writes the stubs before a command runs and returns the
+// environment putting them on PATH together with a function collecting the
+// recorded calls afterwards.
+func (r *runner) prepareStubs(t *testing.T) ([]string, func()) {
+	t.Helper()
+
+	r.stubs.mu.Lock()
+	defer r.stubs.mu.Unlock()
+
+	if len(r.stubs.stubs) == 0 {
+		return nil, func() {}
+	}
+
+	if r.t == nil && r.stubs.cleanupT != t {
+		dir := r.stubs.dir
+		t.Cleanup(func() { os.RemoveAll(dir) })
+		r.stubs.cleanupT = t
+	}
+
+	bin := filepath.Join(r.stubs.dir, "bin")
+	if err := os.MkdirAll(bin, 0o755); err != nil {
+		t.Fatalf("failed to create stub directory: %v", err)
+	}
+	// The commands may run as another user, e.g. in a container.
+	os.Chmod(r.stubs.dir, 0o755)
+	if r.stubs.path == "" {
+		path, err := r.targetPath()
+		if err != nil {
+			t.Fatalf("failed to get PATH for stubs: %v", err)
+		}
+		r.stubs.path = path
+	}
+	for _, s := range r.stubs.stubs {
+		if err := s.write(bin, r.stubs.path); err != nil {
+			t.Fatalf("failed to write stub %s: %v", s.name, err)
+		}
+	}
+	env := []string{"PATH=" + bin + string(os.PathListSeparator) + r.stubs.path}
+
+	fc, ok := r.p.(FileCopier)
+	if !ok {
+		return env, func() {}
+	}
+
+	if err := fc.CopyTo(r.stubs.dir, r.stubs.dir); err != nil {
+		t.Fatalf("failed to copy stubs: %v", err)
+	}
+	stubs := r.stubs.stubs
+	return env, func() {
+		for _, s := range stubs {
+			calls := filepath.Join(s.dir, "calls")
+			if err := fc.CopyFrom(calls, calls); err != nil {
+				t.Errorf("failed to collect calls of stub %s: %v", s.name, err)
+			}
+		}
+	}
+}
+
+// targetPath returns PATH as commands started by the provider see it,
+// which differs from the host one in containers.
+func (r *runner) targetPath() (string, error) {
+	stdout, code, err := r.exec("sh", "-c", `printf %s "$PATH"`)
+	if err != nil {
+		return "", err
+	}
+	if code != 0 {
+		return "", fmt.Errorf("exit code %d", code)
+	}
+	return stdout, nil
+}
@@ -6,15 +6,48 @@ type testSuite struct {
 	t          *testing.T
 	p          Provider
 	beforeEach func(t *testing.T, r Runner)
+
+	verbose   bool
+	lineLimit *int
+
+	secrets Secrets
+}
+
+// TestSuiteOption configures a TestSuite.
+type TestSuiteOption func(*testSuite)
+
+// WithVerbose streams the output of the commands to the test log as it
+// arrives, prefixed with [stdout], [stderr], [pty] or [send]. Setting
+// CAPYTEST_VERBOSE=1 does the same for every suite.
+func WithVerbose() TestSuiteOption {
+	return func(s *testSuite) {
+		s.verbose = true
+	}
+}
+
+// WithVerboseLineLimit sets how many lines of a command are streamed in
+// verbose mode, instead of DefaultVerboseLineLimit; 0 means no limit.
+func WithVerboseLineLimit(n int) TestSuiteOption {
+	return func(s *testSuite) {
+		s.lineLimit = &n
+	}
 }
 
 type TestSuite interface {
 	Run(name string, f func(t *testing.T, r Runner))
 	BeforeEach(f func(t *testing.T, r Runner))
+
+	// Secrets returns the secrets masked in the failures, logs, reports,
+	// recordings and snapshots of every command of the suite.
+	Secrets() *Secrets
 }
 
-func NewTestSuite(t *testing.T, p Provider) TestSuite {
-	return &testSuite{t, p, nil}
+func NewTestSuite(t *testing.T, p Provider, opts ...TestSuiteOption) TestSuite {
+	s := &testSuite{t: t, p: p}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
 }
 
 func (s *testSuite) runner(t *testing.T) Runner {
@@ -31,7 +64,18 @@ func (s *testSuite) runner(t *testing.T) Runner {
 		})
 	}
 
-	return NewRunner(s.p)
+	r := newRunner(s.p)
+	r.t = t
+	r.verbose = r.verbose || s.verbose
+	if s.lineLimit != nil {
+		r.lineLimit = *s.lineLimit
+	}
+	r.secrets = &s.secrets
+	return r
+}
+
+func (s *testSuite) Secrets() *Secrets {
+	return &s.secrets
 }
 
 func (s *testSuite) BeforeEach(f func(t *testing.T, r Runner)) {
@@ -0,0 +1,94 @@
+package capytest
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"time"
+	"unicode/utf8"
+)
+
+// DefaultTypeDelay is the pause between characters written by
+// StepBuilder.Type, unless set with WithDelay or
+// CommandBuilder.WithInputPacing.
+var DefaultTypeDelay = 30 * time.Millisecond
+
+// TypeOption configures the pacing of StepBuilder.Type.
+type TypeOption func(*pacing)
+
+// WithDelay sets the pause between characters.
+func WithDelay(d time.Duration) TypeOption {
+	return func(p *pacing) {
+		p.delay = d
+	}
+}
+
+// WithJitter adds a random pause of up to d to every character, so that
+// the input is not perfectly regular.
+func WithJitter(d time.Duration) TypeOption {
+	return func(p *pacing) {
+		p.jitter = d
+	}
+}
+
+// pacing spreads input over time, like a person typing.
+type pacing struct {
+	delay  time.Duration
+	jitter time.Duration
+}
+
+func (p pacing) paced() bool {
+	return p.delay > 0 || p.jitter > 0
+}
+
+func (p pacing) pause() time.Duration {
+	d := p.delay
+	if p.jitter > 0 {
+		d += rand.N(p.jitter)
+	}
+	return d
+}
+
+func (c *commandBuilder) WithInputPacing(delay, jitter time.Duration) CommandBuilder {
+	c.pacing = pacing{delay: delay, jitter: jitter}
+	return c
+}
+
+// typePacing is the pacing of a Type step: the one of the command, or
+// DefaultTypeDelay, changed by the options of the step.
+func (c *commandBuilder) typePacing(opts []TypeOption) pacing {
+	p := c.pacing
+	if !p.paced() {
+		p.delay = DefaultTypeDelay
+	}
+	for _, opt := range opts {
+		opt(&p)
+	}
+	return p
+}
+
+// splitRunes splits input into its characters; invalid UTF-8 is split into
+// bytes.
+func splitRunes(data []byte) [][]byte {
+	var chunks [][]byte
+	for len(data) > 0 {
+		_, n := utf8.DecodeRune(data)
+		chunks = append(chunks, data[:n])
+		data = data[n:]
+	}
+	return chunks
+}
+
+// writePaced writes the chunks of the input of a step, pausing between
+// them. The recording gets every chunk as it is written.
+func writePaced(session InteractiveSession, chunks [][]byte, p pacing, cast *castRecorder) error {
+	for i, chunk := range chunks {
+		if i > 0 {
+			time.Sleep(p.pause())
+		}
+		cast.input(chunk)
+		if err := session.Write(chunk); err != nil {
+			return fmt.Errorf("failed to write to stdin: %v", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package capytest
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPacedSteps(t *testing.T) {
+	const delay = 20 * time.Millisecond
+	for _, tt := range []struct {
+		name   string
+		pacing pacing
+		step   step
+		want   []string
+	}{
+		{"type", pacing{}, step{action: typeAction, data: []byte("añb"), typeOpts: []TypeOption{WithDelay(delay)}}, []string{"a", "ñ", "b"}},
+		{"input pacing", pacing{delay: delay}, step{action: sendAction, data: []byte("ab\n")}, []string{"a", "b", "\n"}},
+		{"keys", pacing{delay: delay}, step{action: keysAction, keys: []Key{KeyUp, KeyEnter}}, []string{"\x1b[A", "\r"}},
+		{"paste", pacing{delay: delay}, step{action: pasteAction, data: []byte("ab")}, []string{"ab"}},
+		{"unpaced", pacing{}, step{action: sendAction, data: []byte("ab\n")}, []string{"ab\n"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &commandBuilder{record: &CommandRecord{}, pacing: tt.pacing}
+			session := &fakeSession{}
+			cast := newCastRecorder(nil, 24, 80)
+			var buf syncBuffer
+			if _, err := c.executeStep(session, tt.step, &buf, false, cast, t); err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(session.written, tt.want) {
+				t.Errorf("written = %q, want %q", session.written, tt.want)
+			}
+			events := cast.terminalEvents()
+			if len(events) != len(tt.want) {
+				t.Fatalf("%d input events, want %d", len(events), len(tt.want))
+			}
+			for i := 1; i < len(events); i++ {
+				gap := time.Duration((events[i].Time - events[i-1].Time) * float64(time.Second))
+				if gap < delay {
+					t.Errorf("events %d and %d are %s apart, want at least %s", i-1, i, gap, delay)
+				}
+			}
+		})
+	}
+}
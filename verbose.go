@@ -0,0 +1,116 @@
+package capytest
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// DefaultVerboseLineLimit is how many lines of a command are streamed to
+// the test log in verbose mode before the rest is dropped; 0 means no
+// limit. CAPYTEST_VERBOSE_LINES overrides it.
+var DefaultVerboseLineLimit = 200
+
+// verboseFromEnv reads CAPYTEST_VERBOSE, which enables verbose mode for
+// every runner, and CAPYTEST_VERBOSE_LINES.
+func verboseFromEnv() (bool, int) {
+	enabled, _ := strconv.ParseBool(os.Getenv("CAPYTEST_VERBOSE"))
+	limit := DefaultVerboseLineLimit
+	if n, err := strconv.Atoi(os.Getenv("CAPYTEST_VERBOSE_LINES")); err == nil {
+		limit = n
+	}
+	return enabled, limit
+}
+
+// outputLog streams the output of a command to the test log line by line,
+// so that long commands don't look hung with `go test -v`. A nil outputLog
+// discards everything.
+type outputLog struct {
+	t       testing.TB
+	limit   int
+	secrets *Secrets
+
+	mu      sync.Mutex
+	lines   int
+	dropped int
+	partial map[string]string
+	closed  bool
+}
+
+// outputLog returns the log for a command run in t, masking the secrets, or
+// nil if verbose mode is off.
+func (r *runner) outputLog(t *testing.T, s *Secrets) *outputLog {
+	if r == nil || !r.verbose {
+		return nil
+	}
+	return &outputLog{t: t, limit: r.lineLimit, secrets: s, partial: map[string]string{}}
+}
+
+// write logs the complete lines of data with the prefix, keeping the last
+// partial line until more data or close.
+func (l *outputLog) write(prefix, data string) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return
+	}
+
+	data = l.partial[prefix] + strings.ReplaceAll(data, "\r", "")
+	lines := strings.Split(data, "\n")
+	l.partial[prefix] = lines[len(lines)-1]
+	for _, line := range lines[:len(lines)-1] {
+		l.log(prefix, line)
+	}
+}
+
+// send logs input written to a command.
+func (l *outputLog) send(data []byte) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.closed {
+		l.log("[send]", strconv.Quote(l.secrets.Mask(string(data))))
+	}
+}
+
+func (l *outputLog) log(prefix, line string) {
+	if l.limit > 0 && l.lines >= l.limit {
+		l.dropped++
+		return
+	}
+	l.lines++
+	l.t.Log(prefix + " " + l.secrets.Mask(line))
+}
+
+// close logs the partial lines left, ordered by prefix, and stops logging,
+// since the test may finish before the goroutines reading the output.
+func (l *outputLog) close() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return
+	}
+
+	for _, prefix := range slices.Sorted(maps.Keys(l.partial)) {
+		if line := l.partial[prefix]; line != "" {
+			l.log(prefix, line)
+		}
+	}
+	if l.dropped > 0 {
+		l.t.Log(fmt.Sprintf("... %d more lines not shown", l.dropped))
+	}
+	l.closed = true
+}
@@ -0,0 +1,89 @@
+package capytest
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// logRecorder keeps the messages logged by an outputLog.
+type logRecorder struct {
+	testing.TB
+	logs []string
+}
+
+func (r *logRecorder) Log(args ...any) {
+	r.logs = append(r.logs, fmt.Sprint(args...))
+}
+
+func TestOutputLogLimit(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		limit int
+		want  []string
+	}{
+		{"limit", 2, []string{"[pty] a", "[pty] b", "... 2 more lines not shown"}},
+		{"no limit", 0, []string{"[pty] a", "[pty] b", "[pty] c", "[pty] d"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := &logRecorder{}
+			l := &outputLog{t: rec, limit: tt.limit, secrets: &Secrets{}, partial: map[string]string{}}
+			l.write("[pty]", "a\r\nb\nc\n")
+			l.write("[pty]", "d")
+			l.close()
+			l.write("[pty]", "after close\n")
+			if !reflect.DeepEqual(rec.logs, tt.want) {
+				t.Errorf("logs = %q, want %q", rec.logs, tt.want)
+			}
+		})
+	}
+}
+
+func TestOutputLogCloseOrder(t *testing.T) {
+	for range 10 {
+		rec := &logRecorder{}
+		l := &outputLog{t: rec, secrets: &Secrets{}, partial: map[string]string{}}
+		l.write("[stdout]", "out")
+		l.write("[stderr]", "err")
+		l.write("[pty]", "")
+		l.close()
+		if want := []string{"[stderr] err", "[stdout] out"}; !reflect.DeepEqual(rec.logs, want) {
+			t.Fatalf("logs = %q, want %q", rec.logs, want)
+		}
+	}
+}
+
+func TestVerboseFromEnv(t *testing.T) {
+	for _, tt := range []struct {
+		verbose, lines string
+		wantVerbose    bool
+		wantLimit      int
+	}{
+		{"", "", false, DefaultVerboseLineLimit},
+		{"1", "", true, DefaultVerboseLineLimit},
+		{"true", "5", true, 5},
+		{"", "0", false, 0},
+		{"", "many", false, DefaultVerboseLineLimit},
+	} {
+		t.Setenv("CAPYTEST_VERBOSE", tt.verbose)
+		t.Setenv("CAPYTEST_VERBOSE_LINES", tt.lines)
+		verbose, limit := verboseFromEnv()
+		if verbose != tt.wantVerbose || limit != tt.wantLimit {
+			t.Errorf("CAPYTEST_VERBOSE=%q CAPYTEST_VERBOSE_LINES=%q: got %v, %d, want %v, %d",
+				tt.verbose, tt.lines, verbose, limit, tt.wantVerbose, tt.wantLimit)
+		}
+	}
+}
+
+func TestWithVerboseLineLimit(t *testing.T) {
+	t.Setenv("CAPYTEST_VERBOSE_LINES", "5")
+
+	s := NewTestSuite(t, nil).(*testSuite)
+	if got := s.runner(t).(*runner).lineLimit; got != 5 {
+		t.Errorf("limit = %d, want 5 from CAPYTEST_VERBOSE_LINES", got)
+	}
+	s = NewTestSuite(t, nil, WithVerboseLineLimit(3)).(*testSuite)
+	if got := s.runner(t).(*runner).lineLimit; got != 3 {
+		t.Errorf("limit = %d, want 3 from WithVerboseLineLimit", got)
+	}
+}